@@ -34,7 +34,9 @@ func NewApplication(configPath string) (*Application, error) {
 	}
 
 	// Инициализация маршрутов
-	app.initRoutes()
+	if err := app.initRoutes(); err != nil {
+		return nil, fmt.Errorf("on routes init: %w", err)
+	}
 
 	return app, nil
 }
@@ -51,10 +53,19 @@ func (app *Application) Shutdown() error {
 	return app.Server.Shutdown(ctx)
 }
 
-func (app *Application) initRoutes() {
+func (app *Application) initRoutes() error {
 	// Создаем HTTP-обработчики
+	// Один обработчик на все режимы, чтобы они использовали общий кэш
+	imageHandler, err := handler.NewImageHandler(app.Config, app.Logger)
+	if err != nil {
+		return err
+	}
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/fill/", handler.NewImageHandler(app.Config, app.Logger))
+	mux.HandleFunc("/fill/", imageHandler)
+	mux.HandleFunc("/fit/", imageHandler)
+	mux.HandleFunc("/pad/", imageHandler)
+	mux.HandleFunc("/process/", imageHandler)
 
 	// Настраиваем сервер
 	app.Server = &http.Server{
@@ -62,4 +73,5 @@ func (app *Application) initRoutes() {
 		Handler:           mux,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
+	return nil
 }
@@ -2,12 +2,20 @@ package config
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+const (
+	defaultQuality             = 95
+	defaultAnimationMaxFrames  = 200
+	defaultMaxSourceSize       = 20 << 20
+	defaultMaxSourceResolution = 50
+)
+
 type Config struct {
 	AppPort         string
 	CacheSize       int
@@ -15,6 +23,58 @@ type Config struct {
 	LogLevel        logrus.Level
 	ShutdownTimeout time.Duration
 	DisableLogging  bool
+	// Quality - качество сжатия JPEG и WebP по умолчанию, от 1 до 100. Значение по умолчанию совпадает
+	// с качеством JPEG в imaging, поэтому без настройки результат не меняется.
+	Quality int
+	// ResizeFilter - фильтр интерполяции по умолчанию, например lanczos или linear.
+	ResizeFilter string
+	// Upscale - политика увеличения изображений меньше запрошенного размера: allow, deny или коэффициент вида 2x.
+	Upscale string
+	// WatermarkDir - каталог с файлами водяных знаков. Пустое значение отключает водяные знаки.
+	WatermarkDir string
+	// Watermark - имя файла водяного знака, который накладывается на все изображения.
+	// Если он задан, параметры водяного знака из запроса не учитываются.
+	Watermark         string
+	WatermarkPosition string
+	WatermarkOffset   int
+	WatermarkScale    float64
+	WatermarkOpacity  float64
+	// AnimationMaxFrames - наибольшее число кадров анимированного GIF, которые обрабатываются покадрово.
+	// Из анимаций с большим числом кадров берется только первый кадр.
+	AnimationMaxFrames int
+	// MaxSourceSize - наибольший размер исходного изображения в байтах. Ноль снимает ограничение.
+	MaxSourceSize int64
+	// MaxSourceResolution - наибольшее разрешение исходного изображения в мегапикселях. Ноль снимает ограничение.
+	MaxSourceResolution float64
+	// SourceScheme - схема загрузки исходных изображений, URL которых указан без схемы: http или https.
+	SourceScheme string
+	// TLSCAFile - файл PEM с сертификатами удостоверяющих центров, которые дополняют системные.
+	TLSCAFile string
+	// TLSInsecureSkipVerify отключает проверку сертификатов HTTPS. Только для тестовых окружений.
+	TLSInsecureSkipVerify bool
+	// ForwardHeaders - заголовки запроса клиента, которые передаются серверу источника. Значение * разрешает
+	// все заголовки, кроме ForwardHeadersDeny.
+	ForwardHeaders []string
+	// ForwardHeadersDeny - заголовки запроса клиента, которые никогда не передаются серверу источника.
+	ForwardHeadersDeny []string
+	// SourceHeaders - постоянные заголовки для серверов источника в виде записей "<host> <name>: <value>",
+	// разделенных точкой с запятой.
+	SourceHeaders string
+	// UserAgent - заголовок User-Agent запросов к серверам источника. Пустое значение передает заголовок клиента,
+	// если он разрешен ForwardHeaders.
+	UserAgent string
+	// BlockPrivateNetworks запрещает загрузку изображений с локальных, частных и link-local адресов.
+	BlockPrivateNetworks bool
+	// BlockedNetworks - дополнительно запрещенные сети CIDR и IP-адреса.
+	BlockedNetworks []string
+	// TrustedSources - доверенные сети CIDR, IP-адреса и хосты с необязательным портом,
+	// загрузка с которых разрешена независимо от запретов.
+	TrustedSources []string
+	// AllowedSources - шаблоны хостов, с которых разрешена загрузка изображений: точное имя, *.example.com
+	// или регулярное выражение после ~. Пустой список разрешает все хосты.
+	AllowedSources []string
+	// DeniedSources - шаблоны хостов, с которых загрузка запрещена, даже если они разрешены AllowedSources.
+	DeniedSources []string
 }
 
 func Load(configPath string) (*Config, error) {
@@ -31,6 +91,30 @@ func Load(configPath string) (*Config, error) {
 	v.SetDefault("log_level", "info")
 	v.SetDefault("shutdown_timeout", "5s")
 	v.SetDefault("disable_logging", false)
+	v.SetDefault("quality", defaultQuality)
+	v.SetDefault("resize_filter", "lanczos")
+	v.SetDefault("upscale", "allow")
+	v.SetDefault("watermark_dir", "")
+	v.SetDefault("watermark", "")
+	v.SetDefault("watermark_position", "soea")
+	v.SetDefault("watermark_offset", 0)
+	v.SetDefault("watermark_scale", 0)
+	v.SetDefault("watermark_opacity", 1)
+	v.SetDefault("animation_max_frames", defaultAnimationMaxFrames)
+	v.SetDefault("max_source_size", defaultMaxSourceSize)
+	v.SetDefault("max_source_resolution", defaultMaxSourceResolution)
+	v.SetDefault("source_scheme", "http")
+	v.SetDefault("tls_ca_file", "")
+	v.SetDefault("tls_insecure_skip_verify", false)
+	v.SetDefault("forward_headers", "")
+	v.SetDefault("forward_headers_deny", "Cookie,Authorization,Proxy-Authorization")
+	v.SetDefault("source_headers", "")
+	v.SetDefault("user_agent", "image-previewer")
+	v.SetDefault("block_private_networks", true)
+	v.SetDefault("blocked_networks", "")
+	v.SetDefault("trusted_sources", "")
+	v.SetDefault("allowed_sources", "")
+	v.SetDefault("denied_sources", "")
 
 	// Читаем файл конфигурации
 	if err := v.ReadInConfig(); err != nil {
@@ -63,5 +147,65 @@ func Load(configPath string) (*Config, error) {
 
 	cfg.DisableLogging = v.GetBool("disable_logging")
 
+	cfg.Quality = v.GetInt("quality")
+	if cfg.Quality < 1 || cfg.Quality > 100 {
+		cfg.Quality = defaultQuality
+	}
+
+	cfg.ResizeFilter = v.GetString("resize_filter")
+	cfg.Upscale = v.GetString("upscale")
+
+	cfg.WatermarkDir = v.GetString("watermark_dir")
+	cfg.Watermark = v.GetString("watermark")
+	cfg.WatermarkPosition = v.GetString("watermark_position")
+	cfg.WatermarkOffset = v.GetInt("watermark_offset")
+	cfg.WatermarkScale = v.GetFloat64("watermark_scale")
+	cfg.WatermarkOpacity = v.GetFloat64("watermark_opacity")
+	// Без каталога обязательный водяной знак не найти, и каждый запрос завершался бы ошибкой
+	if cfg.Watermark != "" && cfg.WatermarkDir == "" {
+		return nil, errors.New("watermark is set but watermark_dir is empty")
+	}
+
+	cfg.AnimationMaxFrames = v.GetInt("animation_max_frames")
+	if cfg.AnimationMaxFrames < 1 {
+		cfg.AnimationMaxFrames = defaultAnimationMaxFrames
+	}
+
+	cfg.MaxSourceSize = v.GetInt64("max_source_size")
+	if cfg.MaxSourceSize < 0 {
+		cfg.MaxSourceSize = defaultMaxSourceSize
+	}
+	cfg.MaxSourceResolution = v.GetFloat64("max_source_resolution")
+	if !(cfg.MaxSourceResolution >= 0) {
+		cfg.MaxSourceResolution = defaultMaxSourceResolution
+	}
+
+	cfg.SourceScheme = v.GetString("source_scheme")
+	cfg.TLSCAFile = v.GetString("tls_ca_file")
+	cfg.TLSInsecureSkipVerify = v.GetBool("tls_insecure_skip_verify")
+
+	cfg.ForwardHeaders = splitList(v.GetString("forward_headers"))
+	cfg.ForwardHeadersDeny = splitList(v.GetString("forward_headers_deny"))
+	cfg.SourceHeaders = v.GetString("source_headers")
+	cfg.UserAgent = v.GetString("user_agent")
+
+	cfg.BlockPrivateNetworks = v.GetBool("block_private_networks")
+	cfg.BlockedNetworks = splitList(v.GetString("blocked_networks"))
+	cfg.TrustedSources = splitList(v.GetString("trusted_sources"))
+
+	cfg.AllowedSources = splitList(v.GetString("allowed_sources"))
+	cfg.DeniedSources = splitList(v.GetString("denied_sources"))
+
 	return cfg, nil
 }
+
+// splitList разбирает список значений, разделенных запятыми, пропуская пустые значения.
+func splitList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -3,9 +3,12 @@ package handler
 import (
 	"context"
 	"crypto/md5" //nolint:gosec
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -18,35 +21,119 @@ import (
 	"github.com/romangricuk/image-previewer/internal/utils"
 )
 
-func NewImageHandler(cfg *config.Config, log logger.Logger) http.HandlerFunc {
+// NewImageHandler создает обработчик запросов изображений. Ошибки в настройках, которые ограничивают источники
+// изображений, возвращаются, чтобы сервис не запустился с ослабленной защитой.
+func NewImageHandler(cfg *config.Config, log logger.Logger) (http.HandlerFunc, error) {
 	lruCache := cache.NewLRUCache(cfg.CacheSize, log)
 
+	defaultFilter, err := image.ParseFilter(cfg.ResizeFilter)
+	if err != nil {
+		log.Warnf("Invalid resize filter in config, using %s: %v", image.DefaultFilter, err)
+		defaultFilter = image.DefaultFilter
+	}
+
+	defaultMaxUpscale, err := image.ParseUpscale(cfg.Upscale)
+	if err != nil {
+		log.Warnf("Invalid upscale policy in config, allowing upscaling: %v", err)
+		defaultMaxUpscale = 0
+	}
+
+	var watermarks *image.WatermarkStore
+	if cfg.WatermarkDir != "" {
+		watermarks = image.NewWatermarkStore(cfg.WatermarkDir)
+	}
+	enforcedWatermark := configWatermark(cfg, log)
+	maxPixels := int(cfg.MaxSourceResolution * 1e6)
+
+	sourceScheme, err := utils.ParseScheme(cfg.SourceScheme)
+	if err != nil {
+		log.Warnf("Invalid source scheme in config, using %s: %v", utils.SchemeHTTP, err)
+		sourceScheme = utils.SchemeHTTP
+	}
+	sourceHosts, err := utils.NewHostPolicy(cfg.AllowedSources, cfg.DeniedSources)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source host patterns: %w", err)
+	}
+	fetcher, err := newFetcher(cfg, sourceHosts, log)
+	if err != nil {
+		return nil, err
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		cacheDir := cfg.CacheDir
 
 		// Парсинг параметров запроса
-		width, height, imageURL, err := parseRequestParameters(r, log)
+		parse := parseRequestParameters
+		if strings.HasPrefix(r.URL.Path, processPrefix) {
+			parse = parseProcessParameters
+		}
+		opts, imageURL, err := parse(r, defaultMaxUpscale, log)
+		if err == nil {
+			err = validateText(opts)
+		}
+		if err == nil {
+			imageURL, err = sourceURL(imageURL, r.URL.RawQuery, sourceScheme, log)
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		cacheKey := fmt.Sprintf("%d_%d_%s", width, height, imageURL)
-		log.Infof("Processing request for image: %s with size %dx%d", imageURL, width, height)
+		// Хост источника проверяется до обращения к кэшу и загрузки
+		if host := sourceHost(imageURL); !sourceHosts.Allowed(host) {
+			log.Warnf("Source host is not allowed: %s", host)
+			http.Error(w, utils.ErrForbiddenHost.Error(), http.StatusForbidden)
+			return
+		}
+
+		// Если формат не задан явно, он выбирается по заголовку Accept,
+		// и ответ зависит от этого заголовка
+		if opts.Format == "" {
+			w.Header().Set("Vary", "Accept")
+			opts.Format = negotiateFormat(r.Header.Get("Accept"))
+			opts.AutoFormat = opts.Format != ""
+		}
+		if opts.Quality == 0 {
+			opts.Quality = cfg.Quality
+		}
+		if opts.Filter == "" {
+			opts.Filter = defaultFilter
+		}
+		opts.MaxFrames = cfg.AnimationMaxFrames
+		opts.MaxPixels = maxPixels
+
+		if err := resolveWatermark(&opts, enforcedWatermark, watermarks); err != nil {
+			log.Warnf("Failed to resolve watermark: %v", err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, errWatermarkRequest) || (errors.Is(err, image.ErrWatermarkNotFound) && enforcedWatermark == nil) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		cacheKey := buildCacheKey(opts, imageURL)
+		log.Infof("Processing request for image: %s with size %dx%d (%s)", imageURL, opts.Width, opts.Height, opts.Mode)
 
 		// Проверяем наличие в кэше
 		if cachedPath, found := getFromCache(lruCache, cacheKey, log); found {
+			if format, ok := image.FormatFromExtension(filepath.Ext(cachedPath)); ok {
+				w.Header().Set("Content-Type", format.ContentType())
+			}
 			http.ServeFile(w, r, cachedPath)
 			return
 		}
 
 		// Загрузка изображения
-		data, statusCode, err := fetchImage(ctx, r, imageURL, log)
+		data, statusCode, err := fetchImage(ctx, fetcher, r, imageURL, cfg.MaxSourceSize, log)
 		if err != nil {
-			if statusCode == http.StatusOK {
+			switch {
+			case statusCode == http.StatusOK:
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-			} else {
+			case data == nil:
+				http.Error(w, err.Error(), statusCode)
+			default:
 				w.WriteHeader(statusCode)
 				w.Write(data)
 			}
@@ -60,45 +147,709 @@ func NewImageHandler(cfg *config.Config, log logger.Logger) http.HandlerFunc {
 		}
 
 		// Изменение размера изображения
-		resizedData, err := resizeImage(ctx, data, width, height, log)
+		resizedData, format, err := resizeImage(ctx, data, opts, log)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			status := http.StatusInternalServerError
+			if errors.Is(err, image.ErrFrameNotFound) || errors.Is(err, image.ErrTooManyPixels) {
+				status = http.StatusUnprocessableEntity
+			}
+			http.Error(w, err.Error(), status)
 			return
 		}
 
 		// Сохранение в кэш
-		if err := saveToCache(cacheDir, cacheKey, resizedData, lruCache, log); err != nil {
+		if err := saveToCache(cacheDir, cacheKey, resizedData, format, lruCache, log); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Отправка изображения клиенту
-		sendImageResponse(w, resizedData)
-	}
+		sendImageResponse(w, resizedData, format)
+	}, nil
 }
 
-func parseRequestParameters(r *http.Request, log logger.Logger) (int, int, string, error) {
-	parts := strings.SplitN(r.URL.Path, "/", 5)
+func parseRequestParameters(r *http.Request, maxUpscale float64, log logger.Logger) (image.Options, string, error) {
+	// URL изображения может содержать экранированные символы, поэтому путь разбирается в исходном виде
+	parts := strings.SplitN(r.URL.EscapedPath(), "/", 5)
 	if len(parts) < 5 {
 		log.Warn("Invalid URL format")
-		return 0, 0, "", fmt.Errorf("invalid URL format")
+		return image.Options{}, "", fmt.Errorf("invalid URL format")
 	}
 
-	width, err := strconv.Atoi(parts[2])
+	mode, err := image.ParseResizeMode(parts[1])
 	if err != nil {
-		log.Warnf("Invalid width: %v", err)
-		return 0, 0, "", fmt.Errorf("invalid width")
+		log.Warnf("Invalid resize mode: %v", err)
+		return image.Options{}, "", fmt.Errorf("invalid resize mode")
+	}
+
+	width, err := strconv.Atoi(parts[2])
+	if err != nil || width < 1 {
+		log.Warnf("Invalid width: %s", parts[2])
+		return image.Options{}, "", fmt.Errorf("invalid width")
 	}
 
 	height, err := strconv.Atoi(parts[3])
+	if err != nil || height < 1 {
+		log.Warnf("Invalid height: %s", parts[3])
+		return image.Options{}, "", fmt.Errorf("invalid height")
+	}
+
+	opts := image.Options{
+		Mode:    mode,
+		Width:   width,
+		Height:  height,
+		Gravity: image.GravityCenter,
+		// Политика увеличения из конфигурации может быть переопределена опцией запроса
+		MaxUpscale: maxUpscale,
+	}
+
+	imageURL, err := parseOptions(parts[4], &opts)
+	if err != nil {
+		log.Warnf("Invalid options: %v", err)
+		return image.Options{}, "", err
+	}
+
+	return opts, imageURL, nil
+}
+
+// processPrefix - префикс пути запросов с операциями обработки в виде опций.
+const processPrefix = "/process/"
+
+// Маркеры, которые отделяют опции от URL изображения: за plain следует URL, в котором допускается
+// процентное кодирование, а за b64 - URL, закодированный в base64url. В запросах /process/ маркер обязателен.
+const (
+	plainURLMarker  = "plain"
+	base64URLMarker = "b64"
+)
+
+// parseProcessParameters разбирает путь вида /process/<name>:<value>/.../plain/<url> или .../b64/<base64url>
+// и возвращает URL изображения вместе с маркером.
+// Размер задается опцией rs:<mode>:<width>:<height>, без нее размер изображения не меняется.
+func parseProcessParameters(r *http.Request, maxUpscale float64, log logger.Logger) (image.Options, string, error) {
+	path := strings.TrimPrefix(r.URL.EscapedPath(), processPrefix)
+	opts := image.Options{
+		Gravity:    image.GravityCenter,
+		MaxUpscale: maxUpscale,
+	}
+
+	for {
+		segment, rest, found := strings.Cut(path, "/")
+		if !found {
+			log.Warn("Missing image URL in process request")
+			return image.Options{}, "", fmt.Errorf("missing %s/<url> after options", plainURLMarker)
+		}
+		if segment == plainURLMarker || segment == base64URLMarker {
+			if err := requireResize(opts); err != nil {
+				log.Warnf("Invalid options: %v", err)
+				return image.Options{}, "", err
+			}
+			return opts, path, nil
+		}
+
+		segment, err := url.PathUnescape(segment)
+		if err != nil {
+			log.Warnf("Invalid option encoding: %v", err)
+			return image.Options{}, "", fmt.Errorf("invalid option encoding")
+		}
+		name, value, _ := strings.Cut(segment, ":")
+		parser, known := optionParsers[name]
+		if name == "rs" || name == "resize" {
+			parser, known = parseResizeOption, true
+		}
+		if !known {
+			log.Warnf("Unknown option: %s", name)
+			return image.Options{}, "", fmt.Errorf("unknown option %s", name)
+		}
+		if err := parser(value, &opts); err != nil {
+			log.Warnf("Invalid options: %v", err)
+			return image.Options{}, "", fmt.Errorf("invalid option %s: %w", name, err)
+		}
+		path = rest
+	}
+}
+
+// requireResize проверяет, что коррекции, водяной знак и надпись заданы вместе с опцией rs. Без нее они
+// выполнялись бы над исходным изображением полного разрешения, и время обработки не ограничивалось бы
+// размером результата. Обязательный водяной знак из конфигурации добавляется позже и не проверяется.
+func requireResize(opts image.Options) error {
+	if opts.Mode != "" {
+		return nil
+	}
+	switch {
+	case opts.HasAdjustments():
+		return fmt.Errorf("adjustments require rs option")
+	case opts.Watermark != nil:
+		return fmt.Errorf("watermark requires rs option")
+	case opts.Text != nil:
+		return fmt.Errorf("text requires rs option")
+	}
+	return nil
+}
+
+// parseResizeOption разбирает значение опции вида <mode>:<width>:<height>.
+func parseResizeOption(value string, opts *image.Options) error {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("resize must be in format mode:width:height: %s", value)
+	}
+
+	mode, err := image.ParseResizeMode(parts[0])
+	if err != nil {
+		return err
+	}
+	width, err := strconv.Atoi(parts[1])
+	if err != nil || width < 1 {
+		return fmt.Errorf("invalid width: %s", parts[1])
+	}
+	height, err := strconv.Atoi(parts[2])
+	if err != nil || height < 1 {
+		return fmt.Errorf("invalid height: %s", parts[2])
+	}
+
+	opts.Mode = mode
+	opts.Width = width
+	opts.Height = height
+	return nil
+}
+
+// optionParsers сопоставляет имя опции в URL с функцией её разбора.
+var optionParsers = map[string]func(value string, opts *image.Options) error{
+	"g":           parseGravityOption,
+	"gravity":     parseGravityOption,
+	"fp":          parseFocusPointOption,
+	"f":           parseFormatOption,
+	"format":      parseFormatOption,
+	"ll":          parseLosslessOption,
+	"lossless":    parseLosslessOption,
+	"q":           parseQualityOption,
+	"quality":     parseQualityOption,
+	"pr":          parseProgressiveOption,
+	"progressive": parseProgressiveOption,
+	"ar":          parseAutoRotateOption,
+	"auto_rotate": parseAutoRotateOption,
+	"rf":          parseFilterOption,
+	"resample":    parseFilterOption,
+	"up":          parseUpscaleOption,
+	"upscale":     parseUpscaleOption,
+	"bg":          parseBackgroundOption,
+	"background":  parseBackgroundOption,
+	"bl":          parseBlurOption,
+	"blur":        parseBlurOption,
+	"sh":          parseSharpenOption,
+	"sharpen":     parseSharpenOption,
+	"br":          parseBrightnessOption,
+	"brightness":  parseBrightnessOption,
+	"co":          parseContrastOption,
+	"contrast":    parseContrastOption,
+	"gm":          parseGammaOption,
+	"gamma":       parseGammaOption,
+	"gs":          parseGrayscaleOption,
+	"grayscale":   parseGrayscaleOption,
+	"rot":         parseRotateOption,
+	"rotate":      parseRotateOption,
+	"flip":        parseFlipOption,
+	"frame":       parseFrameOption,
+	"still":       parseStillOption,
+	// Параметры водяного знака
+	"wm":                 parseWatermarkOption,
+	"watermark":          parseWatermarkOption,
+	"wm_pos":             parseWatermarkPositionOption,
+	"watermark_position": parseWatermarkPositionOption,
+	"wm_off":             parseWatermarkOffsetOption,
+	"watermark_offset":   parseWatermarkOffsetOption,
+	"wm_scale":           parseWatermarkScaleOption,
+	"watermark_scale":    parseWatermarkScaleOption,
+	"wm_op":              parseWatermarkOpacityOption,
+	"watermark_opacity":  parseWatermarkOpacityOption,
+	// Параметры надписи
+	"txt":         parseTextOption,
+	"text":        parseTextOption,
+	"txt_size":    parseTextSizeOption,
+	"text_size":   parseTextSizeOption,
+	"txt_color":   parseTextColorOption,
+	"text_color":  parseTextColorOption,
+	"txt_pos":     parseTextPositionOption,
+	"text_pos":    parseTextPositionOption,
+	"txt_off":     parseTextOffsetOption,
+	"text_offset": parseTextOffsetOption,
+	"txt_shadow":  parseTextShadowOption,
+	"text_shadow": parseTextShadowOption,
+}
+
+// parseOptions разбирает сегменты вида <name>:<value>, идущие перед URL изображения,
+// и возвращает оставшуюся часть пути как URL изображения.
+func parseOptions(path string, opts *image.Options) (string, error) {
+	for {
+		segment, rest, found := strings.Cut(path, "/")
+		if !found {
+			return path, nil
+		}
+
+		segment, err := url.PathUnescape(segment)
+		if err != nil {
+			return path, nil
+		}
+		name, value, isOption := strings.Cut(segment, ":")
+		parser, known := optionParsers[name]
+		if !isOption || !known {
+			return path, nil
+		}
+
+		if err := parser(value, opts); err != nil {
+			return "", fmt.Errorf("invalid option %s: %w", name, err)
+		}
+		path = rest
+	}
+}
+
+func parseGravityOption(value string, opts *image.Options) error {
+	gravity, err := image.ParseGravity(value)
+	if err != nil {
+		return err
+	}
+	opts.Gravity = gravity
+	return nil
+}
+
+func parseFocusPointOption(value string, opts *image.Options) error {
+	x, y, err := image.ParseFocusPoint(value)
+	if err != nil {
+		return err
+	}
+	opts.Gravity = image.GravityFocusPoint
+	opts.FocusX = x
+	opts.FocusY = y
+	return nil
+}
+
+func parseFormatOption(value string, opts *image.Options) error {
+	format, err := image.ParseFormat(value)
+	if err != nil {
+		return err
+	}
+	opts.Format = format
+	return nil
+}
+
+func parseLosslessOption(value string, opts *image.Options) error {
+	lossless, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	opts.Lossless = lossless
+	return nil
+}
+
+func parseQualityOption(value string, opts *image.Options) error {
+	quality, err := image.ParseQuality(value)
+	if err != nil {
+		return err
+	}
+	opts.Quality = quality
+	return nil
+}
+
+func parseProgressiveOption(value string, opts *image.Options) error {
+	progressive, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	opts.Progressive = progressive
+	return nil
+}
+
+func parseAutoRotateOption(value string, opts *image.Options) error {
+	autoRotate, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	opts.IgnoreOrientation = !autoRotate
+	return nil
+}
+
+func parseFilterOption(value string, opts *image.Options) error {
+	filter, err := image.ParseFilter(value)
+	if err != nil {
+		return err
+	}
+	opts.Filter = filter
+	return nil
+}
+
+func parseUpscaleOption(value string, opts *image.Options) error {
+	maxUpscale, err := image.ParseUpscale(value)
+	if err != nil {
+		return err
+	}
+	opts.MaxUpscale = maxUpscale
+	return nil
+}
+
+func parseBackgroundOption(value string, opts *image.Options) error {
+	background, err := image.ParseColor(value)
+	if err != nil {
+		return err
+	}
+	opts.Background = &background
+	return nil
+}
+
+func parseBlurOption(value string, opts *image.Options) error {
+	blur, err := image.ParseBlur(value)
+	if err != nil {
+		return err
+	}
+	opts.Blur = blur
+	return nil
+}
+
+func parseSharpenOption(value string, opts *image.Options) error {
+	sharpen, err := image.ParseSharpen(value)
+	if err != nil {
+		return err
+	}
+	opts.Sharpen = sharpen
+	return nil
+}
+
+func parseBrightnessOption(value string, opts *image.Options) error {
+	brightness, err := image.ParseBrightness(value)
+	if err != nil {
+		return err
+	}
+	opts.Brightness = brightness
+	return nil
+}
+
+func parseContrastOption(value string, opts *image.Options) error {
+	contrast, err := image.ParseContrast(value)
+	if err != nil {
+		return err
+	}
+	opts.Contrast = contrast
+	return nil
+}
+
+func parseGammaOption(value string, opts *image.Options) error {
+	gamma, err := image.ParseGamma(value)
 	if err != nil {
-		log.Warnf("Invalid height: %v", err)
-		return 0, 0, "", fmt.Errorf("invalid height")
+		return err
 	}
+	opts.Gamma = gamma
+	return nil
+}
+
+func parseGrayscaleOption(value string, opts *image.Options) error {
+	grayscale, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	opts.Grayscale = grayscale
+	return nil
+}
+
+func parseRotateOption(value string, opts *image.Options) error {
+	angle, err := image.ParseRotation(value)
+	if err != nil {
+		return err
+	}
+	opts.Rotate = angle
+	return nil
+}
+
+func parseFlipOption(value string, opts *image.Options) error {
+	horizontal, vertical, err := image.ParseFlip(value)
+	if err != nil {
+		return err
+	}
+	opts.FlipH = horizontal
+	opts.FlipV = vertical
+	return nil
+}
+
+func parseFrameOption(value string, opts *image.Options) error {
+	frame, err := image.ParseFrame(value)
+	if err != nil {
+		return err
+	}
+	opts.Still = true
+	opts.Frame = frame
+	return nil
+}
+
+func parseStillOption(value string, opts *image.Options) error {
+	still, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	// still:1 выбирает первый кадр, если номер кадра не задан опцией frame
+	opts.Still = still
+	if !still {
+		opts.Frame = 0
+	}
+	return nil
+}
+
+// requestWatermark возвращает водяной знак из параметров запроса, создавая его
+// с параметрами по умолчанию при разборе первой опции водяного знака.
+func requestWatermark(opts *image.Options) *image.Watermark {
+	if opts.Watermark == nil {
+		opts.Watermark = &image.Watermark{Position: image.DefaultWatermarkPosition, Opacity: 1}
+	}
+	return opts.Watermark
+}
+
+func parseWatermarkOption(value string, opts *image.Options) error {
+	if value == "" {
+		return fmt.Errorf("watermark name is required")
+	}
+	requestWatermark(opts).Name = value
+	return nil
+}
+
+func parseWatermarkPositionOption(value string, opts *image.Options) error {
+	position, err := image.ParseWatermarkPosition(value)
+	if err != nil {
+		return err
+	}
+	requestWatermark(opts).Position = position
+	return nil
+}
+
+func parseWatermarkOffsetOption(value string, opts *image.Options) error {
+	x, y, err := image.ParseOffset(value)
+	if err != nil {
+		return err
+	}
+	wm := requestWatermark(opts)
+	wm.OffsetX, wm.OffsetY = x, y
+	return nil
+}
+
+func parseWatermarkScaleOption(value string, opts *image.Options) error {
+	scale, err := image.ParseWatermarkScale(value)
+	if err != nil {
+		return err
+	}
+	requestWatermark(opts).Scale = scale
+	return nil
+}
+
+func parseWatermarkOpacityOption(value string, opts *image.Options) error {
+	opacity, err := image.ParseOpacity(value)
+	if err != nil {
+		return err
+	}
+	requestWatermark(opts).Opacity = opacity
+	return nil
+}
+
+// requestText возвращает надпись из параметров запроса, создавая ее
+// с параметрами по умолчанию при разборе первой опции надписи.
+func requestText(opts *image.Options) *image.Text {
+	if opts.Text == nil {
+		opts.Text = &image.Text{
+			Size:     image.DefaultTextSize,
+			Color:    image.DefaultTextColor,
+			Position: image.DefaultTextPosition,
+		}
+	}
+	return opts.Text
+}
+
+func parseTextOption(value string, opts *image.Options) error {
+	text, err := image.DecodeText(value)
+	if err != nil {
+		return err
+	}
+	requestText(opts).Text = text
+	return nil
+}
+
+func parseTextSizeOption(value string, opts *image.Options) error {
+	size, err := image.ParseTextSize(value)
+	if err != nil {
+		return err
+	}
+	requestText(opts).Size = size
+	return nil
+}
+
+func parseTextColorOption(value string, opts *image.Options) error {
+	c, err := image.ParseColor(value)
+	if err != nil {
+		return err
+	}
+	requestText(opts).Color = c
+	return nil
+}
+
+func parseTextPositionOption(value string, opts *image.Options) error {
+	position, err := image.ParseTextPosition(value)
+	if err != nil {
+		return err
+	}
+	requestText(opts).Position = position
+	return nil
+}
+
+func parseTextOffsetOption(value string, opts *image.Options) error {
+	x, y, err := image.ParseOffset(value)
+	if err != nil {
+		return err
+	}
+	t := requestText(opts)
+	t.OffsetX, t.OffsetY = x, y
+	return nil
+}
+
+func parseTextShadowOption(value string, opts *image.Options) error {
+	shadow, err := image.ParseColor(value)
+	if err != nil {
+		return err
+	}
+	requestText(opts).Shadow = &shadow
+	return nil
+}
+
+// validateText проверяет, что параметры надписи заданы вместе с самим текстом.
+func validateText(opts image.Options) error {
+	if opts.Text == nil {
+		return nil
+	}
+	if opts.Text.Text == "" {
+		return fmt.Errorf("text options require text")
+	}
+	return opts.Text.Validate()
+}
+
+// errWatermarkRequest - ошибка в параметрах водяного знака из запроса.
+var errWatermarkRequest = errors.New("invalid watermark request")
+
+// configWatermark возвращает водяной знак, который конфигурация требует накладывать на все изображения,
+// или nil. Некорректные параметры заменяются значениями по умолчанию.
+func configWatermark(cfg *config.Config, log logger.Logger) *image.Watermark {
+	if cfg.Watermark == "" {
+		return nil
+	}
+
+	wm := &image.Watermark{Name: cfg.Watermark, Position: image.DefaultWatermarkPosition, Opacity: 1}
+	if position, err := image.ParseWatermarkPosition(cfg.WatermarkPosition); err == nil {
+		wm.Position = position
+	} else {
+		log.Warnf("Invalid watermark position in config, using %s: %v", wm.Position, err)
+	}
+	if cfg.WatermarkOffset > 0 {
+		wm.OffsetX, wm.OffsetY = cfg.WatermarkOffset, cfg.WatermarkOffset
+	}
+	if cfg.WatermarkScale > 0 && cfg.WatermarkScale <= 1 {
+		wm.Scale = cfg.WatermarkScale
+	}
+	if cfg.WatermarkOpacity >= 0 && cfg.WatermarkOpacity <= 1 {
+		wm.Opacity = cfg.WatermarkOpacity
+	}
+	return wm
+}
+
+// resolveWatermark подставляет обязательный водяной знак из конфигурации вместо параметров запроса
+// и загружает изображение водяного знака.
+func resolveWatermark(opts *image.Options, enforced *image.Watermark, store *image.WatermarkStore) error {
+	if enforced != nil {
+		wm := *enforced
+		opts.Watermark = &wm
+	}
+	if opts.Watermark == nil {
+		return nil
+	}
+
+	if store == nil {
+		// Водяной знак из конфигурации без каталога - ошибка настройки сервера, а не запроса
+		if enforced != nil {
+			return errors.New("watermark directory is not configured")
+		}
+		return fmt.Errorf("%w: watermarks are not configured", errWatermarkRequest)
+	}
+	if opts.Watermark.Name == "" {
+		return fmt.Errorf("%w: watermark name is required", errWatermarkRequest)
+	}
+
+	img, err := store.Get(opts.Watermark.Name)
+	if err != nil {
+		return err
+	}
+	opts.Watermark.Image = img
+	return nil
+}
+
+// negotiateFormat выбирает формат результата по заголовку Accept. Пустое значение означает
+// формат исходного изображения. WebP выбирается, только если клиент перечислил image/webp явно:
+// маски вида image/* присылают и клиенты, которые его не поддерживают.
+func negotiateFormat(accept string) image.Format {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(mediaRange, ";")
+		if strings.EqualFold(strings.TrimSpace(mediaType), image.FormatWebP.ContentType()) && acceptQuality(params) > 0 {
+			return image.FormatWebP
+		}
+	}
+	return ""
+}
+
+// acceptQuality возвращает вес q из параметров диапазона заголовка Accept, по умолчанию 1.
+func acceptQuality(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(name, "q") {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return 0
+			}
+			return q
+		}
+	}
+	return 1
+}
+
+// sourceURL преобразует часть пути запроса с URL изображения в канонический абсолютный URL.
+// URL после маркера b64 декодируется из base64url, иначе снимается процентное кодирование,
+// а параметры запроса к сервису становятся параметрами URL изображения.
+func sourceURL(path, query, defaultScheme string, log logger.Logger) (string, error) {
+	if encoded, ok := strings.CutPrefix(path, base64URLMarker+"/"); ok {
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil {
+			log.Warnf("Invalid base64 image URL: %v", err)
+			return "", fmt.Errorf("invalid base64 image URL")
+		}
+		return utils.SourceURL(string(decoded), defaultScheme)
+	}
+
+	path, err := url.PathUnescape(strings.TrimPrefix(path, plainURLMarker+"/"))
+	if err != nil {
+		log.Warnf("Invalid image URL encoding: %v", err)
+		return "", fmt.Errorf("invalid image URL encoding")
+	}
+	if query != "" {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		path += separator + query
+	}
+	return utils.SourceURL(path, defaultScheme)
+}
 
-	imageURL := parts[4]
+// sourceHost возвращает имя хоста из URL изображения без порта.
+func sourceHost(imageURL string) string {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
 
-	return width, height, imageURL, nil
+// buildCacheKey формирует ключ кэша из канонической записи параметров обработки и URL изображения,
+// поэтому запросы с одинаковыми параметрами, заданными в разном порядке или синтаксисе, используют одну запись.
+func buildCacheKey(opts image.Options, imageURL string) string {
+	return opts.String() + "/" + plainURLMarker + "/" + imageURL
 }
 
 func getFromCache(cache *cache.LRUCache, cacheKey string, log logger.Logger) (string, bool) {
@@ -110,8 +861,69 @@ func getFromCache(cache *cache.LRUCache, cacheKey string, log logger.Logger) (st
 	return "", false
 }
 
-func fetchImage(ctx context.Context, r *http.Request, imageURL string, log logger.Logger) ([]byte, int, error) {
-	resp, err := utils.FetchImage(ctx, r, imageURL, log)
+// newFetcher создает загрузчик исходных изображений с настройками TLS, передачи заголовков и ограничения адресов
+// из конфигурации. Если файл сертификатов не удалось загрузить, используются только системные сертификаты,
+// а постоянные заголовки и доверенные сети с ошибкой в записи не учитываются. Ошибка в списке запрещенных сетей
+// возвращается: без него загрузка была бы разрешена из сетей, которые требовалось запретить.
+func newFetcher(cfg *config.Config, hosts *utils.HostPolicy, log logger.Logger) (*utils.Fetcher, error) {
+	hostHeaders, err := utils.ParseHostHeaders(cfg.SourceHeaders)
+	if err != nil {
+		log.Errorf("Invalid source headers in config, ignoring them: %v", err)
+	}
+	blocked, err := utils.ParseNetworks(cfg.BlockedNetworks, false)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blocked networks: %w", err)
+	}
+	trusted, err := utils.ParseNetworks(cfg.TrustedSources, true)
+	if err != nil {
+		log.Errorf("Invalid trusted sources in config, ignoring them: %v", err)
+	}
+	opts := utils.FetcherOptions{
+		CAFile:               cfg.TLSCAFile,
+		InsecureSkipVerify:   cfg.TLSInsecureSkipVerify,
+		ForwardHeaders:       cfg.ForwardHeaders,
+		DenyHeaders:          cfg.ForwardHeadersDeny,
+		HostHeaders:          hostHeaders,
+		UserAgent:            cfg.UserAgent,
+		BlockPrivateNetworks: cfg.BlockPrivateNetworks,
+		BlockedNetworks:      blocked,
+		TrustedNetworks:      trusted,
+		Hosts:                hosts,
+	}
+	if opts.InsecureSkipVerify {
+		log.Warn("TLS certificate verification of source servers is disabled")
+	}
+	fetcher, err := utils.NewFetcher(opts)
+	if err != nil {
+		log.Errorf("Failed to load CA file, using system certificates: %v", err)
+		opts.CAFile = ""
+		fetcher, _ = utils.NewFetcher(opts)
+	}
+	return fetcher, nil
+}
+
+// errSourceTooLarge возвращается, если ответ с исходным изображением больше допустимого размера.
+var errSourceTooLarge = errors.New("source image exceeds the size limit")
+
+// fetchImage загружает исходное изображение. Ответ больше maxSize байт не читается целиком
+// и приводит к ошибке 413. Нулевое значение maxSize снимает ограничение.
+func fetchImage(
+	ctx context.Context,
+	fetcher *utils.Fetcher,
+	r *http.Request,
+	imageURL string,
+	maxSize int64,
+	log logger.Logger,
+) ([]byte, int, error) {
+	resp, err := fetcher.FetchImage(ctx, r, imageURL, log)
+	if errors.Is(err, utils.ErrForbiddenAddress) {
+		log.Warnf("Refused to fetch image from forbidden address: %v", err)
+		return nil, http.StatusForbidden, utils.ErrForbiddenAddress
+	}
+	if errors.Is(err, utils.ErrForbiddenHost) {
+		log.Warnf("Refused to follow redirect to forbidden host: %v", err)
+		return nil, http.StatusForbidden, utils.ErrForbiddenHost
+	}
 	if err != nil {
 		log.Errorf("Failed to fetch image: %v", err)
 		return nil, http.StatusBadGateway, fmt.Errorf("failed to fetch image")
@@ -120,11 +932,20 @@ func fetchImage(ctx context.Context, r *http.Request, imageURL string, log logge
 
 	if resp.StatusCode != http.StatusOK {
 		log.Warnf("Remote server returned status code: %d", resp.StatusCode)
-		body, _ := io.ReadAll(resp.Body)
+		body, _ := readBody(resp.Body, maxSize)
 		return body, resp.StatusCode, fmt.Errorf("remote server error")
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	// Заявленный размер проверяется до чтения, фактический - при чтении
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		log.Warnf("Remote image is too large: %d bytes, limit %d", resp.ContentLength, maxSize)
+		return nil, http.StatusRequestEntityTooLarge, errSourceTooLarge
+	}
+	data, err := readBody(resp.Body, maxSize)
+	if errors.Is(err, errSourceTooLarge) {
+		log.Warnf("Remote image is larger than %d bytes", maxSize)
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
 	if err != nil {
 		log.Errorf("Failed to read image data: %v", err)
 		return nil, http.StatusInternalServerError, fmt.Errorf("failed to read image data")
@@ -133,6 +954,21 @@ func fetchImage(ctx context.Context, r *http.Request, imageURL string, log logge
 	return data, http.StatusOK, nil
 }
 
+// readBody читает тело ответа, но не больше maxSize байт. Нулевое значение maxSize снимает ограничение.
+func readBody(body io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(body)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errSourceTooLarge
+	}
+	return data, nil
+}
+
 func validateImage(data []byte, log logger.Logger) error {
 	contentType := http.DetectContentType(data)
 	if !strings.HasPrefix(contentType, "image/") {
@@ -142,17 +978,31 @@ func validateImage(data []byte, log logger.Logger) error {
 	return nil
 }
 
-func resizeImage(ctx context.Context, data []byte, width, height int, log logger.Logger) ([]byte, error) {
-	resizedData, err := image.ResizeImage(ctx, data, width, height, log)
+func resizeImage(
+	ctx context.Context,
+	data []byte,
+	opts image.Options,
+	log logger.Logger,
+) ([]byte, image.Format, error) {
+	resizedData, format, err := image.ResizeImage(ctx, data, opts, log)
 	if err != nil {
 		log.Errorf("Failed to resize image: %v", err)
-		return nil, fmt.Errorf("failed to resize image")
+		if errors.Is(err, image.ErrFrameNotFound) || errors.Is(err, image.ErrTooManyPixels) {
+			return nil, "", err
+		}
+		return nil, "", fmt.Errorf("failed to resize image")
 	}
-	return resizedData, nil
+	return resizedData, format, nil
 }
 
-func saveToCache(cacheDir, cacheKey string, data []byte, cache *cache.LRUCache, log logger.Logger) error {
-	cacheFileName := fmt.Sprintf("%x.jpg", md5.Sum([]byte(cacheKey))) //nolint:gosec
+func saveToCache(
+	cacheDir, cacheKey string,
+	data []byte,
+	format image.Format,
+	cache *cache.LRUCache,
+	log logger.Logger,
+) error {
+	cacheFileName := fmt.Sprintf("%x%s", md5.Sum([]byte(cacheKey)), format.Extension()) //nolint:gosec
 	cachePath := filepath.Join(cacheDir, cacheFileName)
 
 	if err := os.WriteFile(cachePath, data, 0o600); err != nil {
@@ -165,7 +1015,7 @@ func saveToCache(cacheDir, cacheKey string, data []byte, cache *cache.LRUCache,
 	return nil
 }
 
-func sendImageResponse(w http.ResponseWriter, data []byte) {
-	w.Header().Set("Content-Type", "image/jpeg")
+func sendImageResponse(w http.ResponseWriter, data []byte, format image.Format) {
+	w.Header().Set("Content-Type", format.ContentType())
 	w.Write(data)
 }
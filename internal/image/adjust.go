@@ -0,0 +1,111 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+)
+
+// Допустимые значения коррекций изображения.
+const (
+	// Время размытия и повышения резкости растет пропорционально сигме.
+	maxBlurSigma    = 10
+	maxSharpenSigma = 10
+	// Яркость и контраст задаются в процентах изменения.
+	maxAdjustPercent = 100
+	minGamma         = 0.1
+	maxGamma         = 10
+)
+
+// ParseBlur разбирает силу размытия по Гауссу (сигму) от 0 до 10. Ноль отключает размытие.
+func ParseBlur(s string) (float64, error) {
+	return parseRange("blur", s, 0, maxBlurSigma)
+}
+
+// ParseSharpen разбирает силу повышения резкости (сигму) от 0 до 10. Ноль отключает повышение резкости.
+func ParseSharpen(s string) (float64, error) {
+	return parseRange("sharpen", s, 0, maxSharpenSigma)
+}
+
+// ParseBrightness разбирает изменение яркости в процентах от -100 до 100.
+func ParseBrightness(s string) (float64, error) {
+	return parseRange("brightness", s, -maxAdjustPercent, maxAdjustPercent)
+}
+
+// ParseContrast разбирает изменение контраста в процентах от -100 до 100.
+func ParseContrast(s string) (float64, error) {
+	return parseRange("contrast", s, -maxAdjustPercent, maxAdjustPercent)
+}
+
+// ParseGamma разбирает гамма-коррекцию от 0.1 до 10. Значение 1 не меняет изображение,
+// меньшие значения затемняют его, большие - осветляют.
+func ParseGamma(s string) (float64, error) {
+	return parseRange("gamma", s, minGamma, maxGamma)
+}
+
+func parseRange(name, s string, minValue, maxValue float64) (float64, error) {
+	value, err := strconv.ParseFloat(s, 64)
+	// Сравнение записано так, чтобы отклонять и NaN
+	if err != nil || !(value >= minValue && value <= maxValue) {
+		return 0, fmt.Errorf("%s must be a number from %g to %g: %s", name, minValue, maxValue, s)
+	}
+	return value, nil
+}
+
+// adjustOperation выполняет коррекцию изображения с числовым параметром.
+type adjustOperation struct {
+	name   string
+	value  float64
+	adjust func(img image.Image, value float64) *image.NRGBA
+}
+
+func (op adjustOperation) String() string {
+	return op.name + ":" + formatFloat(op.value)
+}
+
+func (op adjustOperation) apply(img image.Image) (image.Image, error) {
+	return op.adjust(img, op.value), nil
+}
+
+// grayscaleOperation переводит изображение в оттенки серого.
+type grayscaleOperation struct{}
+
+func (grayscaleOperation) String() string {
+	return "grayscale:true"
+}
+
+func (grayscaleOperation) apply(img image.Image) (image.Image, error) {
+	return imaging.Grayscale(img), nil
+}
+
+// HasAdjustments сообщает, заданы ли в параметрах коррекции изображения.
+func (o Options) HasAdjustments() bool {
+	return len(adjustOperations(o)) > 0
+}
+
+// adjustOperations возвращает коррекции, заданные в opts, в порядке выполнения:
+// сначала тональные коррекции, затем перевод в оттенки серого, повышение резкости и размытие.
+func adjustOperations(opts Options) []Operation {
+	var ops []Operation
+	if opts.Brightness != 0 {
+		ops = append(ops, adjustOperation{"brightness", opts.Brightness, imaging.AdjustBrightness})
+	}
+	if opts.Contrast != 0 {
+		ops = append(ops, adjustOperation{"contrast", opts.Contrast, imaging.AdjustContrast})
+	}
+	if opts.Gamma != 0 && opts.Gamma != 1 {
+		ops = append(ops, adjustOperation{"gamma", opts.Gamma, imaging.AdjustGamma})
+	}
+	if opts.Grayscale {
+		ops = append(ops, grayscaleOperation{})
+	}
+	if opts.Sharpen > 0 {
+		ops = append(ops, adjustOperation{"sharpen", opts.Sharpen, imaging.Sharpen})
+	}
+	if opts.Blur > 0 {
+		ops = append(ops, adjustOperation{"blur", opts.Blur, imaging.Blur})
+	}
+	return ops
+}
@@ -0,0 +1,266 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/romangricuk/image-previewer/internal/image/webp"
+	"github.com/romangricuk/image-previewer/internal/logger"
+)
+
+// ErrFrameNotFound возвращается, если в изображении нет кадра с запрошенным номером.
+var ErrFrameNotFound = errors.New("frame not found")
+
+// DefaultMaxFrames - наибольшее число кадров анимированного GIF, которые обрабатываются по умолчанию.
+const DefaultMaxFrames = 200
+
+// Блоки потока GIF.
+const (
+	gifExtensionIntroducer = 0x21
+	gifImageSeparator      = 0x2c
+	gifColorTableFlag      = 0x80
+)
+
+// countGIFFrames возвращает число кадров GIF, не декодируя их: обходит блоки потока и пропускает
+// данные изображений. Если данные не являются GIF или повреждены, возвращается число найденных кадров.
+func countGIFFrames(data []byte) int {
+	const headerSize, screenSize = 6, 7
+	if len(data) < headerSize+screenSize || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return 0
+	}
+
+	pos := headerSize + screenSize
+	pos += colorTableSize(data[headerSize+4])
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case gifExtensionIntroducer:
+			// Метка расширения, затем подблоки данных
+			pos = skipSubBlocks(data, pos+2)
+		case gifImageSeparator:
+			const descriptorSize = 10
+			if pos+descriptorSize > len(data) {
+				return frames
+			}
+			frames++
+			pos += descriptorSize + colorTableSize(data[pos+9])
+			// Минимальный размер кода LZW, затем подблоки сжатых данных
+			pos = skipSubBlocks(data, pos+1)
+		default:
+			// Завершающий блок 0x3b или поврежденные данные
+			return frames
+		}
+	}
+	return frames
+}
+
+// colorTableSize возвращает размер таблицы цветов в байтах по полю флагов дескриптора.
+func colorTableSize(flags byte) int {
+	if flags&gifColorTableFlag == 0 {
+		return 0
+	}
+	return 3 << (flags&0x07 + 1)
+}
+
+// skipSubBlocks пропускает последовательность подблоков, начинающуюся с pos, и возвращает позицию после нее.
+func skipSubBlocks(data []byte, pos int) int {
+	for pos < len(data) {
+		size := int(data[pos])
+		pos++
+		if size == 0 {
+			return pos
+		}
+		pos += size
+	}
+	return len(data)
+}
+
+// keepsAnimation сообщает, сохраняется ли анимация исходного GIF в результате: не запрошен отдельный кадр,
+// а формат не задан, задан GIF или выбран по заголовку Accept. Остальные форматы получают только первый кадр.
+func (o Options) keepsAnimation() bool {
+	return !o.Still && (o.Format == "" || o.Format == FormatGIF || o.AutoFormat)
+}
+
+// animationAllowed сообщает, можно ли обработать анимацию из frames кадров по pixels пикселей покадрово.
+// Иначе результат строится по первому кадру.
+func animationAllowed(frames, pixels int, opts Options, log logger.Logger) bool {
+	if opts.MaxFrames > 0 && frames > opts.MaxFrames {
+		log.Warnf("Animated GIF has %d frames, more than %d allowed: using the first frame", frames, opts.MaxFrames)
+		return false
+	}
+	if err := checkPixels(pixels, frames, opts.MaxPixels); err != nil {
+		log.Warnf("Animated GIF is too large, using the first frame: %v", err)
+		return false
+	}
+	// Размер одного кадра результата уже проверен, поэтому произведение не переполняется
+	if err := checkPixels(opts.Width*opts.Height, frames, opts.MaxPixels); err != nil {
+		log.Warnf("Animated GIF output is too large, using the first frame: %v", err)
+		return false
+	}
+	return true
+}
+
+// composeGIFFrames собирает кадры GIF на холсте размером с логический экран с учетом способа удаления
+// предыдущего кадра, как их показывает браузер, и передает каждый собранный кадр в fn, пока она возвращает true.
+func composeGIFFrames(src *gif.GIF, fn func(i int, frame *image.NRGBA) bool) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, src.Config.Width, src.Config.Height))
+	for i, frame := range src.Image {
+		disposal := byte(gif.DisposalNone)
+		if i < len(src.Disposal) {
+			disposal = src.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if !fn(i, imaging.Clone(canvas)) {
+			return
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+}
+
+// resizeAnimatedGIF выполняет шаги обработки для каждого кадра анимированного GIF и кодирует анимацию.
+// Частичные кадры обрабатываются после сборки на холсте, поэтому все кадры результата имеют один размер.
+func resizeAnimatedGIF(data []byte, opts Options) ([]byte, error) {
+	src, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	dst := &gif.GIF{LoopCount: src.LoopCount}
+	var ops []Operation
+	composeGIFFrames(src, func(i int, frame *image.NRGBA) bool {
+		var img image.Image = frame
+		if ops == nil {
+			// Операции строятся по первому кадру, чтобы все кадры обрезались одинаково
+			ops = animationOperations(img, opts)
+		}
+		for _, op := range ops {
+			if img, err = op.apply(img); err != nil {
+				return false
+			}
+		}
+
+		dst.Image = append(dst.Image, quantize(img))
+		dst.Delay = append(dst.Delay, src.Delay[i])
+		// Каждый кадр результата занимает все изображение, поэтому перед следующим кадром он очищается
+		dst.Disposal = append(dst.Disposal, gif.DisposalBackground)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeFrame декодирует кадр opts.Frame анимированного GIF или WebP и возвращает его вместе с названием формата.
+// Неанимированное изображение состоит из одного кадра и, если не задан opts.IgnoreOrientation, поворачивается
+// согласно тегу EXIF Orientation. Для выбора кадра кроме первого декодируются и предыдущие кадры,
+// поэтому кадров должно быть не больше opts.MaxFrames, а их общее число пикселей - не больше opts.MaxPixels.
+func decodeFrame(data []byte, opts Options) (image.Image, string, error) {
+	index := opts.Frame
+	if frames := countGIFFrames(data); frames > 0 {
+		if err := checkFrame(data, index, frames, opts); err != nil {
+			return nil, "", err
+		}
+		if index == 0 {
+			// Первый кадр декодируется без остальных
+			return image.Decode(bytes.NewReader(data))
+		}
+		src, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, "", err
+		}
+		var img image.Image
+		composeGIFFrames(src, func(i int, frame *image.NRGBA) bool {
+			img = frame
+			return i < index
+		})
+		return img, string(FormatGIF), nil
+	}
+
+	if frames := webp.FrameCount(data); frames > 0 {
+		if err := checkFrame(data, index, frames, opts); err != nil {
+			return nil, "", err
+		}
+		img, err := webp.DecodeFrame(data, index)
+		return img, string(FormatWebP), err
+	}
+
+	if index > 0 {
+		return nil, "", fmt.Errorf("%w: %d of 1", ErrFrameNotFound, index)
+	}
+	_, formatName, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	// Снимки с камер хранятся в ориентации матрицы, а правильная ориентация задается тегом EXIF
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(!opts.IgnoreOrientation))
+	return img, formatName, err
+}
+
+// checkFrame проверяет, что кадр index анимации из frames кадров существует и его можно декодировать
+// в пределах ограничений opts. Первый кадр декодируется отдельно и проверяется как неанимированное изображение.
+func checkFrame(data []byte, index, frames int, opts Options) error {
+	if index >= frames {
+		return fmt.Errorf("%w: %d of %d", ErrFrameNotFound, index, frames)
+	}
+	if index == 0 {
+		return nil
+	}
+	if opts.MaxFrames > 0 && frames > opts.MaxFrames {
+		return fmt.Errorf("%w: %d frames, limit %d", ErrTooManyPixels, frames, opts.MaxFrames)
+	}
+	return checkPixels(sourcePixels(data), frames, opts.MaxPixels)
+}
+
+// ParseFrame разбирает номер кадра анимации, начиная с нуля.
+func ParseFrame(s string) (int, error) {
+	frame, err := strconv.Atoi(s)
+	if err != nil || frame < 0 {
+		return 0, fmt.Errorf("frame must be a non-negative integer: %s", s)
+	}
+	return frame, nil
+}
+
+// animationOperations возвращает шаги обработки кадров анимации. Область умной обрезки
+// вычисляется один раз по первому кадру и заменяется фокусной точкой, иначе она менялась бы
+// от кадра к кадру и изображение дрожало бы.
+func animationOperations(first image.Image, opts Options) []Operation {
+	if opts.Mode != ModeFill || opts.Gravity != GravitySmart {
+		return opts.Operations()
+	}
+
+	for _, op := range transformOperations(opts) {
+		// Повороты и отражения не возвращают ошибок
+		first, _ = op.apply(first)
+	}
+	size := first.Bounds().Size()
+	width, height := limitUpscale(size, opts.Width, opts.Height, opts.MaxUpscale)
+	rect := smartCropRect(first, width, height).Sub(first.Bounds().Min)
+
+	opts.Gravity = GravityFocusPoint
+	opts.FocusX = (float64(rect.Min.X) + float64(rect.Dx())/2) / float64(size.X)
+	opts.FocusY = (float64(rect.Min.Y) + float64(rect.Dy())/2) / float64(size.Y)
+	return opts.Operations()
+}
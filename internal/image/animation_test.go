@@ -0,0 +1,384 @@
+package image_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	imagePreviewer "github.com/romangricuk/image-previewer/internal/image"
+	"github.com/romangricuk/image-previewer/internal/logger"
+)
+
+// animatedGIF возвращает анимацию 40x20 из трех кадров: красный фон, синий частичный кадр в левой половине,
+// который остается на экране, и зеленый частичный кадр в правой четверти, после которого экран восстанавливается.
+func animatedGIF(t *testing.T) []byte {
+	t.Helper()
+
+	palette := color.Palette{
+		color.NRGBA{R: 255, A: 255},
+		color.NRGBA{B: 255, A: 255},
+		color.NRGBA{G: 255, A: 255},
+	}
+	frame := func(rect image.Rectangle, index uint8) *image.Paletted {
+		img := image.NewPaletted(rect, palette)
+		for i := range img.Pix {
+			img.Pix[i] = index
+		}
+		return img
+	}
+
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 40, 20), 0),
+			frame(image.Rect(0, 0, 20, 20), 1),
+			frame(image.Rect(30, 0, 40, 20), 2),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalPrevious},
+		LoopCount: 3,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode test animation: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestResizeAnimatedGIF(t *testing.T) {
+	log := logger.NewTestLogger()
+	data := animatedGIF(t)
+
+	opts := imagePreviewer.Options{Mode: imagePreviewer.ModeFit, Width: 20, Height: 20}
+	result, format, err := imagePreviewer.ResizeImage(context.Background(), data, opts, log)
+	if err != nil {
+		t.Fatalf("ResizeImage failed: %v", err)
+	}
+	if format != imagePreviewer.FormatGIF {
+		t.Fatalf("Expected gif format, got %s", format)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(result))
+	if err != nil {
+		t.Fatalf("Failed to decode animation: %v", err)
+	}
+	if len(g.Image) != 3 {
+		t.Fatalf("Expected 3 frames, got %d", len(g.Image))
+	}
+	if g.LoopCount != 3 || g.Delay[0] != 10 || g.Delay[1] != 20 || g.Delay[2] != 30 {
+		t.Errorf("Expected loop count and delays to be preserved, got %d %v", g.LoopCount, g.Delay)
+	}
+
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	// Каждый кадр результата содержит все изображение 20x10 с учетом предыдущих кадров
+	expected := [][2]color.NRGBA{
+		{red, red},
+		{blue, red},
+		{blue, green},
+	}
+	for i, frame := range g.Image {
+		if frame.Bounds() != image.Rect(0, 0, 20, 10) {
+			t.Fatalf("Frame %d: expected bounds 20x10, got %v", i, frame.Bounds())
+		}
+		left := color.NRGBAModel.Convert(frame.At(2, 5)).(color.NRGBA)
+		right := color.NRGBAModel.Convert(frame.At(18, 5)).(color.NRGBA)
+		if colorDistance(left, expected[i][0]) > 2 || colorDistance(right, expected[i][1]) > 2 {
+			t.Errorf("Frame %d: expected %v and %v, got %v and %v", i, expected[i][0], expected[i][1], left, right)
+		}
+	}
+}
+
+func TestResizeAnimatedGIFFirstFrame(t *testing.T) {
+	log := logger.NewTestLogger()
+	data := animatedGIF(t)
+
+	testCases := []struct {
+		name string
+		opts imagePreviewer.Options
+	}{
+		{"too many frames", imagePreviewer.Options{MaxFrames: 2}},
+		{"explicit format", imagePreviewer.Options{Format: imagePreviewer.FormatPNG}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.opts.Mode, tc.opts.Width, tc.opts.Height = imagePreviewer.ModeFit, 20, 20
+			result, _, err := imagePreviewer.ResizeImage(context.Background(), data, tc.opts, log)
+			if err != nil {
+				t.Fatalf("ResizeImage failed: %v", err)
+			}
+			img, _, err := image.Decode(bytes.NewReader(result))
+			if err != nil {
+				t.Fatalf("Failed to decode image: %v", err)
+			}
+			if g, err := gif.DecodeAll(bytes.NewReader(result)); err == nil && len(g.Image) != 1 {
+				t.Errorf("Expected single frame, got %d", len(g.Image))
+			}
+			got := color.NRGBAModel.Convert(img.At(2, 5)).(color.NRGBA)
+			if colorDistance(got, color.NRGBA{R: 255, A: 255}) > 2 {
+				t.Errorf("Expected first frame, got pixel %v", got)
+			}
+		})
+	}
+}
+
+func TestResizeImageFrame(t *testing.T) {
+	log := logger.NewTestLogger()
+	animatedWebP := readFile(t, filepath.Join("..", "..", "test", "data", "animated_64x32.webp"))
+
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+
+	testCases := []struct {
+		name  string
+		data  []byte
+		still bool
+		frame int
+		want  [2]color.NRGBA
+	}{
+		{"gif first frame", animatedGIF(t), true, 0, [2]color.NRGBA{red, red}},
+		{"gif partial frame", animatedGIF(t), true, 1, [2]color.NRGBA{blue, red}},
+		{"gif last frame", animatedGIF(t), true, 2, [2]color.NRGBA{blue, green}},
+		{"webp partial frame", animatedWebP, true, 1, [2]color.NRGBA{blue, red}},
+		{"webp last frame", animatedWebP, true, 2, [2]color.NRGBA{blue, green}},
+		// Анимированный WebP без выбора кадра обрабатывается по первому кадру
+		{"webp without frame", animatedWebP, false, 0, [2]color.NRGBA{red, red}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			img := resizeToPNG(t, tc.data, imagePreviewer.Options{
+				Mode:   imagePreviewer.ModeFit,
+				Width:  20,
+				Height: 20,
+				Format: imagePreviewer.FormatPNG,
+				Still:  tc.still,
+				Frame:  tc.frame,
+			}, log)
+
+			left := color.NRGBAModel.Convert(img.At(2, 5)).(color.NRGBA)
+			right := color.NRGBAModel.Convert(img.At(18, 5)).(color.NRGBA)
+			if colorDistance(left, tc.want[0]) > 2 || colorDistance(right, tc.want[1]) > 2 {
+				t.Errorf("Expected %v and %v, got %v and %v", tc.want[0], tc.want[1], left, right)
+			}
+		})
+	}
+
+	static := readFile(t, filepath.Join("..", "..", "test", "data", "gopher_50x50.jpg"))
+	for _, data := range [][]byte{animatedGIF(t), animatedWebP, static} {
+		opts := imagePreviewer.Options{Format: imagePreviewer.FormatPNG, Still: true, Frame: 3}
+		_, _, err := imagePreviewer.ResizeImage(context.Background(), data, opts, log)
+		if !errors.Is(err, imagePreviewer.ErrFrameNotFound) {
+			t.Errorf("Expected ErrFrameNotFound, got %v", err)
+		}
+	}
+
+	// Кадр анимации кэшируется отдельно от анимации
+	opts := imagePreviewer.Options{Still: true, Frame: 2}
+	if got := opts.String(); !strings.HasPrefix(got, "ar:true/frame:2/") {
+		t.Errorf("Expected frame in %q", got)
+	}
+}
+
+func TestResizeImageMaxPixels(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Изображение больше ограничения отклоняется до декодирования
+	static := encodePNG(t, image.NewNRGBA(image.Rect(0, 0, 50, 40)))
+	opts := imagePreviewer.Options{Format: imagePreviewer.FormatPNG, MaxPixels: 1999}
+	_, _, err := imagePreviewer.ResizeImage(context.Background(), static, opts, log)
+	if !errors.Is(err, imagePreviewer.ErrTooManyPixels) {
+		t.Errorf("Expected ErrTooManyPixels, got %v", err)
+	}
+	opts.MaxPixels = 2000
+	if _, _, err := imagePreviewer.ResizeImage(context.Background(), static, opts, log); err != nil {
+		t.Errorf("Expected image within the limit to be resized, got %v", err)
+	}
+
+	// Запрошенный размер результата ограничивается так же, как разрешение исходного изображения
+	opts.Mode, opts.Width, opts.Height = imagePreviewer.ModePad, 50, 41
+	_, _, err = imagePreviewer.ResizeImage(context.Background(), static, opts, log)
+	if !errors.Is(err, imagePreviewer.ErrTooManyPixels) {
+		t.Errorf("Expected ErrTooManyPixels for the output size, got %v", err)
+	}
+
+	// Три кадра 40x20 превышают ограничение вместе, но не по отдельности: анимация сводится к первому кадру,
+	// а последний кадр, для которого декодируются все кадры, недоступен
+	data := animatedGIF(t)
+	opts = imagePreviewer.Options{Mode: imagePreviewer.ModeFit, Width: 20, Height: 20, MaxPixels: 2000}
+	result, _, err := imagePreviewer.ResizeImage(context.Background(), data, opts, log)
+	if err != nil {
+		t.Fatalf("ResizeImage failed: %v", err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(result))
+	if err != nil {
+		t.Fatalf("Failed to decode animation: %v", err)
+	}
+	if len(g.Image) != 1 {
+		t.Errorf("Expected single frame, got %d", len(g.Image))
+	}
+
+	opts.Still, opts.Frame = true, 2
+	_, _, err = imagePreviewer.ResizeImage(context.Background(), data, opts, log)
+	if !errors.Is(err, imagePreviewer.ErrTooManyPixels) {
+		t.Errorf("Expected ErrTooManyPixels for the last frame, got %v", err)
+	}
+
+	// Для кадров анимированного WebP, как и GIF, декодируются предыдущие кадры: три кадра 64x32
+	// превышают ограничение вместе, а первый кадр декодируется отдельно
+	animatedWebP := readFile(t, filepath.Join("..", "..", "test", "data", "animated_64x32.webp"))
+	opts = imagePreviewer.Options{Mode: imagePreviewer.ModeFit, Width: 20, Height: 20, MaxPixels: 5000, Still: true}
+	if _, _, err = imagePreviewer.ResizeImage(context.Background(), animatedWebP, opts, log); err != nil {
+		t.Errorf("Expected first WebP frame within the limit, got %v", err)
+	}
+	opts.Frame = 2
+	_, _, err = imagePreviewer.ResizeImage(context.Background(), animatedWebP, opts, log)
+	if !errors.Is(err, imagePreviewer.ErrTooManyPixels) {
+		t.Errorf("Expected ErrTooManyPixels for the last WebP frame, got %v", err)
+	}
+	opts.MaxPixels, opts.MaxFrames, opts.Frame = 0, 2, 1
+	_, _, err = imagePreviewer.ResizeImage(context.Background(), animatedWebP, opts, log)
+	if !errors.Is(err, imagePreviewer.ErrTooManyPixels) {
+		t.Errorf("Expected ErrTooManyPixels for more frames than allowed, got %v", err)
+	}
+
+	// Поток первого кадра объявляет размер 8000x8000 при холсте 64x32: ограничение проверяется
+	// по размеру из потока, под который декодер выделил бы память
+	crafted := bytes.Clone(animatedWebP)
+	vp8l := bytes.Index(crafted, []byte("VP8L"))
+	// После имени и длины чанка следует сигнатура, затем ширина и высота без единицы по 14 бит
+	header := crafted[vp8l+9 : vp8l+13]
+	binary.LittleEndian.PutUint32(header, binary.LittleEndian.Uint32(header)&^(1<<28-1)|7999|7999<<14)
+	opts = imagePreviewer.Options{Mode: imagePreviewer.ModeFit, Width: 20, Height: 20, MaxPixels: 50_000_000}
+	_, _, err = imagePreviewer.ResizeImage(context.Background(), crafted, opts, log)
+	if !errors.Is(err, imagePreviewer.ErrTooManyPixels) {
+		t.Errorf("Expected ErrTooManyPixels for oversized frame data, got %v", err)
+	}
+}
+
+// Тестируем, что палитра кадров не зависит от порядка обхода гистограммы и результат повторяется байт в байт.
+func TestResizeAnimatedGIFDeterministic(t *testing.T) {
+	data := make([]byte, 3*255)
+	for i := range data {
+		data[i] = byte(i * 37)
+	}
+	src, _ := fuzzAnimation(t, data, 64, 48)
+
+	opts := imagePreviewer.Options{Mode: imagePreviewer.ModeFit, Width: 51, Height: 51}
+	var first []byte
+	for i := 0; i < 10; i++ {
+		result, _, err := imagePreviewer.ResizeImage(context.Background(), src, opts, logger.NewTestLogger())
+		if err != nil {
+			t.Fatalf("ResizeImage failed: %v", err)
+		}
+		if i == 0 {
+			first = result
+		} else if !bytes.Equal(result, first) {
+			t.Fatalf("Expected identical result on run %d", i)
+		}
+	}
+}
+
+// FuzzQuantize проверяет построение палитры кадров анимированного GIF: без операций обработки каждый кадр
+// результата совпадает с исходным с точностью до квантования, а прозрачные пиксели остаются прозрачными.
+func FuzzQuantize(f *testing.F) {
+	f.Add([]byte{}, uint8(0), uint8(0))
+	f.Add([]byte{255, 0, 0, 0, 0, 255, 1, 2, 0}, uint8(39), uint8(19))
+	f.Add([]byte("quantization of an arbitrary palette"), uint8(63), uint8(47))
+
+	f.Fuzz(func(t *testing.T, data []byte, w, h uint8) {
+		src, frames := fuzzAnimation(t, data, int(w)+1, int(h)+1)
+		result, format, err := imagePreviewer.ResizeImage(
+			context.Background(), src, imagePreviewer.Options{}, logger.NewTestLogger())
+		if err != nil {
+			t.Fatalf("ResizeImage failed: %v", err)
+		}
+		if format != imagePreviewer.FormatGIF {
+			t.Fatalf("Expected gif format, got %s", format)
+		}
+		g, err := gif.DecodeAll(bytes.NewReader(result))
+		if err != nil {
+			t.Fatalf("Failed to decode animation: %v", err)
+		}
+		if len(g.Image) != len(frames) {
+			t.Fatalf("Expected %d frames, got %d", len(frames), len(g.Image))
+		}
+
+		for i, frame := range g.Image {
+			bounds := frames[i].Bounds()
+			if frame.Bounds() != bounds {
+				t.Fatalf("Frame %d: expected bounds %v, got %v", i, bounds, frame.Bounds())
+			}
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					want := frames[i].NRGBAAt(x, y)
+					got := color.NRGBAModel.Convert(frame.At(x, y)).(color.NRGBA)
+					if want.A == 0 {
+						if got.A != 0 {
+							t.Fatalf("Frame %d: expected transparent pixel at (%d, %d), got %v", i, x, y, got)
+						}
+						continue
+					}
+					// Исходных цветов меньше размера палитры, поэтому каждый цвет попадает в свою группу,
+					// а ошибка ограничена размером ячейки гистограммы и выбором ближайшего цвета для ячейки
+					if dist := colorDistance(want, got); dist > 24 {
+						t.Fatalf("Frame %d: pixel (%d, %d) mismatch: expected %v, got %v", i, x, y, want, got)
+					}
+				}
+			}
+		}
+	})
+}
+
+// fuzzAnimation собирает из data анимацию w x h из двух кадров с общей палитрой не больше чем из 255 цветов
+// и прозрачным цветом. Второй кадр накладывается на первый. Возвращает GIF и собранные кадры.
+func fuzzAnimation(t *testing.T, data []byte, w, h int) ([]byte, []*image.NRGBA) {
+	t.Helper()
+
+	palette := color.Palette{color.NRGBA{A: 255}}
+	for i := 0; i+2 < len(data) && i < 3*255; i += 3 {
+		if i == 0 {
+			palette = palette[:0]
+		}
+		palette = append(palette, color.NRGBA{R: data[i], G: data[i+1], B: data[i+2], A: 255})
+	}
+	transparent := uint8(len(palette))
+	palette = append(palette, color.NRGBA{})
+
+	g := &gif.GIF{Disposal: []byte{gif.DisposalNone, gif.DisposalNone}, Delay: []int{10, 10}}
+	var frames []*image.NRGBA
+	for k := range 2 {
+		img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+		composed := image.NewNRGBA(img.Rect)
+		for i := range img.Pix {
+			index := uint8(i % len(palette))
+			if len(data) > 0 {
+				index = uint8(int(data[(i*7+k*13)%len(data)]) % len(palette))
+			}
+			img.Pix[i] = index
+			c := palette[index].(color.NRGBA)
+			if index == transparent && k > 0 {
+				// Прозрачный пиксель второго кадра показывает первый кадр
+				c = frames[0].NRGBAAt(i%w, i/w)
+			}
+			composed.SetNRGBA(i%w, i/w, c)
+		}
+		g.Image = append(g.Image, img)
+		frames = append(frames, composed)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("Failed to encode test animation: %v", err)
+	}
+	return buf.Bytes(), frames
+}
@@ -0,0 +1,37 @@
+package image
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image/color"
+	"strings"
+)
+
+// ColorTransparent - название полностью прозрачного цвета фона.
+const ColorTransparent = "transparent"
+
+// ParseColor преобразует цвет в шестнадцатеричной записи RGB, RRGGBB или RRGGBBAA
+// (без символа #, который в URL означает начало фрагмента) либо "transparent" в значение color.NRGBA.
+func ParseColor(s string) (color.NRGBA, error) {
+	if strings.EqualFold(s, ColorTransparent) {
+		return color.NRGBA{}, nil
+	}
+
+	hexStr := s
+	if len(hexStr) == 3 {
+		hexStr = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(hexStr) == 6 {
+		hexStr += "ff"
+	}
+	b, err := hex.DecodeString(hexStr)
+	if err != nil || len(b) != 4 {
+		return color.NRGBA{}, fmt.Errorf("color must be in format RGB, RRGGBB, RRGGBBAA or transparent: %s", s)
+	}
+	return color.NRGBA{R: b[0], G: b[1], B: b[2], A: b[3]}, nil
+}
+
+// formatColor возвращает запись цвета в формате RRGGBBAA.
+func formatColor(c color.NRGBA) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
@@ -0,0 +1,46 @@
+package image
+
+import (
+	"image"
+	"math"
+)
+
+// cropSize возвращает размеры максимальной области исходного изображения srcW x srcH
+// с пропорциями width:height.
+func cropSize(srcW, srcH, width, height int) (int, int) {
+	cropW, cropH := srcW, srcH
+	if srcW*height > srcH*width {
+		cropW = clamp(int(math.Round(float64(srcH)*float64(width)/float64(height))), 1, srcW)
+	} else {
+		cropH = clamp(int(math.Round(float64(srcW)*float64(height)/float64(width))), 1, srcH)
+	}
+	return cropW, cropH
+}
+
+// focusPointCropRect возвращает область с пропорциями width:height, центр которой
+// максимально близок к фокусной точке. Координаты точки задаются долями от размеров изображения.
+func focusPointCropRect(img image.Image, width, height int, focusX, focusY float64) image.Rectangle {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	cropW, cropH := cropSize(srcW, srcH, width, height)
+
+	left := clamp(int(math.Round(focusX*float64(srcW)-float64(cropW)/2)), 0, srcW-cropW)
+	top := clamp(int(math.Round(focusY*float64(srcH)-float64(cropH)/2)), 0, srcH-cropH)
+
+	return image.Rect(
+		bounds.Min.X+left,
+		bounds.Min.Y+top,
+		bounds.Min.X+left+cropW,
+		bounds.Min.Y+top+cropH,
+	)
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,80 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ResampleFilter - фильтр интерполяции, используемый при изменении размера.
+type ResampleFilter string
+
+const (
+	FilterNearest    ResampleFilter = "nearest"
+	FilterBox        ResampleFilter = "box"
+	FilterLinear     ResampleFilter = "linear"
+	FilterHermite    ResampleFilter = "hermite"
+	FilterMitchell   ResampleFilter = "mitchell"
+	FilterCatmullRom ResampleFilter = "catmull-rom"
+	FilterBSpline    ResampleFilter = "bspline"
+	FilterGaussian   ResampleFilter = "gaussian"
+	FilterBartlett   ResampleFilter = "bartlett"
+	FilterLanczos    ResampleFilter = "lanczos"
+	FilterHann       ResampleFilter = "hann"
+	FilterHamming    ResampleFilter = "hamming"
+	FilterBlackman   ResampleFilter = "blackman"
+	FilterWelch      ResampleFilter = "welch"
+	FilterCosine     ResampleFilter = "cosine"
+)
+
+// DefaultFilter используется, если фильтр не задан: медленный, но дает наиболее четкий результат.
+const DefaultFilter = FilterLanczos
+
+var resampleFilters = map[ResampleFilter]imaging.ResampleFilter{
+	FilterNearest:    imaging.NearestNeighbor,
+	FilterBox:        imaging.Box,
+	FilterLinear:     imaging.Linear,
+	FilterHermite:    imaging.Hermite,
+	FilterMitchell:   imaging.MitchellNetravali,
+	FilterCatmullRom: imaging.CatmullRom,
+	FilterBSpline:    imaging.BSpline,
+	FilterGaussian:   imaging.Gaussian,
+	FilterBartlett:   imaging.Bartlett,
+	FilterLanczos:    imaging.Lanczos,
+	FilterHann:       imaging.Hann,
+	FilterHamming:    imaging.Hamming,
+	FilterBlackman:   imaging.Blackman,
+	FilterWelch:      imaging.Welch,
+	FilterCosine:     imaging.Cosine,
+}
+
+// filterAliases - дополнительные названия фильтров, допустимые в запросе и конфигурации.
+var filterAliases = map[string]ResampleFilter{
+	"nearest-neighbor":   FilterNearest,
+	"bilinear":           FilterLinear,
+	"catmullrom":         FilterCatmullRom,
+	"bicubic":            FilterCatmullRom,
+	"mitchell-netravali": FilterMitchell,
+}
+
+// ParseFilter преобразует название фильтра интерполяции в каноническое значение.
+func ParseFilter(s string) (ResampleFilter, error) {
+	name := strings.ToLower(s)
+	if filter, ok := filterAliases[name]; ok {
+		return filter, nil
+	}
+	filter := ResampleFilter(name)
+	if _, ok := resampleFilters[filter]; !ok {
+		return "", fmt.Errorf("unknown resample filter: %s", s)
+	}
+	return filter, nil
+}
+
+// imaging возвращает фильтр imaging для значения f. Пустое значение соответствует DefaultFilter.
+func (f ResampleFilter) imaging() imaging.ResampleFilter {
+	if filter, ok := resampleFilters[f]; ok {
+		return filter
+	}
+	return resampleFilters[DefaultFilter]
+}
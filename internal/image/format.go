@@ -0,0 +1,112 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/romangricuk/image-previewer/internal/image/jpeg"
+	"github.com/romangricuk/image-previewer/internal/image/webp"
+)
+
+// Format - формат изображения.
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatGIF  Format = "gif"
+	FormatBMP  Format = "bmp"
+	FormatTIFF Format = "tiff"
+	FormatWebP Format = "webp"
+)
+
+// DefaultFormat используется, если формат исходного изображения не поддерживается для кодирования.
+const DefaultFormat = FormatJPEG
+
+// encodeFunc кодирует изображение с учетом параметров обработки.
+type encodeFunc func(w io.Writer, img image.Image, opts Options) error
+
+type formatInfo struct {
+	encode        encodeFunc
+	contentType   string
+	extension     string
+	supportsAlpha bool
+}
+
+var formats = map[Format]formatInfo{
+	FormatJPEG: {encodeJPEG, "image/jpeg", ".jpg", false},
+	FormatPNG:  {imagingEncoder(imaging.PNG), "image/png", ".png", true},
+	FormatGIF:  {imagingEncoder(imaging.GIF), "image/gif", ".gif", true},
+	FormatBMP:  {imagingEncoder(imaging.BMP), "image/bmp", ".bmp", false},
+	FormatTIFF: {imagingEncoder(imaging.TIFF), "image/tiff", ".tiff", true},
+	FormatWebP: {encodeWebP, "image/webp", ".webp", true},
+}
+
+// imagingEncoder возвращает функцию кодирования средствами imaging.
+func imagingEncoder(format imaging.Format) encodeFunc {
+	return func(w io.Writer, img image.Image, _ Options) error {
+		return imaging.Encode(w, img, format)
+	}
+}
+
+// encodeJPEG кодирует изображение в baseline JPEG или, если задано opts.Progressive,
+// в прогрессивный JPEG с оптимизированными таблицами Хаффмана.
+func encodeJPEG(w io.Writer, img image.Image, opts Options) error {
+	if opts.Progressive {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.Quality})
+	}
+	if opts.Quality == 0 {
+		return imaging.Encode(w, img, imaging.JPEG)
+	}
+	return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(opts.Quality))
+}
+
+// encodeWebP кодирует изображение в WebP с потерями или, если задано opts.Lossless, без потерь.
+func encodeWebP(w io.Writer, img image.Image, opts Options) error {
+	return webp.Encode(w, img, &webp.Options{Lossless: opts.Lossless, Quality: opts.Quality})
+}
+
+// ParseFormat преобразует название формата в значение Format.
+func ParseFormat(s string) (Format, error) {
+	format := Format(strings.ToLower(s))
+	if format == "jpg" {
+		format = FormatJPEG
+	}
+	if _, ok := formats[format]; !ok {
+		return "", fmt.Errorf("unsupported format: %s", s)
+	}
+	return format, nil
+}
+
+// ParseQuality преобразует строку в качество сжатия от 1 до 100.
+func ParseQuality(s string) (int, error) {
+	quality, err := strconv.Atoi(s)
+	if err != nil || quality < 1 || quality > 100 {
+		return 0, fmt.Errorf("quality must be an integer from 1 to 100: %s", s)
+	}
+	return quality, nil
+}
+
+// FormatFromExtension определяет формат по расширению файла, например ".png".
+func FormatFromExtension(ext string) (Format, bool) {
+	for format, info := range formats {
+		if strings.EqualFold(info.extension, ext) {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// ContentType возвращает MIME-тип формата.
+func (f Format) ContentType() string {
+	return formats[f].contentType
+}
+
+// Extension возвращает расширение файла для формата, включая точку.
+func (f Format) Extension() string {
+	return formats[f].extension
+}
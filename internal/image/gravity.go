@@ -0,0 +1,178 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Gravity определяет, какая часть изображения сохраняется при обрезке в режиме fill.
+type Gravity string
+
+const (
+	GravityCenter    Gravity = "ce"
+	GravityNorth     Gravity = "no"
+	GravitySouth     Gravity = "so"
+	GravityEast      Gravity = "ea"
+	GravityWest      Gravity = "we"
+	GravityNorthEast Gravity = "noea"
+	GravityNorthWest Gravity = "nowe"
+	GravitySouthEast Gravity = "soea"
+	GravitySouthWest Gravity = "sowe"
+	// GravitySmart выбирает область обрезки по содержимому изображения.
+	GravitySmart Gravity = "sm"
+	// GravityFocusPoint обрезает изображение вокруг фокусной точки, заданной в Options.
+	GravityFocusPoint Gravity = "fp"
+)
+
+// gravityAliases сопоставляет допустимые в запросе названия с каноническими значениями.
+var gravityAliases = map[string]Gravity{
+	"ce":           GravityCenter,
+	"center":       GravityCenter,
+	"no":           GravityNorth,
+	"north":        GravityNorth,
+	"top":          GravityNorth,
+	"so":           GravitySouth,
+	"south":        GravitySouth,
+	"bottom":       GravitySouth,
+	"ea":           GravityEast,
+	"east":         GravityEast,
+	"right":        GravityEast,
+	"we":           GravityWest,
+	"west":         GravityWest,
+	"left":         GravityWest,
+	"noea":         GravityNorthEast,
+	"northeast":    GravityNorthEast,
+	"top-right":    GravityNorthEast,
+	"nowe":         GravityNorthWest,
+	"northwest":    GravityNorthWest,
+	"top-left":     GravityNorthWest,
+	"soea":         GravitySouthEast,
+	"southeast":    GravitySouthEast,
+	"bottom-right": GravitySouthEast,
+	"sowe":         GravitySouthWest,
+	"southwest":    GravitySouthWest,
+	"bottom-left":  GravitySouthWest,
+	"sm":           GravitySmart,
+	"smart":        GravitySmart,
+}
+
+var gravityAnchors = map[Gravity]imaging.Anchor{
+	GravityCenter:    imaging.Center,
+	GravityNorth:     imaging.Top,
+	GravitySouth:     imaging.Bottom,
+	GravityEast:      imaging.Right,
+	GravityWest:      imaging.Left,
+	GravityNorthEast: imaging.TopRight,
+	GravityNorthWest: imaging.TopLeft,
+	GravitySouthEast: imaging.BottomRight,
+	GravitySouthWest: imaging.BottomLeft,
+}
+
+// ParseFocusPoint разбирает координаты фокусной точки вида "x,y",
+// где x и y - доли ширины и высоты изображения в диапазоне [0, 1].
+func ParseFocusPoint(s string) (float64, float64, error) {
+	xStr, yStr, found := strings.Cut(s, ",")
+	if !found {
+		return 0, 0, fmt.Errorf("focus point must be in format x,y: %s", s)
+	}
+
+	x, err := strconv.ParseFloat(xStr, 64)
+	// Сравнение записано так, чтобы NaN не проходил проверку
+	if err != nil || !(x >= 0 && x <= 1) {
+		return 0, 0, fmt.Errorf("invalid focus point x: %s", xStr)
+	}
+
+	y, err := strconv.ParseFloat(yStr, 64)
+	if err != nil || !(y >= 0 && y <= 1) {
+		return 0, 0, fmt.Errorf("invalid focus point y: %s", yStr)
+	}
+
+	return x, y, nil
+}
+
+// ParseGravity преобразует название точки привязки в каноническое значение.
+func ParseGravity(s string) (Gravity, error) {
+	gravity, ok := gravityAliases[strings.ToLower(s)]
+	if !ok {
+		return "", fmt.Errorf("unknown gravity: %s", s)
+	}
+	return gravity, nil
+}
+
+// anchor возвращает точку привязки imaging для значения gravity.
+// Пустое значение соответствует центру.
+func (g Gravity) anchor() (imaging.Anchor, error) {
+	if g == "" {
+		return imaging.Center, nil
+	}
+	anchor, ok := gravityAnchors[g]
+	if !ok {
+		return imaging.Center, fmt.Errorf("unknown gravity: %s", g)
+	}
+	return anchor, nil
+}
+
+// parseAnchorGravity разбирает положение накладываемого изображения kind: допустимы только
+// стороны, углы и центр.
+func parseAnchorGravity(kind, s string) (Gravity, error) {
+	gravity, err := ParseGravity(s)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := gravityAnchors[gravity]; !ok {
+		return "", fmt.Errorf("unsupported %s position: %s", kind, s)
+	}
+	return gravity, nil
+}
+
+// ParseOffset разбирает отступ от края изображения вида "x:y" или "n" для одинакового отступа.
+func ParseOffset(s string) (int, int, error) {
+	xStr, yStr, found := strings.Cut(s, ":")
+	if !found {
+		yStr = xStr
+	}
+	x, errX := strconv.Atoi(xStr)
+	y, errY := strconv.Atoi(yStr)
+	if errX != nil || errY != nil || x < 0 || y < 0 {
+		return 0, 0, fmt.Errorf("offset must be non-negative integers x:y: %s", s)
+	}
+	return x, y, nil
+}
+
+// anchoredPosition вычисляет левый верхний угол накладываемого изображения размером size,
+// привязанного к стороне или углу bounds, заданному position.
+// Пустое значение означает DefaultWatermarkPosition.
+func anchoredPosition(
+	bounds image.Rectangle, size image.Point, position Gravity, offsetX, offsetY int,
+) (image.Point, error) {
+	if position == "" {
+		position = DefaultWatermarkPosition
+	}
+	anchor, ok := gravityAnchors[position]
+	if !ok {
+		return image.Point{}, fmt.Errorf("unsupported overlay position: %s", position)
+	}
+
+	// Отступ отсчитывается от края, к которому привязан знак, а по центру - смещает вправо и вниз
+	x := bounds.Min.X + (bounds.Dx()-size.X)/2 + offsetX
+	y := bounds.Min.Y + (bounds.Dy()-size.Y)/2 + offsetY
+	switch anchor {
+	case imaging.TopLeft, imaging.Left, imaging.BottomLeft:
+		x = bounds.Min.X + offsetX
+	case imaging.TopRight, imaging.Right, imaging.BottomRight:
+		x = bounds.Max.X - size.X - offsetX
+	case imaging.Center, imaging.Top, imaging.Bottom:
+	}
+	switch anchor {
+	case imaging.TopLeft, imaging.Top, imaging.TopRight:
+		y = bounds.Min.Y + offsetY
+	case imaging.BottomLeft, imaging.Bottom, imaging.BottomRight:
+		y = bounds.Max.Y - size.Y - offsetY
+	case imaging.Center, imaging.Left, imaging.Right:
+	}
+	return image.Pt(x, y), nil
+}
@@ -0,0 +1,124 @@
+package jpeg
+
+const (
+	// maxCodeLength - наибольшая длина кода Хаффмана в JPEG.
+	maxCodeLength = 16
+	numSymbols    = 256
+)
+
+// huffmanTable - таблица Хаффмана в виде, в котором она записывается в маркер DHT,
+// и коды символов для кодирования.
+type huffmanTable struct {
+	// counts[i] - количество кодов длины i+1.
+	counts [maxCodeLength]byte
+	values []byte
+	codes  [numSymbols]uint32
+	sizes  [numSymbols]uint8
+}
+
+// buildHuffmanTable строит оптимальную таблицу по частотам символов с длинами кодов
+// не больше 16 и без кода из одних единиц (ITU T.81, приложение K.2).
+func buildHuffmanTable(freqs *[numSymbols]int64) *huffmanTable {
+	// Зарезервированный символ получает самый длинный код из одних единиц и затем удаляется
+	var freq [numSymbols + 1]int64
+	copy(freq[:], freqs[:])
+	freq[numSymbols] = 1
+	if leastFrequent(&freq, numSymbols) < 0 {
+		// Таблица без символов не может быть записана, поэтому добавляем произвольный
+		freq[0] = 1
+	}
+
+	var codeSize [numSymbols + 1]int
+	var others [numSymbols + 1]int
+	for i := range others {
+		others[i] = -1
+	}
+
+	for {
+		c1, c2 := leastFrequent(&freq, -1), -1
+		if c1 >= 0 {
+			c2 = leastFrequent(&freq, c1)
+		}
+		if c2 < 0 {
+			break
+		}
+
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+
+	var bits [2*maxCodeLength + 1]int
+	for _, size := range codeSize {
+		if size > 0 {
+			bits[min(size, 2*maxCodeLength)]++
+		}
+	}
+
+	// Укорачиваем слишком длинные коды, сохраняя полноту дерева
+	for i := 2 * maxCodeLength; i > maxCodeLength; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	i := maxCodeLength
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	t := &huffmanTable{}
+	for length := 1; length <= maxCodeLength; length++ {
+		t.counts[length-1] = byte(bits[length])
+	}
+	for size := 1; size <= 2*maxCodeLength; size++ {
+		for s := 0; s < numSymbols; s++ {
+			if codeSize[s] == size {
+				t.values = append(t.values, byte(s))
+			}
+		}
+	}
+
+	// Канонические коды в порядке перечисления символов (ITU T.81, приложение C)
+	code, k := uint32(0), 0
+	for length := 1; length <= maxCodeLength; length++ {
+		for n := 0; n < int(t.counts[length-1]); n++ {
+			s := t.values[k]
+			t.codes[s], t.sizes[s] = code, uint8(length)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+
+	return t
+}
+
+// leastFrequent возвращает символ с наименьшей ненулевой частотой, кроме exclude,
+// или -1, если такого нет. При равных частотах выбирается символ с большим номером.
+func leastFrequent(freq *[numSymbols + 1]int64, exclude int) int {
+	best := -1
+	for i, f := range freq {
+		if f > 0 && i != exclude && (best < 0 || f <= freq[best]) {
+			best = i
+		}
+	}
+	return best
+}
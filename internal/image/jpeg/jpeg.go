@@ -0,0 +1,471 @@
+// Package jpeg реализует кодирование прогрессивных JPEG (SOF2) с оптимизированными
+// для каждого прохода таблицами Хаффмана. Стандартная библиотека умеет записывать только baseline JPEG.
+package jpeg
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"math/bits"
+)
+
+const (
+	// DefaultQuality - качество по умолчанию, как в image/jpeg.
+	DefaultQuality = 75
+	blockSize      = 64
+	// maxDimension - наибольший размер стороны изображения JPEG.
+	maxDimension = 65535
+	// maxLevel ограничивает модуль квантованного коэффициента, чтобы его категория не превышала допустимую.
+	maxLevel = 1023
+	// maxEOBRun - наибольшая длина серии пустых блоков, кодируемая одним символом.
+	maxEOBRun = 0x7fff
+)
+
+// Маркеры JPEG (ITU T.81, таблица B.1).
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOF2 = 0xc2
+	markerDHT  = 0xc4
+	markerDQT  = 0xdb
+	markerSOS  = 0xda
+)
+
+// Options - параметры кодирования.
+type Options struct {
+	// Quality - качество от 1 до 100. Нулевое значение означает DefaultQuality.
+	Quality int
+}
+
+// component - компонента изображения с квантованными коэффициентами блоков.
+type component struct {
+	id byte
+	// Коэффициенты прореживания по горизонтали и вертикали.
+	h, v int
+	// quant - номер таблицы квантования, он же номер таблиц Хаффмана.
+	quant int
+	// Количество блоков компоненты, покрывающих изображение, и в сетке, дополненной до целых MCU.
+	blocksW, blocksH int
+	paddedW, paddedH int
+	coeffs           [][blockSize]int32
+}
+
+// scan - проход прогрессивного JPEG: набор компонент и диапазон коэффициентов в зигзагообразном порядке.
+type scan struct {
+	components []int
+	start, end int
+}
+
+// Encode записывает изображение в w в формате прогрессивного JPEG. Если o равен nil,
+// используется качество по умолчанию. Прозрачность не сохраняется.
+func Encode(w io.Writer, img image.Image, o *Options) error {
+	bounds := img.Bounds()
+	if bounds.Dx() < 1 || bounds.Dy() < 1 || bounds.Dx() > maxDimension || bounds.Dy() > maxDimension {
+		return errors.New("jpeg: invalid image size")
+	}
+
+	quality := DefaultQuality
+	if o != nil && o.Quality > 0 {
+		quality = min(o.Quality, 100)
+	}
+	quant := scaleQuantTables(quality)
+
+	components, scans := prepareComponents(img, &quant)
+
+	bw := bufio.NewWriter(w)
+	e := &encoder{w: bw}
+	e.writeMarker(markerSOI, nil)
+	e.writeDQT(&quant, len(components) > 1)
+	e.writeSOF(bounds.Dx(), bounds.Dy(), components)
+	for _, s := range scans {
+		e.writeScan(components, s)
+	}
+	e.writeMarker(markerEOI, nil)
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+// scaleQuantTables масштабирует базовые таблицы квантования так же, как libjpeg.
+func scaleQuantTables(quality int) [2][blockSize]int32 {
+	scale := int32(200 - 2*quality)
+	if quality < 50 {
+		scale = int32(5000 / quality)
+	}
+	var quant [2][blockSize]int32
+	for t := range quant {
+		for i, q := range baseQuantTables[t] {
+			quant[t][i] = max(1, min(255, (q*scale+50)/100))
+		}
+	}
+	return quant
+}
+
+// prepareComponents переводит изображение в YCbCr с прореживанием цветности 4:2:0
+// (или оставляет одну компоненту для полутоновых изображений), выполняет DCT и квантование.
+// Возвращает компоненты и последовательность проходов.
+func prepareComponents(img image.Image, quant *[2][blockSize]int32) ([]component, []scan) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	if gray, ok := img.(*image.Gray); ok {
+		c := newComponent(1, 1, 1, 0, w, h, (w+7)/8, (h+7)/8)
+		sample := func(x, y int) float64 {
+			return float64(gray.GrayAt(bounds.Min.X+min(x, w-1), bounds.Min.Y+min(y, h-1)).Y)
+		}
+		c.transform(sample, &quant[0])
+		return []component{c}, []scan{
+			{[]int{0}, 0, 0},
+			{[]int{0}, 1, 5},
+			{[]int{0}, 6, 63},
+		}
+	}
+
+	mcusW, mcusH := (w+15)/16, (h+15)/16
+	yc := newComponent(1, 2, 2, 0, w, h, mcusW, mcusH)
+	cb := newComponent(2, 1, 1, 1, (w+1)/2, (h+1)/2, mcusW, mcusH)
+	cr := newComponent(3, 1, 1, 1, (w+1)/2, (h+1)/2, mcusW, mcusH)
+
+	// Плоскости YCbCr, дополненные повтором краевых пикселей до целого числа MCU
+	planeW, planeH := yc.paddedW*8, yc.paddedH*8
+	planes := [3][]uint8{make([]uint8, planeW*planeH), make([]uint8, planeW*planeH), make([]uint8, planeW*planeH)}
+	for y := 0; y < planeH; y++ {
+		for x := 0; x < planeW; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+min(x, w-1), bounds.Min.Y+min(y, h-1)).RGBA()
+			yy, cbb, crr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			i := y*planeW + x
+			planes[0][i], planes[1][i], planes[2][i] = yy, cbb, crr
+		}
+	}
+
+	yc.transform(func(x, y int) float64 { return float64(planes[0][y*planeW+x]) }, &quant[0])
+	for i, c := range []*component{&cb, &cr} {
+		plane := planes[i+1]
+		c.transform(func(x, y int) float64 {
+			p := 2*y*planeW + 2*x
+			return float64(int(plane[p])+int(plane[p+1])+int(plane[p+planeW])+int(plane[p+planeW+1])) / 4
+		}, &quant[1])
+	}
+
+	// Сначала передаются DC и первые коэффициенты яркости, чтобы раньше появилось грубое изображение
+	return []component{yc, cb, cr}, []scan{
+		{[]int{0, 1, 2}, 0, 0},
+		{[]int{0}, 1, 5},
+		{[]int{1}, 1, 63},
+		{[]int{2}, 1, 63},
+		{[]int{0}, 6, 63},
+	}
+}
+
+// newComponent создает компоненту размером w x ht отсчетов в изображении из mcusW x mcusH MCU.
+func newComponent(id byte, h, v, quant, w, ht, mcusW, mcusH int) component {
+	return component{
+		id:      id,
+		h:       h,
+		v:       v,
+		quant:   quant,
+		blocksW: (w + 7) / 8,
+		blocksH: (ht + 7) / 8,
+		paddedW: mcusW * h,
+		paddedH: mcusH * v,
+	}
+}
+
+// transform выполняет DCT и квантование всех блоков компоненты. sample возвращает
+// значение отсчета компоненты в координатах дополненной сетки блоков.
+func (c *component) transform(sample func(x, y int) float64, quant *[blockSize]int32) {
+	c.coeffs = make([][blockSize]int32, c.paddedW*c.paddedH)
+	var block, out [blockSize]float64
+	for by := 0; by < c.paddedH; by++ {
+		for bx := 0; bx < c.paddedW; bx++ {
+			for i := range block {
+				block[i] = sample(bx*8+i%8, by*8+i/8) - 128
+			}
+			forwardDCT(&block, &out)
+			coeffs := &c.coeffs[by*c.paddedW+bx]
+			for i, v := range out {
+				level := int32(math.Round(v / float64(quant[i])))
+				coeffs[i] = max(-maxLevel, min(maxLevel, level))
+			}
+		}
+	}
+}
+
+// dctCos[u][x] = C(u)/2 * cos((2x+1)uπ/16).
+var dctCos = func() [8][8]float64 {
+	var t [8][8]float64
+	for u := range t {
+		cu := 0.5
+		if u == 0 {
+			cu = 0.5 / math.Sqrt2
+		}
+		for x := range t[u] {
+			t[u][x] = cu * math.Cos(float64((2*x+1)*u)*math.Pi/16)
+		}
+	}
+	return t
+}()
+
+// forwardDCT выполняет двумерное DCT блока 8x8 (ITU T.81, раздел A.3.3).
+func forwardDCT(in, out *[blockSize]float64) {
+	var tmp [blockSize]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += dctCos[u][x] * in[y*8+x]
+			}
+			tmp[y*8+u] = s
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var s float64
+			for y := 0; y < 8; y++ {
+				s += dctCos[v][y] * tmp[y*8+u]
+			}
+			out[v*8+u] = s
+		}
+	}
+}
+
+// encoder записывает маркеры и энтропийно кодированные данные, запоминая первую ошибку записи.
+type encoder struct {
+	w   *bufio.Writer
+	err error
+	// Накопленные, но еще не записанные биты.
+	acc   uint32
+	nBits uint
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+func (e *encoder) writeMarker(marker byte, payload []byte) {
+	e.write([]byte{0xff, marker})
+	if payload != nil {
+		e.write([]byte{byte((len(payload) + 2) >> 8), byte(len(payload) + 2)})
+		e.write(payload)
+	}
+}
+
+// writeDQT записывает таблицы квантования в зигзагообразном порядке.
+func (e *encoder) writeDQT(quant *[2][blockSize]int32, chroma bool) {
+	var payload []byte
+	for t := range quant {
+		if t > 0 && !chroma {
+			break
+		}
+		payload = append(payload, byte(t))
+		for _, i := range unzig {
+			payload = append(payload, byte(quant[t][i]))
+		}
+	}
+	e.writeMarker(markerDQT, payload)
+}
+
+// writeSOF записывает заголовок прогрессивного кадра.
+func (e *encoder) writeSOF(w, h int, components []component) {
+	payload := []byte{8, byte(h >> 8), byte(h), byte(w >> 8), byte(w), byte(len(components))}
+	for _, c := range components {
+		payload = append(payload, c.id, byte(c.h<<4|c.v), byte(c.quant))
+	}
+	e.writeMarker(markerSOF2, payload)
+}
+
+// writeScan записывает проход: сначала по статистике прохода строятся оптимальные таблицы,
+// затем данные кодируются ими.
+func (e *encoder) writeScan(components []component, s scan) {
+	counter := &scanCoder{}
+	counter.encode(components, s)
+
+	tableClass := byte(1)
+	if s.start == 0 {
+		tableClass = 0
+	}
+	var dht []byte
+	var tables [2]*huffmanTable
+	for t := range tables {
+		if !counter.used[t] {
+			continue
+		}
+		tables[t] = buildHuffmanTable(&counter.freqs[t])
+		dht = append(dht, tableClass<<4|byte(t))
+		dht = append(dht, tables[t].counts[:]...)
+		dht = append(dht, tables[t].values...)
+	}
+	e.writeMarker(markerDHT, dht)
+
+	sos := []byte{byte(len(s.components))}
+	for _, i := range s.components {
+		table := byte(scanTable(components, i, s))
+		sos = append(sos, components[i].id, table<<4|table)
+	}
+	sos = append(sos, byte(s.start), byte(s.end), 0)
+	e.writeMarker(markerSOS, sos)
+
+	writer := &scanCoder{e: e, tables: tables}
+	writer.encode(components, s)
+	e.flushBits()
+}
+
+// scanTable возвращает номер таблицы Хаффмана компоненты в проходе. В проходах AC участвует
+// одна компонента, поэтому им достаточно одной таблицы.
+func scanTable(components []component, i int, s scan) int {
+	if s.start == 0 {
+		return components[i].quant
+	}
+	return 0
+}
+
+// writeBits записывает n младших битов v, начиная со старшего, вставляя нулевой байт после 0xff.
+func (e *encoder) writeBits(v uint32, n uint) {
+	for n > 0 {
+		take := min(n, 8)
+		n -= take
+		e.acc = e.acc<<take | v>>n&(1<<take-1)
+		e.nBits += take
+		for e.nBits >= 8 {
+			b := byte(e.acc >> (e.nBits - 8))
+			e.nBits -= 8
+			if b == 0xff {
+				e.write([]byte{0xff, 0})
+			} else {
+				e.write([]byte{b})
+			}
+		}
+		e.acc &= 1<<e.nBits - 1
+	}
+}
+
+// flushBits дополняет последний байт прохода единицами.
+func (e *encoder) flushBits() {
+	if e.nBits > 0 {
+		e.writeBits(1<<(8-e.nBits)-1, 8-e.nBits)
+	}
+}
+
+// scanCoder кодирует проход. Если e равен nil, только подсчитываются частоты символов.
+type scanCoder struct {
+	e      *encoder
+	tables [2]*huffmanTable
+	freqs  [2][numSymbols]int64
+	used   [2]bool
+	eobRun int
+}
+
+func (c *scanCoder) symbol(table int, s byte) {
+	if c.e == nil {
+		c.freqs[table][s]++
+		c.used[table] = true
+		return
+	}
+	t := c.tables[table]
+	c.e.writeBits(t.codes[s], uint(t.sizes[s]))
+}
+
+func (c *scanCoder) bits(v uint32, n int) {
+	if c.e != nil && n > 0 {
+		c.e.writeBits(v, uint(n))
+	}
+}
+
+// encode кодирует блоки прохода. Проходы AC содержат одну компоненту и обходят только блоки,
+// покрывающие изображение.
+func (c *scanCoder) encode(components []component, s scan) {
+	if s.start == 0 {
+		c.encodeDC(components, s.components)
+		return
+	}
+
+	comp := &components[s.components[0]]
+	for by := 0; by < comp.blocksH; by++ {
+		for bx := 0; bx < comp.blocksW; bx++ {
+			c.encodeACBlock(&comp.coeffs[by*comp.paddedW+bx], s.start, s.end)
+		}
+	}
+	c.flushEOBRun()
+}
+
+// encodeDC кодирует разности коэффициентов DC. Если в проходе несколько компонент,
+// блоки чередуются по MCU, иначе обходятся только блоки, покрывающие изображение.
+func (c *scanCoder) encodeDC(components []component, indices []int) {
+	var pred [3]int32
+	first := &components[indices[0]]
+	mcusW, mcusH := first.paddedW/first.h, first.paddedH/first.v
+	if len(indices) == 1 {
+		mcusW, mcusH = first.blocksW, first.blocksH
+	}
+	for my := 0; my < mcusH; my++ {
+		for mx := 0; mx < mcusW; mx++ {
+			for _, i := range indices {
+				comp := &components[i]
+				h, v := comp.h, comp.v
+				if len(indices) == 1 {
+					h, v = 1, 1
+				}
+				for b := 0; b < h*v; b++ {
+					dc := comp.coeffs[(my*v+b/h)*comp.paddedW+mx*h+b%h][0]
+					c.putValue(comp.quant, 0, dc-pred[i])
+					pred[i] = dc
+				}
+			}
+		}
+	}
+}
+
+// encodeACBlock кодирует коэффициенты блока с start по end. Блоки без ненулевых коэффициентов
+// в конце диапазона объединяются в серии (ITU T.81, раздел G.1.2.2).
+func (c *scanCoder) encodeACBlock(coeffs *[blockSize]int32, start, end int) {
+	run := 0
+	for k := start; k <= end; k++ {
+		v := coeffs[unzig[k]]
+		if v == 0 {
+			run++
+			continue
+		}
+		c.flushEOBRun()
+		for run > 15 {
+			c.symbol(0, 0xf0)
+			run -= 16
+		}
+		c.putValue(0, run, v)
+		run = 0
+	}
+	if run > 0 {
+		c.eobRun++
+		if c.eobRun == maxEOBRun {
+			c.flushEOBRun()
+		}
+	}
+}
+
+func (c *scanCoder) flushEOBRun() {
+	if c.eobRun == 0 {
+		return
+	}
+	n := bits.Len(uint(c.eobRun)) - 1
+	c.symbol(0, byte(n<<4))
+	c.bits(uint32(c.eobRun), n)
+	c.eobRun = 0
+}
+
+// putValue кодирует значение v с предшествующей серией нулей run: символ
+// с категорией значения и дополнительные биты (ITU T.81, раздел F.1.2).
+func (c *scanCoder) putValue(table, run int, v int32) {
+	a := v
+	if v < 0 {
+		a = -v
+		v--
+	}
+	size := bits.Len32(uint32(a))
+	c.symbol(table, byte(run<<4|size))
+	c.bits(uint32(v)&(1<<size-1), size)
+}
@@ -0,0 +1,213 @@
+package jpeg_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	stdjpeg "image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/romangricuk/image-previewer/internal/image/jpeg"
+)
+
+func TestEncodeProgressive(t *testing.T) {
+	photo := readTestImage(t, "gopher_256x126.jpg")
+
+	testCases := []struct {
+		name string
+		img  image.Image
+	}{
+		{"photo", photo},
+		{"odd size", gradientImage(37, 21)},
+		{"gray", grayImage(photo)},
+		{"single pixel", image.NewNRGBA(image.Rect(0, 0, 1, 1))},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := jpeg.Encode(&buf, tc.img, &jpeg.Options{Quality: 90}); err != nil {
+				t.Fatalf("Encode failed: %v", err)
+			}
+			if !bytes.Contains(buf.Bytes(), []byte{0xff, 0xc2}) {
+				t.Fatal("Expected progressive SOF2 marker")
+			}
+
+			decoded, err := stdjpeg.Decode(&buf)
+			if err != nil {
+				t.Fatalf("Failed to decode JPEG: %v", err)
+			}
+			if decoded.Bounds().Size() != tc.img.Bounds().Size() {
+				t.Fatalf("Expected size %v, got %v", tc.img.Bounds().Size(), decoded.Bounds().Size())
+			}
+			if psnr := grayPSNR(tc.img, decoded); psnr < 30 {
+				t.Errorf("PSNR %.1f dB is too low", psnr)
+			}
+		})
+	}
+}
+
+func TestEncodeQuality(t *testing.T) {
+	img := readTestImage(t, "gopher_256x126.jpg")
+
+	var sizes []int
+	for _, quality := range []int{20, 95} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		sizes = append(sizes, buf.Len())
+	}
+	if sizes[0] >= sizes[1] {
+		t.Errorf("Expected lower quality to produce smaller file, got %d and %d bytes", sizes[0], sizes[1])
+	}
+
+	// Оптимизированные таблицы Хаффмана дают файл меньше, чем baseline с теми же таблицами квантования
+	var progressive, baseline bytes.Buffer
+	if err := jpeg.Encode(&progressive, img, nil); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if err := stdjpeg.Encode(&baseline, img, nil); err != nil {
+		t.Fatalf("Baseline encode failed: %v", err)
+	}
+	if progressive.Len() >= baseline.Len() {
+		t.Errorf("Expected progressive file smaller than baseline, got %d and %d bytes", progressive.Len(), baseline.Len())
+	}
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 0, 10)), nil); err == nil {
+		t.Fatal("Expected error for empty image")
+	}
+}
+
+// FuzzEncode проверяет, что любое изображение кодируется в прогрессивный JPEG, который декодирует image/jpeg,
+// а ошибка яркости в каждом блоке не превышает ошибки квантования коэффициентов DCT.
+func FuzzEncode(f *testing.F) {
+	f.Add([]byte{}, uint8(0), uint8(0), false, uint8(0))
+	f.Add(gradientImage(37, 21).Pix, uint8(36), uint8(20), false, uint8(90))
+	f.Add(gradientImage(37, 21).Pix, uint8(36), uint8(20), true, uint8(1))
+	f.Add([]byte{0, 255, 17, 255, 255, 0, 240, 255}, uint8(15), uint8(16), false, uint8(100))
+
+	f.Fuzz(func(t *testing.T, pix []byte, w, h uint8, gray bool, quality uint8) {
+		// JPEG не хранит прозрачность, поэтому pix по кругу задает только цвета RGB
+		rgb := image.NewNRGBA(image.Rect(0, 0, int(w)+1, int(h)+1))
+		for i := 0; i < len(rgb.Pix); i += 4 {
+			rgb.Pix[i+3] = 255
+			if len(pix) > 0 {
+				for c := 0; c < 3; c++ {
+					rgb.Pix[i+c] = pix[(i/4*3+c)%len(pix)]
+				}
+			}
+		}
+		var img image.Image = rgb
+		if gray {
+			img = grayImage(img)
+		}
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: int(quality) % 101}); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		data := buf.Bytes()
+		decoded, err := stdjpeg.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Failed to decode JPEG: %v", err)
+		}
+		if decoded.Bounds().Size() != img.Bounds().Size() {
+			t.Fatalf("Expected size %v, got %v", img.Bounds().Size(), decoded.Bounds().Size())
+		}
+
+		// DCT ортонормировано, поэтому среднеквадратичная ошибка блока не больше ошибки округления
+		// коэффициентов до шагов квантования (не больше половины шага) с запасом на округление при декодировании
+		i := bytes.Index(data, []byte{0xff, 0xdb})
+		if i < 0 || len(data) < i+5+64 {
+			t.Fatal("Expected quantization table")
+		}
+		var sum float64
+		for _, q := range data[i+5 : i+5+64] {
+			sum += float64(q) * float64(q)
+		}
+		limit := math.Sqrt(sum)/2 + 16
+
+		bounds := img.Bounds()
+		for by := 0; by < bounds.Dy(); by += 8 {
+			for bx := 0; bx < bounds.Dx(); bx += 8 {
+				var blockErr float64
+				for y := by; y < min(by+8, bounds.Dy()); y++ {
+					for x := bx; x < min(bx+8, bounds.Dx()); x++ {
+						d := float64(luma(img.At(x, y))) - float64(luma(decoded.At(x, y)))
+						blockErr += d * d
+					}
+				}
+				if math.Sqrt(blockErr) > limit {
+					t.Fatalf("Block (%d, %d): luma error %.1f exceeds %.1f", bx, by, math.Sqrt(blockErr), limit)
+				}
+			}
+		}
+	})
+}
+
+// luma возвращает яркость цвета в YCbCr, как ее кодирует JPEG.
+func luma(c color.Color) uint8 {
+	return color.YCbCrModel.Convert(c).(color.YCbCr).Y
+}
+
+// grayPSNR вычисляет отношение сигнал/шум по яркости декодированного изображения.
+func grayPSNR(img, decoded image.Image) float64 {
+	bounds := img.Bounds()
+	var sum float64
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			want := color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+			got := color.GrayModel.Convert(decoded.At(x, y)).(color.Gray).Y
+			d := float64(want) - float64(got)
+			sum += d * d
+		}
+	}
+	if sum == 0 {
+		return math.Inf(1)
+	}
+	mse := sum / float64(bounds.Dx()*bounds.Dy())
+	return 10 * math.Log10(255*255/mse)
+}
+
+// gradientImage создает изображение с плавными переходами цвета.
+func gradientImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func grayImage(img image.Image) *image.Gray {
+	bounds := img.Bounds()
+	gray := image.NewGray(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			gray.Set(x, y, img.At(x, y))
+		}
+	}
+	return gray
+}
+
+func readTestImage(t *testing.T, name string) image.Image {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("..", "..", "..", "test", "data", name))
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	img, err := stdjpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to decode test image: %v", err)
+	}
+	return img
+}
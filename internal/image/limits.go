@@ -0,0 +1,48 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/romangricuk/image-previewer/internal/image/webp"
+)
+
+// ErrTooManyPixels возвращается, если разрешение исходного изображения или запрошенный размер результата
+// превышают Options.MaxPixels, а также если для выбранного кадра пришлось бы декодировать больше
+// Options.MaxFrames кадров.
+var ErrTooManyPixels = errors.New("source image resolution exceeds the limit")
+
+// sourcePixels возвращает число пикселей изображения по его заголовку, не декодируя изображение.
+// Для анимаций GIF возвращается размер холста, за пределы которого кадры не выходят, а для WebP -
+// наибольший размер из заголовков холста и кадров. Если размер определить не удалось, возвращается 0.
+func sourcePixels(data []byte) int {
+	// Заголовок VP8X, который возвращает image.DecodeConfig, может быть меньше потоков кадров
+	if size, ok := webp.Size(data); ok {
+		return size.X * size.Y
+	}
+	if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return config.Width * config.Height
+	}
+	return 0
+}
+
+// checkPixels возвращает ErrTooManyPixels, если frames кадров по pixels пикселей превышают maxPixels.
+// Нулевое значение maxPixels снимает ограничение.
+func checkPixels(pixels, frames, maxPixels int) error {
+	// Деление вместо умножения исключает переполнение
+	if maxPixels > 0 && frames > 0 && pixels > maxPixels/frames {
+		return fmt.Errorf("%w: %d frames of %d pixels, limit %d", ErrTooManyPixels, frames, pixels, maxPixels)
+	}
+	return nil
+}
+
+// checkOutputPixels возвращает ErrTooManyPixels, если запрошенный размер результата width x height
+// превышает maxPixels. Нулевое значение maxPixels снимает ограничение.
+func checkOutputPixels(width, height, maxPixels int) error {
+	if maxPixels > 0 && width > 0 && height > 0 && width > maxPixels/height {
+		return fmt.Errorf("%w: output %dx%d, limit %d", ErrTooManyPixels, width, height, maxPixels)
+	}
+	return nil
+}
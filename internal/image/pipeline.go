@@ -0,0 +1,96 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Operation - шаг конвейера обработки изображения.
+type Operation interface {
+	// String возвращает каноническую запись операции в синтаксисе опций URL, например "rs:fill:300:200".
+	String() string
+	apply(img image.Image) (image.Image, error)
+}
+
+// resizeOperation изменяет размер изображения в режиме Mode с параметрами обрезки и интерполяции.
+type resizeOperation struct {
+	opts Options
+}
+
+func (op resizeOperation) String() string {
+	o := op.opts
+	parts := []string{fmt.Sprintf("rs:%s:%d:%d", o.Mode, o.Width, o.Height)}
+
+	gravity := o.Gravity
+	if gravity == "" {
+		gravity = GravityCenter
+	}
+	if gravity == GravityFocusPoint {
+		parts = append(parts, "fp:"+formatFloat(o.FocusX)+","+formatFloat(o.FocusY))
+	} else {
+		parts = append(parts, "g:"+string(gravity))
+	}
+
+	filter := o.Filter
+	if filter == "" {
+		filter = DefaultFilter
+	}
+	parts = append(parts, "rf:"+string(filter), "up:"+formatFloat(o.MaxUpscale))
+
+	if o.Background != nil {
+		parts = append(parts, "bg:"+formatColor(*o.Background))
+	}
+	return strings.Join(parts, "/")
+}
+
+func (op resizeOperation) apply(img image.Image) (image.Image, error) {
+	return resize(img, op.opts)
+}
+
+// Operations возвращает шаги обработки изображения в порядке выполнения. Порядок не зависит
+// от порядка опций в запросе. Если режим изменения размера не задан, размер не меняется.
+func (o Options) Operations() []Operation {
+	// Поворот выполняется до изменения размера, чтобы область обрезки вычислялась для повернутого изображения
+	ops := transformOperations(o)
+	if o.Mode != "" {
+		ops = append(ops, resizeOperation{o})
+	}
+	ops = append(ops, adjustOperations(o)...)
+	if o.Watermark != nil {
+		ops = append(ops, watermarkOperation{o.Watermark})
+	}
+	if o.Text != nil {
+		ops = append(ops, textOperation{o.Text})
+	}
+	return ops
+}
+
+// String возвращает каноническую запись параметров обработки: операции в порядке выполнения
+// и параметры кодирования. Параметры, дающие одинаковый результат, записываются одинаково
+// независимо от порядка опций в запросе, поэтому запись используется как ключ кэша.
+func (o Options) String() string {
+	parts := []string{fmt.Sprintf("ar:%t", !o.IgnoreOrientation)}
+	if o.Still {
+		parts = append(parts, "frame:"+strconv.Itoa(o.Frame))
+	}
+	for _, op := range o.Operations() {
+		parts = append(parts, op.String())
+	}
+	format := "f:" + string(o.Format)
+	if o.AutoFormat {
+		format += ":auto"
+	}
+	parts = append(parts,
+		format,
+		"q:"+strconv.Itoa(o.Quality),
+		fmt.Sprintf("pr:%t", o.Progressive),
+		fmt.Sprintf("ll:%t", o.Lossless),
+	)
+	return strings.Join(parts, "/")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,187 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"slices"
+
+	"github.com/disintegration/imaging"
+)
+
+// colorBucket - группа близких цветов гистограммы: суммы каналов и число пикселей.
+type colorBucket struct {
+	r, g, b, count int
+}
+
+func (c colorBucket) channel(i int) int {
+	switch i {
+	case 0:
+		return c.r / c.count
+	case 1:
+		return c.g / c.count
+	default:
+		return c.b / c.count
+	}
+}
+
+// medianCutPalette строит палитру не больше чем из size цветов для непрозрачных пикселей изображения
+// методом медианного сечения: группа цветов с наибольшим разбросом делится пополам по числу пикселей,
+// пока групп не станет size, а цвет палитры - среднее цвета группы.
+func medianCutPalette(img *image.NRGBA, size int) color.Palette {
+	histogram := make(map[int]colorBucket)
+	for i := 0; i < len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4 : i+4]
+		if p[3] < 0x80 {
+			continue
+		}
+		key := colorKey(p[0], p[1], p[2])
+		bucket := histogram[key]
+		bucket.r += int(p[0])
+		bucket.g += int(p[1])
+		bucket.b += int(p[2])
+		bucket.count++
+		histogram[key] = bucket
+	}
+	if len(histogram) == 0 {
+		return nil
+	}
+
+	// Порядок обхода map случаен, поэтому группы упорядочиваются по ключу, чтобы палитра не менялась от запуска к запуску
+	keys := make([]int, 0, len(histogram))
+	for key := range histogram {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	all := make([]colorBucket, 0, len(keys))
+	for _, key := range keys {
+		all = append(all, histogram[key])
+	}
+	boxes := [][]colorBucket{all}
+	for len(boxes) < size {
+		index, channel := widestBox(boxes)
+		if index < 0 {
+			break
+		}
+		low, high := splitBox(boxes[index], channel)
+		boxes[index] = low
+		boxes = append(boxes, high)
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var sum colorBucket
+		for _, bucket := range box {
+			sum.r += bucket.r
+			sum.g += bucket.g
+			sum.b += bucket.b
+			sum.count += bucket.count
+		}
+		palette = append(palette, color.NRGBA{
+			R: uint8(sum.channel(0)), G: uint8(sum.channel(1)), B: uint8(sum.channel(2)), A: 0xff,
+		})
+	}
+	return palette
+}
+
+// widestBox возвращает индекс группы с наибольшим разбросом значений одного из каналов и этот канал.
+// Если ни одну группу нельзя разделить, возвращается -1.
+func widestBox(boxes [][]colorBucket) (int, int) {
+	bestIndex, bestChannel, bestRange := -1, 0, 0
+	for i, box := range boxes {
+		if len(box) < 2 {
+			continue
+		}
+		for channel := 0; channel < 3; channel++ {
+			lo, hi := 255, 0
+			for _, bucket := range box {
+				v := bucket.channel(channel)
+				lo, hi = min(lo, v), max(hi, v)
+			}
+			if hi-lo > bestRange {
+				bestIndex, bestChannel, bestRange = i, channel, hi-lo
+			}
+		}
+	}
+	return bestIndex, bestChannel
+}
+
+// splitBox делит группу по медиане канала channel так, чтобы в обеих частях было примерно поровну пикселей.
+func splitBox(box []colorBucket, channel int) ([]colorBucket, []colorBucket) {
+	// Устойчивая сортировка сохраняет порядок групп с равным значением канала
+	slices.SortStableFunc(box, func(a, b colorBucket) int {
+		return a.channel(channel) - b.channel(channel)
+	})
+
+	total := 0
+	for _, bucket := range box {
+		total += bucket.count
+	}
+	split, count := 1, box[0].count
+	for split < len(box)-1 && count < total/2 {
+		count += box[split].count
+		split++
+	}
+	return box[:split:split], box[split:]
+}
+
+// quantize преобразует кадр в палитровое изображение с палитрой, построенной по его цветам.
+// Полупрозрачные пиксели становятся прозрачными или непрозрачными, как того требует GIF.
+// Ошибка не рассеивается, чтобы одинаковые области соседних кадров не мерцали.
+func quantize(img image.Image) *image.Paletted {
+	src := imaging.Clone(img)
+	bounds := src.Bounds()
+	opaque := medianCutPalette(src, 255)
+	palette := opaque
+	transparent := -1
+	if hasTransparency(src) {
+		transparent = len(opaque)
+		palette = append(palette, color.NRGBA{})
+	}
+
+	dst := image.NewPaletted(bounds, palette)
+	// Ближайший цвет палитры ищется один раз для каждого цвета с точностью 5 бит на канал
+	nearest := make([]int16, 1<<15)
+	for i := range nearest {
+		nearest[i] = -1
+	}
+	for i := 0; i < len(src.Pix); i += 4 {
+		p := src.Pix[i : i+4 : i+4]
+		if p[3] < 0x80 && transparent >= 0 {
+			dst.Pix[i/4] = uint8(transparent)
+			continue
+		}
+		key := colorKey(p[0], p[1], p[2])
+		if nearest[key] < 0 {
+			nearest[key] = int16(nearestColor(opaque, p))
+		}
+		dst.Pix[i/4] = uint8(nearest[key])
+	}
+	return dst
+}
+
+// hasTransparency сообщает, есть ли в изображении пиксели, которые в GIF станут прозрачными.
+func hasTransparency(img *image.NRGBA) bool {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] < 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+func colorKey(r, g, b uint8) int {
+	return int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+}
+
+// nearestColor возвращает индекс ближайшего по евклидову расстоянию цвета палитры.
+func nearestColor(palette color.Palette, p []uint8) int {
+	best, bestDist := 0, -1
+	for i, c := range palette {
+		nc := c.(color.NRGBA)
+		dr, dg, db := int(nc.R)-int(p[0]), int(nc.G)-int(p[1]), int(nc.B)-int(p[2])
+		if dist := dr*dr + dg*dg + db*db; bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
@@ -3,35 +3,220 @@ package image
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"image"
+	"image/color"
 
 	"github.com/disintegration/imaging"
 	"github.com/romangricuk/image-previewer/internal/logger"
+	_ "golang.org/x/image/webp" // Регистрация декодера WebP для исходных изображений
 )
 
-func ResizeImage(ctx context.Context, data []byte, width, height int, log logger.Logger) ([]byte, error) {
+// ResizeMode определяет способ приведения изображения к запрошенным размерам.
+type ResizeMode string
+
+const (
+	// ModeFill изменяет размер с обрезкой до точных размеров.
+	ModeFill ResizeMode = "fill"
+	// ModeFit вписывает изображение в заданные размеры с сохранением пропорций, без обрезки.
+	ModeFit ResizeMode = "fit"
+	// ModePad вписывает изображение в заданные размеры и заполняет оставшуюся область цветом фона.
+	ModePad ResizeMode = "pad"
+)
+
+// ParseResizeMode преобразует строку в режим изменения размера.
+func ParseResizeMode(s string) (ResizeMode, error) {
+	switch mode := ResizeMode(s); mode {
+	case ModeFill, ModeFit, ModePad:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown resize mode: %s", s)
+	}
+}
+
+// Options описывает параметры обработки изображения.
+type Options struct {
+	Mode    ResizeMode
+	Width   int
+	Height  int
+	Gravity Gravity
+	// Координаты фокусной точки в долях от размеров изображения, используются с GravityFocusPoint.
+	FocusX float64
+	FocusY float64
+	// Format - формат результата. Пустое значение означает формат исходного изображения.
+	Format Format
+	// Background - цвет фона в режиме pad. Значение nil означает белый фон.
+	Background *color.NRGBA
+	// Lossless включает сжатие без потерь для форматов, которые его поддерживают (WebP).
+	Lossless bool
+	// Quality - качество сжатия с потерями от 1 до 100 (JPEG, WebP). Нулевое значение означает
+	// качество кодировщика по умолчанию.
+	Quality int
+	// Progressive включает кодирование JPEG в прогрессивном режиме с оптимизированными таблицами Хаффмана.
+	Progressive bool
+	// Filter - фильтр интерполяции. Пустое значение означает DefaultFilter.
+	Filter ResampleFilter
+	// MaxUpscale - наибольший коэффициент увеличения изображения в режиме fill, если оно меньше запрошенного.
+	// Результат уменьшается с сохранением пропорций. Нулевое значение означает отсутствие ограничения.
+	MaxUpscale float64
+	// Rotate - угол поворота по часовой стрелке (0, 90, 180 или 270), FlipH и FlipV - отражение
+	// по горизонтали и вертикали. Выполняются до изменения размера: сначала поворот, затем отражение.
+	Rotate int
+	FlipH  bool
+	FlipV  bool
+	// Коррекции, выполняемые после изменения размера. Нулевые значения их отключают.
+	// Blur и Sharpen - сигма размытия и повышения резкости, Brightness и Contrast - изменение в процентах,
+	// Gamma - гамма-коррекция (1 не меняет изображение).
+	Blur       float64
+	Sharpen    float64
+	Brightness float64
+	Contrast   float64
+	Gamma      float64
+	Grayscale  bool
+	// Watermark - водяной знак, накладываемый после изменения размера и коррекций.
+	Watermark *Watermark
+	// Text - надпись, рисуемая поверх водяного знака.
+	Text *Text
+	// MaxFrames - наибольшее число кадров анимированного GIF, обрабатываемых покадрово. Если кадров больше,
+	// результат строится по первому кадру, а другие кадры GIF и WebP недоступны. Нулевое значение снимает ограничение.
+	MaxFrames int
+	// MaxPixels - наибольшее число пикселей исходного изображения и запрошенного размера результата,
+	// а для покадровой обработки анимации - всех ее кадров. Проверяется до декодирования и выделения памяти
+	// под результат. Нулевое значение снимает ограничение.
+	MaxPixels int
+	// Still означает, что результат строится по одному кадру анимации с номером Frame, начиная с нуля.
+	// Без него анимированный GIF обрабатывается покадрово, а из анимированного WebP берется первый кадр.
+	Still bool
+	Frame int
+	// AutoFormat означает, что Format выбран по заголовку Accept, а не задан в запросе.
+	// Анимированные GIF в этом случае остаются GIF, чтобы не терять анимацию.
+	AutoFormat bool
+	// IgnoreOrientation отключает поворот изображения согласно тегу EXIF Orientation.
+	IgnoreOrientation bool
+}
+
+// ResizeImage выполняет шаги обработки opts.Operations и кодирует результат в формате opts.Format.
+// Если формат не задан, используется формат исходного изображения, а если он
+// не поддерживается для кодирования - DefaultFormat.
+func ResizeImage(ctx context.Context, data []byte, opts Options, log logger.Logger) ([]byte, Format, error) {
 	select {
 	case <-ctx.Done():
 		log.Warn("ResizeImage operation cancelled")
-		return nil, ctx.Err()
+		return nil, "", ctx.Err()
 	default:
 		// Продолжаем обработку
 	}
 
-	img, err := imaging.Decode(bytes.NewReader(data))
+	// Размер проверяется по заголовку до декодирования, чтобы не выделять память под огромное изображение
+	pixels := sourcePixels(data)
+	if err := checkPixels(pixels, 1, opts.MaxPixels); err != nil {
+		log.Warnf("Source image is too large: %v", err)
+		return nil, "", err
+	}
+	// Запрошенный размер ограничивает память под результат, в том числе под фон режима pad
+	if err := checkOutputPixels(opts.Width, opts.Height, opts.MaxPixels); err != nil {
+		log.Warnf("Requested image size is too large: %v", err)
+		return nil, "", err
+	}
+
+	// Анимированный GIF обрабатывается покадрово, если результат тоже GIF
+	frames := countGIFFrames(data)
+	if frames > 1 && opts.keepsAnimation() && animationAllowed(frames, pixels, opts, log) {
+		result, err := resizeAnimatedGIF(data, opts)
+		if err != nil {
+			log.Errorf("Failed to resize animated GIF: %v", err)
+			return nil, "", err
+		}
+		return result, FormatGIF, nil
+	}
+
+	img, formatName, err := decodeFrame(data, opts)
 	if err != nil {
 		log.Errorf("Failed to decode image: %v", err)
-		return nil, err
+		return nil, "", err
 	}
 
-	// Изменение размера с обрезкой
-	img = imaging.Fill(img, width, height, imaging.Center, imaging.Lanczos)
+	format := opts.Format
+	if format == "" {
+		format, err = ParseFormat(formatName)
+		if err != nil {
+			log.Debugf("Source format %s is not supported for encoding, using %s", formatName, DefaultFormat)
+			format = DefaultFormat
+		}
+	}
+
+	for _, op := range opts.Operations() {
+		img, err = op.apply(img)
+		if err != nil {
+			log.Errorf("Failed to apply operation %s: %v", op, err)
+			return nil, "", err
+		}
+	}
+
+	info, ok := formats[format]
+	if !ok {
+		log.Errorf("Unsupported output format: %s", format)
+		return nil, "", fmt.Errorf("unsupported format: %s", format)
+	}
+
+	if !info.supportsAlpha {
+		// Формат без прозрачности: прозрачные области заливаются белым, а не черным
+		img = flatten(img, color.White)
+	}
 
 	var buf bytes.Buffer
-	err = imaging.Encode(&buf, img, imaging.JPEG)
+	err = info.encode(&buf, img, opts)
 	if err != nil {
 		log.Errorf("Failed to encode image: %v", err)
-		return nil, err
+		return nil, "", err
+	}
+
+	return buf.Bytes(), format, nil
+}
+
+func resize(img image.Image, opts Options) (image.Image, error) {
+	filter := opts.Filter.imaging()
+	switch opts.Mode {
+	case ModeFill:
+		opts.Width, opts.Height = limitUpscale(img.Bounds().Size(), opts.Width, opts.Height, opts.MaxUpscale)
+		if opts.Gravity == GravitySmart {
+			// Обрезка по наиболее детализированной области
+			rect := smartCropRect(img, opts.Width, opts.Height)
+			return imaging.Resize(imaging.Crop(img, rect), opts.Width, opts.Height, filter), nil
+		}
+		if opts.Gravity == GravityFocusPoint {
+			// Обрезка вокруг фокусной точки
+			rect := focusPointCropRect(img, opts.Width, opts.Height, opts.FocusX, opts.FocusY)
+			return imaging.Resize(imaging.Crop(img, rect), opts.Width, opts.Height, filter), nil
+		}
+
+		anchor, err := opts.Gravity.anchor()
+		if err != nil {
+			return nil, err
+		}
+		// Изменение размера с обрезкой относительно точки привязки
+		return imaging.Fill(img, opts.Width, opts.Height, anchor, filter), nil
+	case ModeFit:
+		// Вписывание в размеры с сохранением пропорций. Изображения меньше заданных размеров не увеличиваются
+		return imaging.Fit(img, opts.Width, opts.Height, filter), nil
+	case ModePad:
+		// Вписывание в размеры и размещение по центру холста точного размера
+		background := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		if opts.Background != nil {
+			background = *opts.Background
+		}
+		canvas := imaging.New(opts.Width, opts.Height, background)
+		return imaging.OverlayCenter(canvas, imaging.Fit(img, opts.Width, opts.Height, filter), 1), nil
+	default:
+		return nil, fmt.Errorf("unknown resize mode: %s", opts.Mode)
 	}
+}
 
-	return buf.Bytes(), nil
+// flatten накладывает изображение на однотонный фон, если в нем есть прозрачные пиксели.
+func flatten(img image.Image, background color.Color) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	bounds := img.Bounds()
+	return imaging.Overlay(imaging.New(bounds.Dx(), bounds.Dy(), background), img, image.Point{}, 1)
 }
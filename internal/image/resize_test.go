@@ -4,12 +4,18 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	imagePreviewer "github.com/romangricuk/image-previewer/internal/image"
+	"github.com/romangricuk/image-previewer/internal/image/webp"
 	"github.com/romangricuk/image-previewer/internal/logger"
 )
 
@@ -39,7 +45,12 @@ func TestResizeImage(t *testing.T) {
 	height := 100
 
 	// Вызов функции ResizeImage
-	resizedData, err := imagePreviewer.ResizeImage(context.Background(), originalImageData.Bytes(), width, height, log)
+	resizedData, _, err := imagePreviewer.ResizeImage(
+		context.Background(),
+		originalImageData.Bytes(),
+		imagePreviewer.Options{Mode: imagePreviewer.ModeFill, Width: width, Height: height},
+		log,
+	)
 	if err != nil {
 		t.Fatalf("ResizeImage failed: %v", err)
 	}
@@ -87,7 +98,12 @@ func TestResizeImageWithCancelledContext(t *testing.T) {
 	cancel()
 
 	// Вызов функции ResizeImage с отмененным контекстом
-	_, err = imagePreviewer.ResizeImage(ctx, originalImageData.Bytes(), 100, 100, log)
+	_, _, err = imagePreviewer.ResizeImage(
+		ctx,
+		originalImageData.Bytes(),
+		imagePreviewer.Options{Mode: imagePreviewer.ModeFill, Width: 100, Height: 100},
+		log,
+	)
 	if err == nil {
 		t.Fatalf("Expected error due to cancelled context, but got nil")
 	}
@@ -95,3 +111,955 @@ func TestResizeImageWithCancelledContext(t *testing.T) {
 		t.Fatalf("Expected context.Canceled error, got %v", err)
 	}
 }
+
+func TestResizeImageFit(t *testing.T) {
+	log := logger.NewTestLogger()
+	data := readTestImage(t, "test_image.jpg")
+
+	// Исходное изображение 800x600 должно вписаться в 100x100 без обрезки
+	resizedData, _, err := imagePreviewer.ResizeImage(
+		context.Background(),
+		data,
+		imagePreviewer.Options{Mode: imagePreviewer.ModeFit, Width: 100, Height: 100},
+		log,
+	)
+	if err != nil {
+		t.Fatalf("ResizeImage failed: %v", err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(resizedData))
+	if err != nil {
+		t.Fatalf("Failed to decode resized image: %v", err)
+	}
+
+	if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 75 {
+		t.Errorf("Expected image size 100x75, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+}
+
+func TestResizeImagePreservesFormat(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Полупрозрачное изображение: прозрачность должна сохраниться в PNG
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			if x >= 20 {
+				src.Set(x, y, color.NRGBA{R: 255, A: 255})
+			}
+		}
+	}
+
+	var gifData bytes.Buffer
+	if err := gif.Encode(&gifData, src, nil); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected imagePreviewer.Format
+	}{
+		{"jpeg", readTestImage(t, "test_image.jpg"), imagePreviewer.FormatJPEG},
+		{"png", encodePNG(t, src), imagePreviewer.FormatPNG},
+		{"gif", gifData.Bytes(), imagePreviewer.FormatGIF},
+		{"webp", encodeWebP(t, src), imagePreviewer.FormatWebP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resizedData, format, err := imagePreviewer.ResizeImage(
+				context.Background(),
+				tt.data,
+				imagePreviewer.Options{Mode: imagePreviewer.ModeFill, Width: 20, Height: 20},
+				log,
+			)
+			if err != nil {
+				t.Fatalf("ResizeImage failed: %v", err)
+			}
+			if format != tt.expected {
+				t.Fatalf("Expected format %s, got %s", tt.expected, format)
+			}
+
+			img, decodedFormat, err := image.Decode(bytes.NewReader(resizedData))
+			if err != nil {
+				t.Fatalf("Failed to decode resized image: %v", err)
+			}
+			if decodedFormat != string(tt.expected) {
+				t.Errorf("Expected encoded format %s, got %s", tt.expected, decodedFormat)
+			}
+
+			if tt.expected == imagePreviewer.FormatPNG {
+				if _, _, _, a := img.At(0, 10).RGBA(); a != 0 {
+					t.Errorf("Expected transparent pixel, got alpha %d", a>>8)
+				}
+			}
+		})
+	}
+}
+
+func TestResizeImageExplicitFormat(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Прозрачное изображение при кодировании в JPEG должно получить белый фон
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	data := encodePNG(t, src)
+
+	for _, format := range []imagePreviewer.Format{
+		imagePreviewer.FormatJPEG,
+		imagePreviewer.FormatPNG,
+		imagePreviewer.FormatGIF,
+		imagePreviewer.FormatBMP,
+		imagePreviewer.FormatTIFF,
+		imagePreviewer.FormatWebP,
+	} {
+		t.Run(string(format), func(t *testing.T) {
+			resizedData, resultFormat, err := imagePreviewer.ResizeImage(
+				context.Background(),
+				data,
+				imagePreviewer.Options{Mode: imagePreviewer.ModeFit, Width: 20, Height: 20, Format: format},
+				log,
+			)
+			if err != nil {
+				t.Fatalf("ResizeImage failed: %v", err)
+			}
+			if resultFormat != format {
+				t.Fatalf("Expected format %s, got %s", format, resultFormat)
+			}
+
+			img, decodedFormat, err := image.Decode(bytes.NewReader(resizedData))
+			if err != nil {
+				t.Fatalf("Failed to decode resized image: %v", err)
+			}
+			if decodedFormat != string(format) {
+				t.Errorf("Expected encoded format %s, got %s", format, decodedFormat)
+			}
+
+			if format == imagePreviewer.FormatJPEG {
+				if r, g, b, _ := img.At(10, 10).RGBA(); r>>8 < 250 || g>>8 < 250 || b>>8 < 250 {
+					t.Errorf("Expected white background, got r=%d g=%d b=%d", r>>8, g>>8, b>>8)
+				}
+			}
+		})
+	}
+}
+
+func TestResizeImageWebPLossless(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			src.Set(x, y, color.NRGBA{R: uint8(x * 6), G: uint8(y * 6), B: 100, A: uint8(x * y)})
+		}
+	}
+
+	resizedData, _, err := imagePreviewer.ResizeImage(
+		context.Background(),
+		encodePNG(t, src),
+		imagePreviewer.Options{
+			Mode:     imagePreviewer.ModeFit,
+			Width:    40,
+			Height:   40,
+			Format:   imagePreviewer.FormatWebP,
+			Lossless: true,
+		},
+		log,
+	)
+	if err != nil {
+		t.Fatalf("ResizeImage failed: %v", err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(resizedData))
+	if err != nil {
+		t.Fatalf("Failed to decode resized image: %v", err)
+	}
+	// Размер не меняется, поэтому сжатие без потерь должно сохранить пиксели в точности
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			if got := color.NRGBAModel.Convert(img.At(x, y)); got != src.NRGBAAt(x, y) {
+				t.Fatalf("Pixel (%d, %d) mismatch: expected %v, got %v", x, y, src.NRGBAAt(x, y), got)
+			}
+		}
+	}
+}
+
+func TestResizeImageQuality(t *testing.T) {
+	log := logger.NewTestLogger()
+	data := readFile(t, filepath.Join("..", "..", "test", "data", "gopher_256x126.jpg"))
+
+	testCases := []struct {
+		name        string
+		progressive bool
+	}{
+		{"baseline", false},
+		{"progressive", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var sizes []int
+			for _, quality := range []int{20, 95} {
+				resizedData, _, err := imagePreviewer.ResizeImage(
+					context.Background(),
+					data,
+					imagePreviewer.Options{
+						Mode:        imagePreviewer.ModeFill,
+						Width:       200,
+						Height:      100,
+						Format:      imagePreviewer.FormatJPEG,
+						Quality:     quality,
+						Progressive: tc.progressive,
+					},
+					log,
+				)
+				if err != nil {
+					t.Fatalf("ResizeImage failed: %v", err)
+				}
+				// Прогрессивные JPEG отмечаются маркером SOF2
+				if isProgressive := bytes.Contains(resizedData, []byte{0xff, 0xc2}); isProgressive != tc.progressive {
+					t.Errorf("Expected progressive %t, got %t", tc.progressive, isProgressive)
+				}
+				img, _, err := image.Decode(bytes.NewReader(resizedData))
+				if err != nil {
+					t.Fatalf("Failed to decode resized image: %v", err)
+				}
+				if img.Bounds().Dx() != 200 || img.Bounds().Dy() != 100 {
+					t.Errorf("Expected 200x100, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+				}
+				sizes = append(sizes, len(resizedData))
+			}
+			if sizes[0] >= sizes[1] {
+				t.Errorf("Expected lower quality to produce smaller file, got %d and %d bytes", sizes[0], sizes[1])
+			}
+		})
+	}
+}
+
+func TestResizeImageOrientation(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Все файлы хранят одно и то же изображение 48x32 с цветными четвертями,
+	// преобразованное так, что после учета тега Orientation оно выглядит одинаково
+	quadrants := []struct {
+		x, y int
+		want color.NRGBA
+	}{
+		{12, 8, color.NRGBA{R: 255, A: 255}},
+		{36, 8, color.NRGBA{G: 255, A: 255}},
+		{12, 24, color.NRGBA{B: 255, A: 255}},
+		{36, 24, color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+	}
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		t.Run(fmt.Sprintf("orientation %d", orientation), func(t *testing.T) {
+			path := filepath.Join("..", "..", "test", "data", "orientation", fmt.Sprintf("orientation_%d.jpg", orientation))
+			img := resizeToPNG(t, readFile(t, path), imagePreviewer.Options{
+				Mode:   imagePreviewer.ModeFit,
+				Width:  48,
+				Height: 48,
+				Format: imagePreviewer.FormatPNG,
+			}, log)
+
+			if img.Bounds().Dx() != 48 || img.Bounds().Dy() != 32 {
+				t.Fatalf("Expected 48x32, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+			}
+			for _, q := range quadrants {
+				got := color.NRGBAModel.Convert(img.At(q.x, q.y)).(color.NRGBA)
+				if colorDistance(got, q.want) > 30 {
+					t.Errorf("Pixel (%d, %d): expected %v, got %v", q.x, q.y, q.want, got)
+				}
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		path := filepath.Join("..", "..", "test", "data", "orientation", "orientation_6.jpg")
+		img := resizeToPNG(t, readFile(t, path), imagePreviewer.Options{
+			Mode:              imagePreviewer.ModeFit,
+			Width:             48,
+			Height:            48,
+			Format:            imagePreviewer.FormatPNG,
+			IgnoreOrientation: true,
+		}, log)
+
+		// Без учета тега изображение остается в ориентации, в которой хранится
+		if img.Bounds().Dx() != 32 || img.Bounds().Dy() != 48 {
+			t.Fatalf("Expected 32x48, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+		}
+	})
+}
+
+func TestResizeImageFilter(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Шахматная доска из клеток 1x1: при уменьшении фильтры с усреднением дают серый цвет,
+	// а выборка ближайшего пикселя сохраняет исходные цвета
+	src := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if (x+y)%2 == 0 {
+				src.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+
+	testCases := []struct {
+		name   string
+		filter imagePreviewer.ResampleFilter
+		gray   bool
+	}{
+		{"nearest", imagePreviewer.FilterNearest, false},
+		{"linear", imagePreviewer.FilterLinear, true},
+		{"lanczos", imagePreviewer.FilterLanczos, true},
+		{"default", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			img := resizeToPNG(t, encodePNG(t, src), imagePreviewer.Options{
+				Mode:   imagePreviewer.ModeFit,
+				Width:  21,
+				Height: 21,
+				Format: imagePreviewer.FormatPNG,
+				Filter: tc.filter,
+			}, log)
+
+			r, _, _, _ := img.At(10, 10).RGBA()
+			isGray := r>>8 > 64 && r>>8 < 192
+			if isGray != tc.gray {
+				t.Errorf("Expected averaged color %t, got value %d", tc.gray, r>>8)
+			}
+		})
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	testCases := map[string]imagePreviewer.ResampleFilter{
+		"nearest":     imagePreviewer.FilterNearest,
+		"Lanczos":     imagePreviewer.FilterLanczos,
+		"catmull-rom": imagePreviewer.FilterCatmullRom,
+		"bicubic":     imagePreviewer.FilterCatmullRom,
+		"bilinear":    imagePreviewer.FilterLinear,
+	}
+	for s, want := range testCases {
+		filter, err := imagePreviewer.ParseFilter(s)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q) failed: %v", s, err)
+		}
+		if filter != want {
+			t.Errorf("ParseFilter(%q): expected %s, got %s", s, want, filter)
+		}
+	}
+
+	if _, err := imagePreviewer.ParseFilter("sinc"); err == nil {
+		t.Errorf("Expected error for unknown filter")
+	}
+}
+
+func TestResizeImageUpscale(t *testing.T) {
+	log := logger.NewTestLogger()
+	data := readFile(t, filepath.Join("..", "..", "test", "data", "gopher_50x50.jpg"))
+
+	testCases := []struct {
+		name          string
+		mode          imagePreviewer.ResizeMode
+		maxUpscale    float64
+		width, height int
+	}{
+		{"allow", imagePreviewer.ModeFill, 0, 200, 100},
+		{"deny", imagePreviewer.ModeFill, 1, 50, 25},
+		{"cap 2x", imagePreviewer.ModeFill, 2, 100, 50},
+		{"cap not reached", imagePreviewer.ModeFill, 10, 200, 100},
+		{"fit", imagePreviewer.ModeFit, 0, 50, 50},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resizedData, _, err := imagePreviewer.ResizeImage(
+				context.Background(),
+				data,
+				imagePreviewer.Options{Mode: tc.mode, Width: 200, Height: 100, MaxUpscale: tc.maxUpscale},
+				log,
+			)
+			if err != nil {
+				t.Fatalf("ResizeImage failed: %v", err)
+			}
+			img, _, err := image.Decode(bytes.NewReader(resizedData))
+			if err != nil {
+				t.Fatalf("Failed to decode resized image: %v", err)
+			}
+			if img.Bounds().Dx() != tc.width || img.Bounds().Dy() != tc.height {
+				t.Errorf("Expected %dx%d, got %dx%d", tc.width, tc.height, img.Bounds().Dx(), img.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestParseUpscale(t *testing.T) {
+	testCases := map[string]float64{
+		"allow": 0,
+		"deny":  1,
+		"2":     2,
+		"1.5x":  1.5,
+		"3X":    3,
+	}
+	for s, want := range testCases {
+		maxUpscale, err := imagePreviewer.ParseUpscale(s)
+		if err != nil {
+			t.Fatalf("ParseUpscale(%q) failed: %v", s, err)
+		}
+		if maxUpscale != want {
+			t.Errorf("ParseUpscale(%q): expected %g, got %g", s, want, maxUpscale)
+		}
+	}
+
+	for _, s := range []string{"0.5x", "never", "-2", "inf", "NaN"} {
+		if _, err := imagePreviewer.ParseUpscale(s); err == nil {
+			t.Errorf("Expected error for upscale %q", s)
+		}
+	}
+}
+
+func TestResizeImagePad(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Красное изображение 100x50 вписывается в квадрат с полосами сверху и снизу
+	red := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+	for i := 0; i < len(red.Pix); i += 4 {
+		copy(red.Pix[i:], []byte{255, 0, 0, 255})
+	}
+
+	blue := color.NRGBA{B: 255, A: 255}
+	transparent := color.NRGBA{}
+	testCases := []struct {
+		name       string
+		background *color.NRGBA
+		format     imagePreviewer.Format
+		want       color.NRGBA
+	}{
+		{"default white", nil, imagePreviewer.FormatPNG, color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+		{"color", &blue, imagePreviewer.FormatPNG, blue},
+		{"transparent", &transparent, imagePreviewer.FormatPNG, transparent},
+		{"transparent flattened", &transparent, imagePreviewer.FormatBMP, color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resizedData, _, err := imagePreviewer.ResizeImage(
+				context.Background(),
+				encodePNG(t, red),
+				imagePreviewer.Options{
+					Mode:       imagePreviewer.ModePad,
+					Width:      40,
+					Height:     40,
+					Format:     tc.format,
+					Background: tc.background,
+				},
+				log,
+			)
+			if err != nil {
+				t.Fatalf("ResizeImage failed: %v", err)
+			}
+			img, _, err := image.Decode(bytes.NewReader(resizedData))
+			if err != nil {
+				t.Fatalf("Failed to decode resized image: %v", err)
+			}
+			if img.Bounds().Dx() != 40 || img.Bounds().Dy() != 40 {
+				t.Fatalf("Expected 40x40, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+			}
+
+			if got := color.NRGBAModel.Convert(img.At(20, 2)).(color.NRGBA); got != tc.want {
+				t.Errorf("Expected background %v, got %v", tc.want, got)
+			}
+			if got := color.NRGBAModel.Convert(img.At(20, 20)).(color.NRGBA); colorDistance(got, red.NRGBAAt(0, 0)) > 2 {
+				t.Errorf("Expected image in the center, got %v", got)
+			}
+		})
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	testCases := map[string]color.NRGBA{
+		"fff":         {R: 255, G: 255, B: 255, A: 255},
+		"FF8000":      {R: 255, G: 128, A: 255},
+		"00000080":    {A: 128},
+		"transparent": {},
+	}
+	for s, want := range testCases {
+		c, err := imagePreviewer.ParseColor(s)
+		if err != nil {
+			t.Fatalf("ParseColor(%q) failed: %v", s, err)
+		}
+		if c != want {
+			t.Errorf("ParseColor(%q): expected %v, got %v", s, want, c)
+		}
+	}
+
+	for _, s := range []string{"", "ff", "#ffffff", "red", "fffff"} {
+		if _, err := imagePreviewer.ParseColor(s); err == nil {
+			t.Errorf("Expected error for color %q", s)
+		}
+	}
+}
+
+func TestResizeImageRotateFlip(t *testing.T) {
+	log := logger.NewTestLogger()
+	data := readFile(t, filepath.Join("..", "..", "test", "data", "orientation", "orientation_1.jpg"))
+
+	red := color.NRGBA{R: 255, A: 255}
+	green := color.NRGBA{G: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+	// Исходное изображение 48x32: красная, зеленая, синяя и белая четверти по строкам
+	testCases := []struct {
+		name      string
+		rotate    int
+		flipH     bool
+		flipV     bool
+		quadrants [4]color.NRGBA
+	}{
+		{"none", 0, false, false, [4]color.NRGBA{red, green, blue, white}},
+		{"rot 90", 90, false, false, [4]color.NRGBA{blue, red, white, green}},
+		{"rot 180", 180, false, false, [4]color.NRGBA{white, blue, green, red}},
+		{"rot 270", 270, false, false, [4]color.NRGBA{green, white, red, blue}},
+		{"flip h", 0, true, false, [4]color.NRGBA{green, red, white, blue}},
+		{"flip v", 0, false, true, [4]color.NRGBA{blue, white, red, green}},
+		{"rot 90 flip h", 90, true, false, [4]color.NRGBA{red, blue, green, white}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			width, height := 24, 16
+			if tc.rotate%180 != 0 {
+				width, height = height, width
+			}
+			// Размеры результата совпадают с пропорциями повернутого изображения, поэтому обрезки нет
+			img := resizeToPNG(t, data, imagePreviewer.Options{
+				Mode:   imagePreviewer.ModeFill,
+				Width:  width,
+				Height: height,
+				Format: imagePreviewer.FormatPNG,
+				Rotate: tc.rotate,
+				FlipH:  tc.flipH,
+				FlipV:  tc.flipV,
+			}, log)
+
+			if img.Bounds().Dx() != width || img.Bounds().Dy() != height {
+				t.Fatalf("Expected %dx%d, got %dx%d", width, height, img.Bounds().Dx(), img.Bounds().Dy())
+			}
+			points := []image.Point{
+				{width / 4, height / 4}, {width * 3 / 4, height / 4},
+				{width / 4, height * 3 / 4}, {width * 3 / 4, height * 3 / 4},
+			}
+			for i, p := range points {
+				got := color.NRGBAModel.Convert(img.At(p.X, p.Y)).(color.NRGBA)
+				if colorDistance(got, tc.quadrants[i]) > 30 {
+					t.Errorf("Pixel %v: expected %v, got %v", p, tc.quadrants[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRotationAndFlip(t *testing.T) {
+	for _, s := range []string{"0", "90", "180", "270"} {
+		if _, err := imagePreviewer.ParseRotation(s); err != nil {
+			t.Errorf("Unexpected error for rotation %q: %v", s, err)
+		}
+	}
+	for _, s := range []string{"45", "-90", "360", "left"} {
+		if _, err := imagePreviewer.ParseRotation(s); err == nil {
+			t.Errorf("Expected error for rotation %q", s)
+		}
+	}
+
+	horizontal, vertical, err := imagePreviewer.ParseFlip("hv")
+	if err != nil || !horizontal || !vertical {
+		t.Errorf("Expected both flips for hv, got %t %t %v", horizontal, vertical, err)
+	}
+	if _, _, err := imagePreviewer.ParseFlip("x"); err == nil {
+		t.Errorf("Expected error for flip x")
+	}
+}
+
+func TestOptionsString(t *testing.T) {
+	opts := imagePreviewer.Options{
+		Mode:    imagePreviewer.ModeFill,
+		Width:   300,
+		Height:  200,
+		Gravity: imagePreviewer.GravitySmart,
+		Format:  imagePreviewer.FormatWebP,
+		Quality: 80,
+	}
+	want := "ar:true/rs:fill:300:200/g:sm/rf:lanczos/up:0/f:webp/q:80/pr:false/ll:false"
+	if got := opts.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// Значения по умолчанию записываются явно, чтобы не различать их в ключе кэша
+	opts.Filter = imagePreviewer.FilterLanczos
+	if got := opts.String(); got != want {
+		t.Errorf("Expected explicit default filter to give %q, got %q", want, got)
+	}
+
+	opts.Gravity = imagePreviewer.GravityFocusPoint
+	opts.FocusX, opts.FocusY = 0.25, 0.5
+	if got := opts.String(); !strings.Contains(got, "/fp:0.25,0.5/") {
+		t.Errorf("Expected focus point in %q", got)
+	}
+}
+
+func TestResizeImageWithoutResize(t *testing.T) {
+	log := logger.NewTestLogger()
+	data := readFile(t, filepath.Join("..", "..", "test", "data", "gopher_50x50.jpg"))
+
+	opts := imagePreviewer.Options{Format: imagePreviewer.FormatPNG}
+	if ops := opts.Operations(); len(ops) != 0 {
+		t.Fatalf("Expected no operations, got %v", ops)
+	}
+
+	img := resizeToPNG(t, data, opts, log)
+	if img.Bounds().Dx() != 50 || img.Bounds().Dy() != 50 {
+		t.Errorf("Expected original size 50x50, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+}
+
+func TestResizeImageAdjustments(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Левая половина оранжевая, правая темно-синяя: резкая граница проверяет размытие и резкость
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	orange, navy := color.NRGBA{R: 200, G: 120, B: 40, A: 255}, color.NRGBA{R: 20, G: 30, B: 90, A: 255}
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 20 {
+				src.SetNRGBA(x, y, orange)
+			} else {
+				src.SetNRGBA(x, y, navy)
+			}
+		}
+	}
+
+	testCases := []struct {
+		name  string
+		opts  imagePreviewer.Options
+		check func(left, edge color.NRGBA) bool
+	}{
+		{"none", imagePreviewer.Options{}, func(left, edge color.NRGBA) bool {
+			return left == orange && edge == orange
+		}},
+		{"grayscale", imagePreviewer.Options{Grayscale: true}, func(left, _ color.NRGBA) bool {
+			return left.R == left.G && left.G == left.B
+		}},
+		{"brightness", imagePreviewer.Options{Brightness: 20}, func(left, _ color.NRGBA) bool {
+			return left.R > orange.R && left.G > orange.G
+		}},
+		{"contrast", imagePreviewer.Options{Contrast: -50}, func(left, _ color.NRGBA) bool {
+			return left.R < orange.R && left.B > orange.B
+		}},
+		{"gamma", imagePreviewer.Options{Gamma: 0.5}, func(left, _ color.NRGBA) bool {
+			return left.G < orange.G
+		}},
+		{"blur", imagePreviewer.Options{Blur: 2}, func(left, edge color.NRGBA) bool {
+			return left == orange && edge.R < orange.R
+		}},
+		{"sharpen", imagePreviewer.Options{Sharpen: 2}, func(left, edge color.NRGBA) bool {
+			return left == orange && edge.R > orange.R
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.Mode, opts.Width, opts.Height = imagePreviewer.ModeFit, 40, 40
+			opts.Format = imagePreviewer.FormatPNG
+			img := resizeToPNG(t, encodePNG(t, src), opts, log)
+
+			left := color.NRGBAModel.Convert(img.At(5, 20)).(color.NRGBA)
+			edge := color.NRGBAModel.Convert(img.At(19, 20)).(color.NRGBA)
+			if !tc.check(left, edge) {
+				t.Errorf("Unexpected result: left %v, edge %v", left, edge)
+			}
+		})
+	}
+}
+
+func TestAdjustmentsString(t *testing.T) {
+	opts := imagePreviewer.Options{Blur: 2, Grayscale: true, Gamma: 1, Brightness: -10}
+	want := "ar:true/brightness:-10/grayscale:true/blur:2/f:/q:0/pr:false/ll:false"
+	if got := opts.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestParseAdjustments(t *testing.T) {
+	testCases := []struct {
+		name    string
+		parse   func(string) (float64, error)
+		valid   []string
+		invalid []string
+	}{
+		{"blur", imagePreviewer.ParseBlur, []string{"0", "2.5", "10"}, []string{"-1", "11", "NaN", "soft"}},
+		{"sharpen", imagePreviewer.ParseSharpen, []string{"0", "1", "10"}, []string{"-0.5", "10.5", "1000"}},
+		{"brightness", imagePreviewer.ParseBrightness, []string{"-100", "25"}, []string{"-101", "150"}},
+		{"contrast", imagePreviewer.ParseContrast, []string{"-50", "100"}, []string{"200"}},
+		{"gamma", imagePreviewer.ParseGamma, []string{"0.1", "1", "2.2", "10"}, []string{"0", "-1", "11"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, s := range tc.valid {
+				if _, err := tc.parse(s); err != nil {
+					t.Errorf("Unexpected error for %q: %v", s, err)
+				}
+			}
+			for _, s := range tc.invalid {
+				if _, err := tc.parse(s); err == nil {
+					t.Errorf("Expected error for %q", s)
+				}
+			}
+		})
+	}
+}
+
+func TestParseQuality(t *testing.T) {
+	quality, err := imagePreviewer.ParseQuality("80")
+	if err != nil {
+		t.Fatalf("ParseQuality failed: %v", err)
+	}
+	if quality != 80 {
+		t.Errorf("Expected quality 80, got %d", quality)
+	}
+
+	for _, s := range []string{"0", "101", "-5", "high"} {
+		if _, err := imagePreviewer.ParseQuality(s); err == nil {
+			t.Errorf("Expected error for quality %q", s)
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := imagePreviewer.ParseFormat("JPG")
+	if err != nil {
+		t.Fatalf("ParseFormat failed: %v", err)
+	}
+	if format != imagePreviewer.FormatJPEG {
+		t.Errorf("Expected format jpeg, got %s", format)
+	}
+
+	if _, err := imagePreviewer.ParseFormat("svg"); err == nil {
+		t.Errorf("Expected error for unsupported format")
+	}
+}
+
+func TestResizeImageUnknownMode(t *testing.T) {
+	log := logger.NewTestLogger()
+	data := readTestImage(t, "test_image.jpg")
+
+	_, _, err := imagePreviewer.ResizeImage(
+		context.Background(),
+		data,
+		imagePreviewer.Options{Mode: "stretch", Width: 100, Height: 100},
+		log,
+	)
+	if err == nil {
+		t.Fatalf("Expected error for unknown resize mode, but got nil")
+	}
+}
+
+func TestResizeImageGravity(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Верхняя половина изображения красная, нижняя - синяя
+	src := image.NewRGBA(image.Rect(0, 0, 100, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 100; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if y >= 100 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	data := encodePNG(t, src)
+
+	tests := []struct {
+		gravity imagePreviewer.Gravity
+		isRed   bool
+	}{
+		{imagePreviewer.GravityNorth, true},
+		{imagePreviewer.GravityNorthWest, true},
+		{imagePreviewer.GravitySouth, false},
+		{imagePreviewer.GravitySouthEast, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.gravity), func(t *testing.T) {
+			resizedData, _, err := imagePreviewer.ResizeImage(
+				context.Background(),
+				data,
+				imagePreviewer.Options{Mode: imagePreviewer.ModeFill, Width: 50, Height: 50, Gravity: tt.gravity},
+				log,
+			)
+			if err != nil {
+				t.Fatalf("ResizeImage failed: %v", err)
+			}
+
+			img, _, err := image.Decode(bytes.NewReader(resizedData))
+			if err != nil {
+				t.Fatalf("Failed to decode resized image: %v", err)
+			}
+
+			r, _, b, _ := img.At(25, 25).RGBA()
+			if (r > b) != tt.isRed {
+				t.Errorf("Unexpected color for gravity %s: r=%d b=%d", tt.gravity, r>>8, b>>8)
+			}
+		})
+	}
+}
+
+func TestResizeImageFocusPoint(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Левая четверть изображения красная, остальное - синее
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 400; x++ {
+			c := color.RGBA{B: 255, A: 255}
+			if x < 100 {
+				c = color.RGBA{R: 255, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	data := encodePNG(t, src)
+
+	tests := []struct {
+		focusX float64
+		isRed  bool
+	}{
+		{0.1, true},
+		{0, true},
+		{0.5, false},
+		{1, false},
+	}
+
+	for _, tt := range tests {
+		resizedData, _, err := imagePreviewer.ResizeImage(
+			context.Background(),
+			data,
+			imagePreviewer.Options{
+				Mode:    imagePreviewer.ModeFill,
+				Width:   50,
+				Height:  50,
+				Gravity: imagePreviewer.GravityFocusPoint,
+				FocusX:  tt.focusX,
+				FocusY:  0.5,
+			},
+			log,
+		)
+		if err != nil {
+			t.Fatalf("ResizeImage failed: %v", err)
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(resizedData))
+		if err != nil {
+			t.Fatalf("Failed to decode resized image: %v", err)
+		}
+
+		r, _, b, _ := img.At(25, 25).RGBA()
+		if (r > b) != tt.isRed {
+			t.Errorf("Unexpected color for focus point x=%v: r=%d b=%d", tt.focusX, r>>8, b>>8)
+		}
+	}
+}
+
+func TestParseFocusPoint(t *testing.T) {
+	x, y, err := imagePreviewer.ParseFocusPoint("0.3,0.7")
+	if err != nil {
+		t.Fatalf("ParseFocusPoint failed: %v", err)
+	}
+	if x != 0.3 || y != 0.7 {
+		t.Errorf("Expected focus point 0.3,0.7, got %v,%v", x, y)
+	}
+
+	for _, invalid := range []string{"0.3", "0.3,1.5", "-0.1,0.5", "a,b", "NaN,NaN", "0.5,NaN"} {
+		if _, _, err := imagePreviewer.ParseFocusPoint(invalid); err == nil {
+			t.Errorf("Expected error for focus point %q", invalid)
+		}
+	}
+}
+
+func TestParseGravity(t *testing.T) {
+	aliases := map[string]imagePreviewer.Gravity{
+		"north":     imagePreviewer.GravityNorth,
+		"top":       imagePreviewer.GravityNorth,
+		"no":        imagePreviewer.GravityNorth,
+		"SouthWest": imagePreviewer.GravitySouthWest,
+		"center":    imagePreviewer.GravityCenter,
+	}
+
+	for alias, expected := range aliases {
+		gravity, err := imagePreviewer.ParseGravity(alias)
+		if err != nil {
+			t.Fatalf("ParseGravity(%q) failed: %v", alias, err)
+		}
+		if gravity != expected {
+			t.Errorf("ParseGravity(%q) = %s, expected %s", alias, gravity, expected)
+		}
+	}
+
+	if _, err := imagePreviewer.ParseGravity("middle"); err == nil {
+		t.Errorf("Expected error for unknown gravity")
+	}
+}
+
+// readTestImage читает тестовое изображение из каталога test/data.
+func readTestImage(t *testing.T, name string) []byte {
+	t.Helper()
+
+	return readFile(t, filepath.Join("..", "..", "test", "data", name))
+}
+
+// encodeWebP кодирует изображение в WebP для передачи в ResizeImage.
+func resizeToPNG(t *testing.T, data []byte, opts imagePreviewer.Options, log logger.Logger) image.Image {
+	t.Helper()
+
+	resizedData, _, err := imagePreviewer.ResizeImage(context.Background(), data, opts, log)
+	if err != nil {
+		t.Fatalf("ResizeImage failed: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(resizedData))
+	if err != nil {
+		t.Fatalf("Failed to decode resized image: %v", err)
+	}
+	return img
+}
+
+// colorDistance возвращает наибольшую разницу каналов двух цветов.
+func colorDistance(a, b color.NRGBA) float64 {
+	return max(absDiff(a.R, b.R), absDiff(a.G, b.G), absDiff(a.B, b.B), absDiff(a.A, b.A))
+}
+
+func encodeWebP(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// encodePNG кодирует изображение в PNG для передачи в ResizeImage.
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test image: %v", err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,161 @@
+package image
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// smartCropAnalysisSize - размер большей стороны уменьшенной копии, по которой оцениваются области.
+	smartCropAnalysisSize = 256
+	// Веса составляющих оценки пикселя.
+	smartCropEdgeWeight       = 1.0
+	smartCropSaturationWeight = 0.3
+	smartCropSaliencyWeight   = 1.0
+	// smartCropEpsilon - точность сравнения оценок, при равенстве выбирается область ближе к центру.
+	smartCropEpsilon = 1e-9
+)
+
+// smartCropRect выбирает область исходного изображения с пропорциями width:height,
+// содержащую больше всего деталей: резких границ, насыщенных и выделяющихся цветов.
+// Результат детерминирован для одного и того же изображения.
+func smartCropRect(img image.Image, width, height int) image.Rectangle {
+	bounds := img.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	cropW, cropH := cropSize(srcW, srcH, width, height)
+	if cropW == srcW && cropH == srcH {
+		return bounds
+	}
+
+	// Оцениваем уменьшенную копию, чтобы не обходить все пиксели большого изображения
+	scale := math.Min(1, float64(smartCropAnalysisSize)/float64(max(srcW, srcH)))
+	analysisW := max(1, int(math.Round(float64(srcW)*scale)))
+	analysisH := max(1, int(math.Round(float64(srcH)*scale)))
+	small := imaging.Resize(img, analysisW, analysisH, imaging.Box)
+	scores := scorePixels(small)
+
+	// Область занимает изображение целиком по одной из осей,
+	// поэтому достаточно найти лучшее смещение по другой
+	if cropW < srcW {
+		profile := make([]float64, analysisW)
+		for y := 0; y < analysisH; y++ {
+			for x := 0; x < analysisW; x++ {
+				profile[x] += scores[y*analysisW+x]
+			}
+		}
+		window := clamp(int(math.Round(float64(cropW)*float64(analysisW)/float64(srcW))), 1, analysisW)
+		offset := bestWindowOffset(profile, window) * srcW / analysisW
+		offset = clamp(offset, 0, srcW-cropW)
+		return image.Rect(bounds.Min.X+offset, bounds.Min.Y, bounds.Min.X+offset+cropW, bounds.Max.Y)
+	}
+
+	profile := make([]float64, analysisH)
+	for y := 0; y < analysisH; y++ {
+		for x := 0; x < analysisW; x++ {
+			profile[y] += scores[y*analysisW+x]
+		}
+	}
+	window := clamp(int(math.Round(float64(cropH)*float64(analysisH)/float64(srcH))), 1, analysisH)
+	offset := bestWindowOffset(profile, window) * srcH / analysisH
+	offset = clamp(offset, 0, srcH-cropH)
+	return image.Rect(bounds.Min.X, bounds.Min.Y+offset, bounds.Max.X, bounds.Min.Y+offset+cropH)
+}
+
+// scorePixels вычисляет оценку "интересности" каждого пикселя: модуль лапласиана яркости
+// (плотность границ), насыщенность цвета и отличие цвета от среднего по изображению.
+func scorePixels(img *image.NRGBA) []float64 {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	n := w * h
+
+	rgb := make([][3]float64, n)
+	luma := make([]float64, n)
+	var mean [3]float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := y*img.Stride + x*4
+			c := [3]float64{
+				float64(img.Pix[p]) / 255,
+				float64(img.Pix[p+1]) / 255,
+				float64(img.Pix[p+2]) / 255,
+			}
+			rgb[y*w+x] = c
+			luma[y*w+x] = 0.299*c[0] + 0.587*c[1] + 0.114*c[2]
+			for k := range mean {
+				mean[k] += c[k] / float64(n)
+			}
+		}
+	}
+
+	scores := make([]float64, n)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*w + x
+			c := rgb[i]
+
+			edge := math.Abs(4*luma[i] -
+				luma[y*w+clamp(x-1, 0, w-1)] -
+				luma[y*w+clamp(x+1, 0, w-1)] -
+				luma[clamp(y-1, 0, h-1)*w+x] -
+				luma[clamp(y+1, 0, h-1)*w+x])
+
+			var saturation float64
+			maxC := math.Max(c[0], math.Max(c[1], c[2]))
+			minC := math.Min(c[0], math.Min(c[1], c[2]))
+			if maxC > 0 {
+				saturation = (maxC - minC) / maxC
+			}
+
+			saliency := math.Sqrt((c[0]-mean[0])*(c[0]-mean[0]) +
+				(c[1]-mean[1])*(c[1]-mean[1]) +
+				(c[2]-mean[2])*(c[2]-mean[2]))
+
+			alpha := float64(img.Pix[y*img.Stride+x*4+3]) / 255
+			scores[i] = alpha * (smartCropEdgeWeight*edge +
+				smartCropSaturationWeight*saturation +
+				smartCropSaliencyWeight*saliency)
+		}
+	}
+
+	return scores
+}
+
+// bestWindowOffset возвращает начало окна длиной window с наибольшей оценкой.
+// Вклад элементов профиля убывает от центра окна к краям, чтобы интересная часть
+// оказывалась в середине кадра, а не у его границы. При равных оценках
+// предпочтение отдается окну, расположенному ближе к центру изображения.
+func bestWindowOffset(profile []float64, window int) int {
+	// Вычитаем среднее, чтобы равномерный фон не влиял на выбор
+	var mean float64
+	for _, v := range profile {
+		mean += v
+	}
+	mean /= float64(len(profile))
+
+	weights := make([]float64, window)
+	for i := range weights {
+		d := (float64(i)+0.5)/float64(window)*2 - 1
+		weights[i] = 1 - d*d
+	}
+
+	center := float64(len(profile)-window) / 2
+	best, bestScore := 0, math.Inf(-1)
+	for offset := 0; offset+window <= len(profile); offset++ {
+		var score float64
+		for i, weight := range weights {
+			score += (profile[offset+i] - mean) * weight
+		}
+
+		switch {
+		case score > bestScore+smartCropEpsilon:
+			best, bestScore = offset, score
+		case score >= bestScore-smartCropEpsilon &&
+			math.Abs(float64(offset)-center) < math.Abs(float64(best)-center):
+			best = offset
+		}
+	}
+
+	return best
+}
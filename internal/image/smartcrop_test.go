@@ -0,0 +1,166 @@
+package image_test
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	imagePreviewer "github.com/romangricuk/image-previewer/internal/image"
+	"github.com/romangricuk/image-previewer/internal/logger"
+)
+
+var updateGolden = flag.Bool("update", false, "обновить эталонные изображения в test/data/golden")
+
+func TestSmartCropGolden(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	tests := []struct {
+		source string
+		width  int
+		height int
+		golden string
+	}{
+		{"gopher_2000x1000.jpg", 100, 300, "smart_gopher_2000x1000_100x300.png"},
+		{"gopher_1024x252.jpg", 200, 200, "smart_gopher_1024x252_200x200.png"},
+		{"gopher_200x700.jpg", 200, 100, "smart_gopher_200x700_200x100.png"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			resizedData, _, err := imagePreviewer.ResizeImage(
+				context.Background(),
+				readTestImage(t, tt.source),
+				imagePreviewer.Options{
+					Mode:    imagePreviewer.ModeFill,
+					Width:   tt.width,
+					Height:  tt.height,
+					Gravity: imagePreviewer.GravitySmart,
+				},
+				log,
+			)
+			if err != nil {
+				t.Fatalf("ResizeImage failed: %v", err)
+			}
+
+			img, _, err := image.Decode(bytes.NewReader(resizedData))
+			if err != nil {
+				t.Fatalf("Failed to decode resized image: %v", err)
+			}
+
+			goldenPath := filepath.Join("..", "..", "test", "data", "golden", tt.golden)
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, encodePNG(t, img), 0o600); err != nil {
+					t.Fatalf("Failed to update golden image: %v", err)
+				}
+			}
+
+			golden, _, err := image.Decode(bytes.NewReader(readFile(t, goldenPath)))
+			if err != nil {
+				t.Fatalf("Failed to decode golden image: %v", err)
+			}
+
+			if diff := meanDifference(img, golden); diff > 1 {
+				t.Errorf("Result differs from golden image %s: mean difference %.2f", tt.golden, diff)
+			}
+		})
+	}
+}
+
+func TestSmartCropFindsDetails(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	// Однотонный фон с детализированным фрагментом у правого края
+	src := image.NewRGBA(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 400; x++ {
+			c := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+			if x >= 320 && (x/4+y/4)%2 == 0 {
+				c = color.RGBA{R: 255, G: 40, B: 40, A: 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	data := encodePNG(t, src)
+
+	smartDetails := countDetailedPixels(t, data, imagePreviewer.GravitySmart, log)
+	centerDetails := countDetailedPixels(t, data, imagePreviewer.GravityCenter, log)
+
+	if centerDetails != 0 {
+		t.Fatalf("Expected center crop to miss the detailed area, got %d detailed pixels", centerDetails)
+	}
+	if smartDetails == 0 {
+		t.Errorf("Expected smart crop to contain the detailed area")
+	}
+}
+
+// countDetailedPixels возвращает количество красных пикселей в результате обрезки до 100x100.
+func countDetailedPixels(t *testing.T, data []byte, gravity imagePreviewer.Gravity, log logger.Logger) int {
+	t.Helper()
+
+	resizedData, _, err := imagePreviewer.ResizeImage(
+		context.Background(),
+		data,
+		imagePreviewer.Options{Mode: imagePreviewer.ModeFill, Width: 100, Height: 100, Gravity: gravity},
+		log,
+	)
+	if err != nil {
+		t.Fatalf("ResizeImage failed: %v", err)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(resizedData))
+	if err != nil {
+		t.Fatalf("Failed to decode resized image: %v", err)
+	}
+
+	count := 0
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, _, _ := img.At(x, y).RGBA()
+			if r>>8 > 200 && g>>8 < 100 {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// meanDifference возвращает среднее абсолютное отличие каналов двух изображений одного размера.
+func meanDifference(a, b image.Image) float64 {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 255
+	}
+
+	var sum float64
+	bounds := a.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			ca := color.NRGBAModel.Convert(a.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			cb := color.NRGBAModel.Convert(b.At(b.Bounds().Min.X+x, b.Bounds().Min.Y+y)).(color.NRGBA)
+			sum += absDiff(ca.R, cb.R) + absDiff(ca.G, cb.G) + absDiff(ca.B, cb.B)
+		}
+	}
+	return sum / float64(3*bounds.Dx()*bounds.Dy())
+}
+
+func absDiff(a, b uint8) float64 {
+	if a > b {
+		return float64(a - b)
+	}
+	return float64(b - a)
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %v", path, err)
+	}
+	return data
+}
@@ -0,0 +1,292 @@
+package image
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+const (
+	// DefaultTextSize - размер шрифта надписи по умолчанию в пикселях.
+	DefaultTextSize = 24
+	// DefaultTextPosition - положение надписи по умолчанию.
+	DefaultTextPosition = GravityCenter
+
+	minTextSize   = 4
+	maxTextSize   = 512
+	maxTextLength = 256
+	// maxTextExtent ограничивает произведение размера шрифта на число символов, а вместе с ним и размер
+	// маски надписи, которая растеризуется при каждом промахе кэша.
+	maxTextExtent = 8192
+)
+
+// DefaultTextColor - цвет надписи по умолчанию.
+var DefaultTextColor = color.NRGBA{A: 0xff}
+
+// textFont - встроенный шрифт Go Regular. Шрифт не читается с диска, поэтому надписи
+// работают и в образе без файловой системы.
+var textFont = sync.OnceValues(func() (*sfnt.Font, error) {
+	return sfnt.Parse(goregular.TTF)
+})
+
+// Text описывает однострочную надпись, рисуемую на изображении после водяного знака.
+type Text struct {
+	Text string
+	// Size - размер шрифта в пикселях.
+	Size  int
+	Color color.NRGBA
+	// Position - угол или сторона изображения, к которой привязана надпись.
+	Position Gravity
+	// OffsetX и OffsetY - отступ в пикселях от края, к которому привязана надпись.
+	OffsetX, OffsetY int
+	// Shadow - цвет тени, смещенной вправо и вниз. Nil означает надпись без тени.
+	Shadow *color.NRGBA
+}
+
+// DecodeText декодирует текст надписи, закодированный в base64 для URL (RFC 4648, с дополнением или без).
+// Текст не может быть пустым, содержать управляющие символы и быть длиннее maxTextLength символов.
+func DecodeText(s string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return "", fmt.Errorf("text must be URL-safe base64: %w", err)
+	}
+	text := string(data)
+	switch {
+	case text == "":
+		return "", fmt.Errorf("text is empty")
+	case !utf8.ValidString(text):
+		return "", fmt.Errorf("text is not valid UTF-8")
+	case utf8.RuneCountInString(text) > maxTextLength:
+		return "", fmt.Errorf("text is longer than %d characters", maxTextLength)
+	case strings.IndexFunc(text, unicode.IsControl) >= 0:
+		return "", fmt.Errorf("text contains control characters")
+	}
+	return text, nil
+}
+
+// EncodeText кодирует текст надписи для опции запроса.
+func EncodeText(text string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(text))
+}
+
+// ParseTextSize разбирает размер шрифта надписи в пикселях.
+func ParseTextSize(s string) (int, error) {
+	size, err := strconv.Atoi(s)
+	if err != nil || size < minTextSize || size > maxTextSize {
+		return 0, fmt.Errorf("text size must be an integer from %d to %d: %s", minTextSize, maxTextSize, s)
+	}
+	return size, nil
+}
+
+// ParseTextPosition разбирает положение надписи. Допустимы те же значения, что и для водяного знака.
+func ParseTextPosition(s string) (Gravity, error) {
+	return parseAnchorGravity("text", s)
+}
+
+// size возвращает размер шрифта с учетом значения по умолчанию.
+func (t *Text) size() int {
+	if t.Size == 0 {
+		return DefaultTextSize
+	}
+	return t.Size
+}
+
+// Validate проверяет, что надпись не слишком велика для отрисовки: произведение размера шрифта
+// на число символов не должно превышать maxTextExtent.
+func (t *Text) Validate() error {
+	if extent := t.size() * utf8.RuneCountInString(t.Text); extent > maxTextExtent {
+		return fmt.Errorf("text is too large: size %d times %d characters exceeds %d",
+			t.size(), utf8.RuneCountInString(t.Text), maxTextExtent)
+	}
+	return nil
+}
+
+// position возвращает положение надписи с учетом значения по умолчанию.
+func (t *Text) position() Gravity {
+	if t.Position == "" {
+		return DefaultTextPosition
+	}
+	return t.Position
+}
+
+// textOperation рисует надпись на изображении.
+type textOperation struct {
+	text *Text
+}
+
+func (op textOperation) String() string {
+	t := op.text
+	shadow := "-"
+	if t.Shadow != nil {
+		shadow = formatColor(*t.Shadow)
+	}
+	return fmt.Sprintf("text:%s:%d:%s:%s:%d:%d:%s",
+		EncodeText(t.Text), t.size(), formatColor(t.Color), t.position(), t.OffsetX, t.OffsetY, shadow)
+}
+
+func (op textOperation) apply(img image.Image) (image.Image, error) {
+	t := op.text
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	mask, err := renderText(t.Text, t.size())
+	if err != nil {
+		return nil, err
+	}
+	if mask == nil {
+		return img, nil
+	}
+
+	// Тень смещается пропорционально размеру шрифта и входит в размер надписи при выравнивании
+	shadowOffset := 0
+	if t.Shadow != nil {
+		shadowOffset = max(1, t.size()/16)
+	}
+	size := mask.Bounds().Size().Add(image.Pt(shadowOffset, shadowOffset))
+	pos, err := anchoredPosition(img.Bounds(), size, t.position(), t.OffsetX, t.OffsetY)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := imaging.Clone(img)
+	// imaging.Clone возвращает изображение с началом координат в (0, 0)
+	pos = pos.Sub(img.Bounds().Min)
+	if t.Shadow != nil {
+		shadowPos := pos.Add(image.Pt(shadowOffset, shadowOffset))
+		drawTextMask(dst, mask, shadowPos, *t.Shadow)
+	}
+	drawTextMask(dst, mask, pos, t.Color)
+	return dst, nil
+}
+
+// drawTextMask закрашивает цветом c пиксели dst, покрытые маской надписи, расположенной в точке pos.
+func drawTextMask(dst draw.Image, mask *image.Alpha, pos image.Point, c color.NRGBA) {
+	r := image.Rectangle{Min: pos, Max: pos.Add(mask.Bounds().Size())}
+	draw.DrawMask(dst, r, image.NewUniform(c), image.Point{}, mask, image.Point{}, draw.Over)
+}
+
+// renderText растеризует строку встроенным шрифтом размера size в маску, обрезанную по контурам глифов.
+// Если в строке нет видимых глифов, возвращается nil.
+func renderText(text string, size int) (*image.Alpha, error) {
+	f, err := textFont()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load font: %w", err)
+	}
+
+	// Буфер не разделяется между вызовами, поэтому шрифт можно использовать параллельно
+	var buf sfnt.Buffer
+	ppem := fixed.I(size)
+	var segments []sfnt.Segment
+	var dot fixed.Int26_6
+	prev := sfnt.GlyphIndex(0)
+	for i, r := range text {
+		glyph, err := f.GlyphIndex(&buf, r)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			// Таблица кернинга необязательна, ее отсутствие не ошибка
+			if kern, err := f.Kern(&buf, prev, glyph, ppem, font.HintingNone); err == nil {
+				dot += kern
+			}
+		}
+		glyphSegments, err := f.LoadGlyph(&buf, glyph, ppem, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range glyphSegments {
+			for j := range s.Args {
+				s.Args[j].X += dot
+			}
+			segments = append(segments, s)
+		}
+		advance, err := f.GlyphAdvance(&buf, glyph, ppem, font.HintingNone)
+		if err != nil {
+			return nil, err
+		}
+		dot += advance
+		prev = glyph
+	}
+	return rasterize(segments), nil
+}
+
+// rasterize заполняет контуры segments в маске размером с их ограничивающий прямоугольник.
+func rasterize(segments []sfnt.Segment) *image.Alpha {
+	if len(segments) == 0 {
+		return nil
+	}
+
+	// Контрольные точки кривых Безье ограничивают сами кривые, поэтому границы считаются по всем точкам
+	minX, minY := float32(math.Inf(1)), float32(math.Inf(1))
+	maxX, maxY := float32(math.Inf(-1)), float32(math.Inf(-1))
+	for _, s := range segments {
+		for _, p := range s.Args[:segmentPoints(s.Op)] {
+			x, y := fixedToFloat(p.X), fixedToFloat(p.Y)
+			minX, minY = min(minX, x), min(minY, y)
+			maxX, maxY = max(maxX, x), max(maxY, y)
+		}
+	}
+	originX, originY := float32(math.Floor(float64(minX))), float32(math.Floor(float64(minY)))
+	width := int(math.Ceil(float64(maxX - originX)))
+	height := int(math.Ceil(float64(maxY - originY)))
+	if width <= 0 || height <= 0 {
+		return nil
+	}
+
+	point := func(p fixed.Point26_6) (float32, float32) {
+		return fixedToFloat(p.X) - originX, fixedToFloat(p.Y) - originY
+	}
+	z := vector.NewRasterizer(width, height)
+	for _, s := range segments {
+		switch s.Op {
+		case sfnt.SegmentOpMoveTo:
+			z.MoveTo(point(s.Args[0]))
+		case sfnt.SegmentOpLineTo:
+			z.LineTo(point(s.Args[0]))
+		case sfnt.SegmentOpQuadTo:
+			bx, by := point(s.Args[0])
+			cx, cy := point(s.Args[1])
+			z.QuadTo(bx, by, cx, cy)
+		case sfnt.SegmentOpCubeTo:
+			bx, by := point(s.Args[0])
+			cx, cy := point(s.Args[1])
+			dx, dy := point(s.Args[2])
+			z.CubeTo(bx, by, cx, cy, dx, dy)
+		}
+	}
+
+	mask := image.NewAlpha(z.Bounds())
+	z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+	return mask
+}
+
+// segmentPoints возвращает число используемых точек сегмента контура.
+func segmentPoints(op sfnt.SegmentOp) int {
+	switch op {
+	case sfnt.SegmentOpQuadTo:
+		return 2
+	case sfnt.SegmentOpCubeTo:
+		return 3
+	default:
+		return 1
+	}
+}
+
+func fixedToFloat(v fixed.Int26_6) float32 {
+	return float32(v) / 64
+}
@@ -0,0 +1,117 @@
+package image_test
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	imagePreviewer "github.com/romangricuk/image-previewer/internal/image"
+	"github.com/romangricuk/image-previewer/internal/logger"
+)
+
+func TestResizeImageText(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for i := range src.Pix {
+		src.Pix[i] = 255
+	}
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	red := color.NRGBA{R: 255, A: 255}
+
+	testCases := []struct {
+		name string
+		text imagePreviewer.Text
+		// area - область, в которую должна попасть вся надпись
+		area image.Rectangle
+	}{
+		{
+			"center",
+			imagePreviewer.Text{Text: "SAMPLE", Size: 32},
+			image.Rect(30, 25, 170, 75),
+		},
+		{
+			"top left with offset",
+			imagePreviewer.Text{Text: "$10", Size: 16, Position: imagePreviewer.GravityNorthWest, OffsetX: 10, OffsetY: 10},
+			image.Rect(10, 10, 50, 40),
+		},
+		{
+			"bottom right with shadow",
+			imagePreviewer.Text{Text: "SALE", Size: 32, Position: imagePreviewer.GravitySouthEast, Shadow: &red},
+			image.Rect(100, 60, 200, 100),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			text := tc.text
+			text.Color = color.NRGBA{A: 255}
+			img := resizeToPNG(t, encodePNG(t, src), imagePreviewer.Options{
+				Format: imagePreviewer.FormatPNG,
+				Text:   &text,
+			}, log)
+
+			var drawn, shadow int
+			bounds := img.Bounds()
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+					if c == white {
+						continue
+					}
+					if !image.Pt(x, y).In(tc.area) {
+						t.Fatalf("Pixel %v outside of %v is changed: %v", image.Pt(x, y), tc.area, c)
+					}
+					drawn++
+					if c == red {
+						shadow++
+					}
+				}
+			}
+			if drawn == 0 {
+				t.Fatalf("Expected text to be drawn")
+			}
+			if (tc.text.Shadow != nil) != (shadow > 0) {
+				t.Errorf("Expected shadow %t, got %d shadow pixels", tc.text.Shadow != nil, shadow)
+			}
+		})
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	for _, s := range []string{"U0FNUExF", "U0FNUExF=="} {
+		text, err := imagePreviewer.DecodeText(s)
+		if err != nil || text != "SAMPLE" {
+			t.Errorf("Expected SAMPLE for %q, got %q (%v)", s, text, err)
+		}
+	}
+
+	// Кириллица и символ валюты кодируются в base64 с символами - и _
+	encoded := imagePreviewer.EncodeText("Цена: 100 ₽?")
+	if text, err := imagePreviewer.DecodeText(encoded); err != nil || text != "Цена: 100 ₽?" {
+		t.Errorf("Expected round trip for %q, got %q (%v)", encoded, text, err)
+	}
+
+	invalid := []string{
+		"",
+		"U0FN+UxF",
+		imagePreviewer.EncodeText("line\nbreak"),
+		imagePreviewer.EncodeText("\xff"),
+		imagePreviewer.EncodeText(strings.Repeat("a", 257)),
+	}
+	for _, s := range invalid {
+		if _, err := imagePreviewer.DecodeText(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+
+	// Длинный текст допустим только мелким шрифтом
+	long := strings.Repeat("a", 256)
+	if err := (&imagePreviewer.Text{Text: long, Size: 32}).Validate(); err != nil {
+		t.Errorf("Expected 256 characters at size 32 to be valid, got %v", err)
+	}
+	if err := (&imagePreviewer.Text{Text: long, Size: 512}).Validate(); err == nil {
+		t.Error("Expected error for 256 characters at size 512")
+	}
+}
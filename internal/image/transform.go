@@ -0,0 +1,95 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ParseRotation разбирает угол поворота по часовой стрелке: 0, 90, 180 или 270 градусов.
+func ParseRotation(s string) (int, error) {
+	angle, err := strconv.Atoi(s)
+	if err != nil || angle%90 != 0 || angle < 0 || angle >= 360 {
+		return 0, fmt.Errorf("rotation must be 0, 90, 180 or 270: %s", s)
+	}
+	return angle, nil
+}
+
+// ParseFlip разбирает направление отражения: h - по горизонтали, v - по вертикали, hv - в обоих направлениях.
+func ParseFlip(s string) (horizontal, vertical bool, err error) {
+	switch strings.ToLower(s) {
+	case "h":
+		return true, false, nil
+	case "v":
+		return false, true, nil
+	case "hv", "vh":
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("flip must be h, v or hv: %s", s)
+	}
+}
+
+// rotateOperation поворачивает изображение по часовой стрелке на угол, кратный 90 градусам.
+type rotateOperation struct {
+	angle int
+}
+
+func (op rotateOperation) String() string {
+	return "rot:" + strconv.Itoa(op.angle)
+}
+
+func (op rotateOperation) apply(img image.Image) (image.Image, error) {
+	// Функции imaging поворачивают против часовой стрелки
+	switch op.angle {
+	case 90:
+		return imaging.Rotate270(img), nil
+	case 180:
+		return imaging.Rotate180(img), nil
+	case 270:
+		return imaging.Rotate90(img), nil
+	default:
+		return nil, fmt.Errorf("unsupported rotation: %d", op.angle)
+	}
+}
+
+// flipOperation отражает изображение по горизонтали и (или) вертикали.
+type flipOperation struct {
+	horizontal, vertical bool
+}
+
+func (op flipOperation) String() string {
+	s := "flip:"
+	if op.horizontal {
+		s += "h"
+	}
+	if op.vertical {
+		s += "v"
+	}
+	return s
+}
+
+func (op flipOperation) apply(img image.Image) (image.Image, error) {
+	if op.horizontal {
+		img = imaging.FlipH(img)
+	}
+	if op.vertical {
+		img = imaging.FlipV(img)
+	}
+	return img, nil
+}
+
+// transformOperations возвращает повороты и отражения, заданные в opts, в порядке выполнения:
+// сначала поворот, затем отражение.
+func transformOperations(opts Options) []Operation {
+	var ops []Operation
+	if opts.Rotate != 0 {
+		ops = append(ops, rotateOperation{opts.Rotate})
+	}
+	if opts.FlipH || opts.FlipV {
+		ops = append(ops, flipOperation{opts.FlipH, opts.FlipV})
+	}
+	return ops
+}
@@ -0,0 +1,48 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Значения политики увеличения, допустимые в запросе и конфигурации, кроме коэффициента вида "2x".
+const (
+	UpscaleAllow = "allow"
+	UpscaleDeny  = "deny"
+)
+
+// ParseUpscale преобразует политику увеличения изображений в наибольший коэффициент увеличения:
+// "allow" - без ограничений (0), "deny" - увеличение запрещено (1), "<N>" или "<N>x" - не больше чем в N раз.
+func ParseUpscale(s string) (float64, error) {
+	switch strings.ToLower(s) {
+	case UpscaleAllow:
+		return 0, nil
+	case UpscaleDeny:
+		return 1, nil
+	}
+
+	factor, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(s), "x"), 64)
+	if err != nil || !(factor >= 1) || math.IsInf(factor, 0) {
+		return 0, fmt.Errorf("upscale must be allow, deny or a factor not less than 1: %s", s)
+	}
+	return factor, nil
+}
+
+// limitUpscale уменьшает размеры результата режима fill так, чтобы исходное изображение
+// увеличивалось не больше чем в maxUpscale раз. Пропорции результата сохраняются.
+func limitUpscale(src image.Point, width, height int, maxUpscale float64) (int, int) {
+	if maxUpscale <= 0 || src.X <= 0 || src.Y <= 0 {
+		return width, height
+	}
+
+	scale := math.Max(float64(width)/float64(src.X), float64(height)/float64(src.Y))
+	if scale <= maxUpscale {
+		return width, height
+	}
+
+	ratio := maxUpscale / scale
+	return max(1, int(math.Round(float64(width)*ratio))), max(1, int(math.Round(float64(height)*ratio)))
+}
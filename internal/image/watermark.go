@@ -0,0 +1,128 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+// ErrWatermarkNotFound возвращается, если водяной знак с запрошенным именем отсутствует в каталоге.
+var ErrWatermarkNotFound = errors.New("watermark not found")
+
+// DefaultWatermarkPosition - положение водяного знака по умолчанию.
+const DefaultWatermarkPosition = GravitySouthEast
+
+// Watermark описывает водяной знак, накладываемый на изображение после изменения размера.
+type Watermark struct {
+	// Name - имя файла водяного знака, используется в ключе кэша.
+	Name  string
+	Image image.Image
+	// Position - угол или сторона изображения, к которой привязан водяной знак.
+	Position Gravity
+	// OffsetX и OffsetY - отступ в пикселях от края, к которому привязан водяной знак.
+	OffsetX, OffsetY int
+	// Scale - ширина водяного знака относительно ширины изображения от 0 до 1.
+	// Нулевое значение означает исходный размер водяного знака.
+	Scale float64
+	// Opacity - непрозрачность от 0 до 1.
+	Opacity float64
+}
+
+// ParseWatermarkPosition разбирает положение водяного знака. Допустимы значения точки привязки,
+// кроме умной обрезки и фокусной точки.
+func ParseWatermarkPosition(s string) (Gravity, error) {
+	return parseAnchorGravity("watermark", s)
+}
+
+// ParseWatermarkScale разбирает ширину водяного знака относительно изображения от 0 до 1.
+func ParseWatermarkScale(s string) (float64, error) {
+	return parseRange("watermark scale", s, 0, 1)
+}
+
+// ParseOpacity разбирает непрозрачность от 0 до 1.
+func ParseOpacity(s string) (float64, error) {
+	return parseRange("opacity", s, 0, 1)
+}
+
+// WatermarkStore загружает водяные знаки из каталога и хранит декодированные изображения.
+type WatermarkStore struct {
+	dir    string
+	mu     sync.Mutex
+	images map[string]image.Image
+}
+
+// NewWatermarkStore создает хранилище водяных знаков из каталога dir.
+func NewWatermarkStore(dir string) *WatermarkStore {
+	return &WatermarkStore{
+		dir:    dir,
+		images: make(map[string]image.Image),
+	}
+}
+
+// Get возвращает водяной знак по имени файла в каталоге. Имена с путями не допускаются,
+// чтобы запрос не мог прочитать файлы вне каталога.
+func (s *WatermarkStore) Get(name string) (image.Image, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("%w: %s", ErrWatermarkNotFound, name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if img, ok := s.images[name]; ok {
+		return img, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s", ErrWatermarkNotFound, name)
+		}
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode watermark %s: %w", name, err)
+	}
+
+	s.images[name] = img
+	return img, nil
+}
+
+// watermarkOperation накладывает водяной знак на изображение.
+type watermarkOperation struct {
+	wm *Watermark
+}
+
+func (op watermarkOperation) String() string {
+	wm := op.wm
+	return fmt.Sprintf("wm:%s:%s:%d:%d:%s:%s",
+		wm.Name, wm.Position, wm.OffsetX, wm.OffsetY, formatFloat(wm.Scale), formatFloat(wm.Opacity))
+}
+
+func (op watermarkOperation) apply(img image.Image) (image.Image, error) {
+	wm := op.wm
+	if wm.Image == nil {
+		return nil, fmt.Errorf("watermark %s is not loaded", wm.Name)
+	}
+
+	bounds := img.Bounds()
+	mark := wm.Image
+	if wm.Scale > 0 {
+		width := max(1, int(float64(bounds.Dx())*wm.Scale+0.5))
+		mark = imaging.Resize(mark, width, 0, imaging.Lanczos)
+	}
+
+	pos, err := anchoredPosition(bounds, mark.Bounds().Size(), wm.Position, wm.OffsetX, wm.OffsetY)
+	if err != nil {
+		return nil, err
+	}
+	return imaging.Overlay(img, mark, pos, wm.Opacity), nil
+}
@@ -0,0 +1,117 @@
+package image_test
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"path/filepath"
+	"testing"
+
+	imagePreviewer "github.com/romangricuk/image-previewer/internal/image"
+	"github.com/romangricuk/image-previewer/internal/logger"
+)
+
+func TestResizeImageWatermark(t *testing.T) {
+	log := logger.NewTestLogger()
+
+	store := imagePreviewer.NewWatermarkStore(filepath.Join("..", "..", "test", "data", "watermarks"))
+	// Логотип 40x20: красная рамка шириной 4 пикселя вокруг белого прямоугольника
+	logo, err := store.Get("logo.png")
+	if err != nil {
+		t.Fatalf("Failed to load watermark: %v", err)
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, 100, 60))
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = 255
+	}
+
+	red := color.NRGBA{R: 255, A: 255}
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	corner := imagePreviewer.Watermark{OffsetX: 5, OffsetY: 5, Opacity: 1}
+	topLeft := imagePreviewer.Watermark{Position: imagePreviewer.GravityNorthWest, Opacity: 1}
+	center := imagePreviewer.Watermark{Position: imagePreviewer.GravityCenter, Opacity: 1}
+	translucent := imagePreviewer.Watermark{Position: imagePreviewer.GravityNorthWest, Opacity: 0.5}
+	scaled := imagePreviewer.Watermark{Position: imagePreviewer.GravityCenter, Scale: 0.8, Opacity: 1}
+
+	testCases := []struct {
+		name  string
+		wm    imagePreviewer.Watermark
+		point image.Point
+		want  color.NRGBA
+	}{
+		{"bottom right with offset", corner, image.Pt(94, 54), red},
+		{"offset leaves margin", corner, image.Pt(97, 57), color.NRGBA{A: 255}},
+		{"top left", topLeft, image.Pt(0, 0), red},
+		{"center", center, image.Pt(50, 30), white},
+		{"half opacity", translucent, image.Pt(1, 1), color.NRGBA{R: 128, A: 255}},
+		// При ширине 80% логотип увеличивается до 80x40, и его белая середина занимает 64x24
+		{"scaled", scaled, image.Pt(20, 30), white},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			wm := tc.wm
+			wm.Name, wm.Image = "logo.png", logo
+			img := resizeToPNG(t, encodePNG(t, src), imagePreviewer.Options{
+				Format:    imagePreviewer.FormatPNG,
+				Watermark: &wm,
+			}, log)
+
+			got := color.NRGBAModel.Convert(img.At(tc.point.X, tc.point.Y)).(color.NRGBA)
+			if colorDistance(got, tc.want) > 2 {
+				t.Errorf("Pixel %v: expected %v, got %v", tc.point, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestWatermarkStore(t *testing.T) {
+	store := imagePreviewer.NewWatermarkStore(filepath.Join("..", "..", "test", "data", "watermarks"))
+
+	img, err := store.Get("logo.png")
+	if err != nil {
+		t.Fatalf("Failed to load watermark: %v", err)
+	}
+	if img.Bounds().Dx() != 40 || img.Bounds().Dy() != 20 {
+		t.Errorf("Expected 40x20 watermark, got %v", img.Bounds().Size())
+	}
+
+	// Файлы вне каталога водяных знаков недоступны
+	for _, name := range []string{"missing.png", "../gopher_50x50.jpg", "", ".hidden"} {
+		if _, err := store.Get(name); !errors.Is(err, imagePreviewer.ErrWatermarkNotFound) {
+			t.Errorf("Expected ErrWatermarkNotFound for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestParseWatermarkOptions(t *testing.T) {
+	if _, err := imagePreviewer.ParseWatermarkPosition("smart"); err == nil {
+		t.Errorf("Expected error for smart watermark position")
+	}
+	position, err := imagePreviewer.ParseWatermarkPosition("top-left")
+	if err != nil || position != imagePreviewer.GravityNorthWest {
+		t.Errorf("Expected nowe, got %s (%v)", position, err)
+	}
+
+	x, y, err := imagePreviewer.ParseOffset("10:4")
+	if err != nil || x != 10 || y != 4 {
+		t.Errorf("Expected offset 10:4, got %d:%d (%v)", x, y, err)
+	}
+	x, y, err = imagePreviewer.ParseOffset("7")
+	if err != nil || x != 7 || y != 7 {
+		t.Errorf("Expected offset 7:7, got %d:%d (%v)", x, y, err)
+	}
+	if _, _, err := imagePreviewer.ParseOffset("-1:2"); err == nil {
+		t.Errorf("Expected error for negative offset")
+	}
+
+	for _, s := range []string{"-0.1", "1.5"} {
+		if _, err := imagePreviewer.ParseOpacity(s); err == nil {
+			t.Errorf("Expected error for opacity %q", s)
+		}
+		if _, err := imagePreviewer.ParseWatermarkScale(s); err == nil {
+			t.Errorf("Expected error for scale %q", s)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// ErrFrameNotFound возвращается, если в анимации нет кадра с запрошенным номером.
+var ErrFrameNotFound = errors.New("webp: frame not found")
+
+const (
+	vp8xAnimationFlag = 0x02
+	vp8xAlphaFlag     = 0x10
+	anmfHeaderSize    = 16
+	anmfDisposeFlag   = 0x01
+	anmfNoBlendFlag   = 0x02
+)
+
+// chunk - чанк RIFF.
+type chunk struct {
+	fourCC string
+	data   []byte
+}
+
+// animation - разобранный анимированный WebP: размер холста и данные кадров (чанки ANMF).
+type animation struct {
+	width, height int
+	frames        [][]byte
+}
+
+// parseChunks разбирает последовательность чанков RIFF.
+func parseChunks(data []byte) ([]chunk, error) {
+	var chunks []chunk
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("webp: truncated chunk header")
+		}
+		size := int(binary.LittleEndian.Uint32(data[4:]))
+		if size > len(data)-8 {
+			return nil, errors.New("webp: truncated chunk")
+		}
+		chunks = append(chunks, chunk{fourCC: string(data[:4]), data: data[8 : 8+size]})
+		// Данные чанка дополняются до четной длины
+		data = data[min(len(data), 8+size+size%2):]
+	}
+	return chunks, nil
+}
+
+// parseAnimation разбирает анимированный WebP. Для неанимированных изображений возвращается nil без ошибки.
+func parseAnimation(data []byte) (*animation, error) {
+	if len(data) < 12 || string(data[:4]) != fourCCRIFF || string(data[8:12]) != fourCCWEBP {
+		return nil, nil
+	}
+	chunks, err := parseChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 0 || chunks[0].fourCC != fourCCVP8X || len(chunks[0].data) < 10 ||
+		chunks[0].data[0]&vp8xAnimationFlag == 0 {
+		return nil, nil
+	}
+
+	header := chunks[0].data
+	anim := &animation{
+		width:  int(uint24(header[4:])) + 1,
+		height: int(uint24(header[7:])) + 1,
+	}
+	for _, c := range chunks[1:] {
+		if c.fourCC == fourCCANMF {
+			anim.frames = append(anim.frames, c.data)
+		}
+	}
+	return anim, nil
+}
+
+// FrameCount возвращает число кадров анимированного WebP. Для неанимированных и поврежденных изображений
+// возвращается 0.
+func FrameCount(data []byte) int {
+	anim, err := parseAnimation(data)
+	if err != nil || anim == nil {
+		return 0
+	}
+	return len(anim.frames)
+}
+
+// Size возвращает наибольший размер изображения, под который декодер может выделить память, не декодируя его:
+// наибольшую ширину и высоту из заголовка VP8X и потоков VP8 и VP8L, в том числе потоков всех кадров анимации.
+// Размер в потоке не обязан совпадать с заголовком VP8X, а декодер выделяет память по размеру из потока.
+// Если данные не являются WebP, возвращается false.
+func Size(data []byte) (image.Point, bool) {
+	if len(data) < 12 || string(data[:4]) != fourCCRIFF || string(data[8:12]) != fourCCWEBP {
+		return image.Point{}, false
+	}
+	chunks, err := parseChunks(data[12:])
+	if err != nil {
+		return image.Point{}, false
+	}
+
+	var size image.Point
+	found := false
+	grow := func(p image.Point) {
+		size, found = image.Pt(max(size.X, p.X), max(size.Y, p.Y)), true
+	}
+	for _, c := range chunks {
+		switch c.fourCC {
+		case fourCCVP8X:
+			if len(c.data) >= 10 {
+				grow(image.Pt(int(uint24(c.data[4:]))+1, int(uint24(c.data[7:]))+1))
+			}
+		case fourCCVP8, fourCCVP8L:
+			if p, err := bitstreamSize(c); err == nil {
+				grow(p)
+			}
+		case fourCCANMF:
+			if len(c.data) < anmfHeaderSize {
+				continue
+			}
+			frameChunks, err := parseChunks(c.data[anmfHeaderSize:])
+			if err != nil {
+				continue
+			}
+			for _, fc := range frameChunks {
+				if fc.fourCC != fourCCVP8 && fc.fourCC != fourCCVP8L {
+					continue
+				}
+				if p, err := bitstreamSize(fc); err == nil {
+					grow(p)
+				}
+			}
+		}
+	}
+	return size, found
+}
+
+// DecodeFrame декодирует кадр index анимированного WebP в том виде, в котором он отображается:
+// кадры с начала анимации накладываются на прозрачный холст с учетом способа смешивания и удаления.
+func DecodeFrame(data []byte, index int) (image.Image, error) {
+	anim, err := parseAnimation(data)
+	if err != nil {
+		return nil, err
+	}
+	if anim == nil {
+		return nil, errors.New("webp: image is not animated")
+	}
+	if index < 0 || index >= len(anim.frames) {
+		return nil, fmt.Errorf("%w: %d of %d", ErrFrameNotFound, index, len(anim.frames))
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, anim.width, anim.height))
+	for i := 0; i <= index; i++ {
+		frame := anim.frames[i]
+		if len(frame) < anmfHeaderSize {
+			return nil, errors.New("webp: truncated frame header")
+		}
+		x, y := 2*int(uint24(frame)), 2*int(uint24(frame[3:]))
+		width, height := int(uint24(frame[6:]))+1, int(uint24(frame[9:]))+1
+		flags := frame[15]
+		rect := image.Rect(x, y, x+width, y+height)
+		// Кадр за пределами холста недопустим, а его декодирование могло бы занять много памяти
+		if !rect.In(canvas.Rect) {
+			return nil, fmt.Errorf("webp: frame %d is outside of the canvas", i)
+		}
+
+		img, err := decodeFrameData(frame[anmfHeaderSize:], width, height)
+		if err != nil {
+			return nil, fmt.Errorf("webp: frame %d: %w", i, err)
+		}
+		op := draw.Over
+		if flags&anmfNoBlendFlag != 0 {
+			op = draw.Src
+		}
+		draw.Draw(canvas, rect, img, img.Bounds().Min, op)
+
+		if i < index && flags&anmfDisposeFlag != 0 {
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+	return canvas, nil
+}
+
+// decodeFrameData декодирует данные кадра ANMF (чанки ALPH и VP8 либо VP8L), собирая из них
+// отдельный файл WebP.
+func decodeFrameData(data []byte, width, height int) (image.Image, error) {
+	chunks, err := parseChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var alpha, bitstream *chunk
+	for i := range chunks {
+		switch chunks[i].fourCC {
+		case fourCCALPH:
+			alpha = &chunks[i]
+		case fourCCVP8, fourCCVP8L:
+			bitstream = &chunks[i]
+		}
+	}
+	if bitstream == nil {
+		return nil, errors.New("missing image data")
+	}
+
+	// Размер в потоке должен совпадать с заголовком ANMF, проверенным по холсту: декодер выделяет память
+	// по размеру из потока
+	size, err := bitstreamSize(*bitstream)
+	if err != nil {
+		return nil, err
+	}
+	if size != image.Pt(width, height) {
+		return nil, fmt.Errorf("image data size %dx%d does not match frame size %dx%d", size.X, size.Y, width, height)
+	}
+
+	var body []byte
+	if alpha != nil && bitstream.fourCC == fourCCVP8 {
+		vp8x := make([]byte, 10)
+		vp8x[0] = vp8xAlphaFlag
+		putUint24(vp8x[4:], uint32(width-1))
+		putUint24(vp8x[7:], uint32(height-1))
+		body = appendChunk(body, fourCCVP8X, vp8x)
+		body = appendChunk(body, fourCCALPH, alpha.data)
+	}
+	body = appendChunk(body, bitstream.fourCC, bitstream.data)
+	return xwebp.Decode(bytes.NewReader(riffFile(body)))
+}
+
+// bitstreamSize возвращает размер изображения из заголовка потока VP8 или VP8L, не декодируя его.
+func bitstreamSize(bitstream chunk) (image.Point, error) {
+	file := riffFile(appendChunk(nil, bitstream.fourCC, bitstream.data))
+	config, err := xwebp.DecodeConfig(bytes.NewReader(file))
+	if err != nil {
+		return image.Point{}, err
+	}
+	return image.Pt(config.Width, config.Height), nil
+}
+
+// riffFile собирает файл WebP из последовательности чанков.
+func riffFile(body []byte) []byte {
+	file := make([]byte, 0, 12+len(body))
+	file = append(file, fourCCRIFF...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(4+len(body)))
+	file = append(file, fourCCWEBP...)
+	return append(file, body...)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
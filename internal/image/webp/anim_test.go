@@ -0,0 +1,163 @@
+package webp_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"github.com/romangricuk/image-previewer/internal/image/webp"
+)
+
+// animationFrame - кадр тестовой анимации: прямоугольник цвета c в области rect.
+type animationFrame struct {
+	rect    image.Rectangle
+	c       color.NRGBA
+	dispose bool
+	noBlend bool
+	// dataSize - размер, записываемый в заголовок потока VP8L вместо размера кадра.
+	dataSize image.Point
+}
+
+// animatedWebP собирает анимированный WebP с холстом width x height из кадров, сжатых без потерь.
+func animatedWebP(t *testing.T, width, height int, frames []animationFrame) []byte {
+	t.Helper()
+
+	chunk := func(fourCC string, data []byte) []byte {
+		b := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		b = append(b, data...)
+		if len(data)%2 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	uint24 := func(b []byte, v int) []byte {
+		return append(b, byte(v), byte(v>>8), byte(v>>16))
+	}
+
+	vp8x := uint24([]byte{0x12, 0, 0, 0}, width-1)
+	body := chunk("VP8X", uint24(vp8x, height-1))
+	body = append(body, chunk("ANIM", []byte{0, 0, 0, 0, 0, 0})...)
+	for _, f := range frames {
+		img := image.NewNRGBA(image.Rect(0, 0, f.rect.Dx(), f.rect.Dy()))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = f.c.R, f.c.G, f.c.B, f.c.A
+		}
+		var buf bytes.Buffer
+		if err := webp.Encode(&buf, img, &webp.Options{Lossless: true}); err != nil {
+			t.Fatalf("Failed to encode frame: %v", err)
+		}
+
+		if f.dataSize != (image.Point{}) {
+			// Заголовок VP8L следует за сигнатурой: ширина и высота без единицы по 14 бит, затем флаг альфа-канала
+			header := buf.Bytes()[21:25]
+			bits := binary.LittleEndian.Uint32(header)&^(1<<28-1) | uint32(f.dataSize.X-1) | uint32(f.dataSize.Y-1)<<14
+			binary.LittleEndian.PutUint32(header, bits)
+		}
+
+		var flags byte
+		if f.dispose {
+			flags |= 0x01
+		}
+		if f.noBlend {
+			flags |= 0x02
+		}
+		header := uint24(uint24(nil, f.rect.Min.X/2), f.rect.Min.Y/2)
+		header = uint24(uint24(header, f.rect.Dx()-1), f.rect.Dy()-1)
+		header = append(uint24(header, 100), flags)
+		// Файл WebP без заголовка RIFF содержит только чанк VP8L
+		body = append(body, chunk("ANMF", append(header, buf.Bytes()[12:]...))...)
+	}
+
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(body)))...)
+	data = append(data, "WEBP"...)
+	return append(data, body...)
+}
+
+func TestDecodeFrame(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	blue := color.NRGBA{B: 255, A: 255}
+	transparent := color.NRGBA{}
+
+	data := animatedWebP(t, 40, 20, []animationFrame{
+		{rect: image.Rect(0, 0, 40, 20), c: red},
+		{rect: image.Rect(0, 0, 20, 20), c: blue, dispose: true},
+		{rect: image.Rect(30, 0, 40, 20), c: transparent, noBlend: true},
+	})
+
+	if n := webp.FrameCount(data); n != 3 {
+		t.Fatalf("Expected 3 frames, got %d", n)
+	}
+
+	// Второй кадр удаляется перед третьим, а третий заменяет пиксели холста без смешивания
+	expected := [][2]color.NRGBA{
+		{red, red},
+		{blue, red},
+		{transparent, transparent},
+	}
+	for i, want := range expected {
+		img, err := webp.DecodeFrame(data, i)
+		if err != nil {
+			t.Fatalf("Frame %d: %v", i, err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 40, 20) {
+			t.Fatalf("Frame %d: expected 40x20 canvas, got %v", i, img.Bounds())
+		}
+		left := color.NRGBAModel.Convert(img.At(5, 10)).(color.NRGBA)
+		right := color.NRGBAModel.Convert(img.At(35, 10)).(color.NRGBA)
+		if left != want[0] || right != want[1] {
+			t.Errorf("Frame %d: expected %v and %v, got %v and %v", i, want[0], want[1], left, right)
+		}
+	}
+
+	if _, err := webp.DecodeFrame(data, 3); !errors.Is(err, webp.ErrFrameNotFound) {
+		t.Errorf("Expected ErrFrameNotFound, got %v", err)
+	}
+
+	var static bytes.Buffer
+	if err := webp.Encode(&static, image.NewNRGBA(image.Rect(0, 0, 4, 4)), nil); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+	if n := webp.FrameCount(static.Bytes()); n != 0 {
+		t.Errorf("Expected no frames in static image, got %d", n)
+	}
+}
+
+func TestDecodeFrameSizeMismatch(t *testing.T) {
+	// Поток кадра 1x1 объявляет размер 8000x8000, под который декодер выделил бы около 250 МБ
+	data := animatedWebP(t, 1, 1, []animationFrame{
+		{rect: image.Rect(0, 0, 1, 1), c: color.NRGBA{A: 255}, dataSize: image.Pt(8000, 8000)},
+	})
+	_, err := webp.DecodeFrame(data, 0)
+	if err == nil || !strings.Contains(err.Error(), "does not match frame size") {
+		t.Fatalf("Expected frame size mismatch error, got %v", err)
+	}
+
+	// Размер, по которому проверяются ограничения, учитывает поток кадра, а не только холст
+	if size, ok := webp.Size(data); !ok || size != image.Pt(8000, 8000) {
+		t.Errorf("Expected size 8000x8000, got %v", size)
+	}
+}
+
+func TestSize(t *testing.T) {
+	var buf bytes.Buffer
+	// Сжатие с потерями с прозрачностью дает заголовок VP8X и поток VP8
+	if err := webp.Encode(&buf, gradientImage(50, 30), nil); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	if size, ok := webp.Size(buf.Bytes()); !ok || size != image.Pt(50, 30) {
+		t.Errorf("Expected size 50x30, got %v", size)
+	}
+
+	data := animatedWebP(t, 40, 20, []animationFrame{{rect: image.Rect(0, 0, 20, 10), c: color.NRGBA{A: 255}}})
+	if size, ok := webp.Size(data); !ok || size != image.Pt(40, 20) {
+		t.Errorf("Expected canvas size 40x20, got %v", size)
+	}
+
+	if _, ok := webp.Size([]byte("GIF89a")); ok {
+		t.Error("Expected no size for non-WebP data")
+	}
+}
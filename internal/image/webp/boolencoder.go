@@ -0,0 +1,84 @@
+package webp
+
+// boolEncoder - арифметический кодер логических значений VP8 (RFC 6386, раздел 7).
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+// putBit кодирует bit с вероятностью нуля prob/256.
+func (e *boolEncoder) putBit(bit bool, prob uint8) {
+	split := 1 + (((e.rng - 1) * uint32(prob)) >> 8)
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.propagateCarry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// propagateCarry переносит единицу в уже записанные байты.
+func (e *boolEncoder) propagateCarry() {
+	i := len(e.buf) - 1
+	for i >= 0 && e.buf[i] == 0xff {
+		e.buf[i] = 0
+		i--
+	}
+	if i >= 0 {
+		e.buf[i]++
+	}
+}
+
+// putLiteral записывает n младших битов v, начиная со старшего, с равной вероятностью.
+func (e *boolEncoder) putLiteral(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		e.putBit(v>>uint(i)&1 != 0, 128)
+	}
+}
+
+// putSigned записывает модуль v в n битах и затем знак.
+func (e *boolEncoder) putSigned(v int32, n int) {
+	if v < 0 {
+		e.putLiteral(uint32(-v), n)
+		e.putBit(true, 128)
+		return
+	}
+	e.putLiteral(uint32(v), n)
+	e.putBit(false, 128)
+}
+
+// putOptionalSigned записывает флаг наличия значения и само значение, если оно не равно нулю.
+func (e *boolEncoder) putOptionalSigned(v int32, n int) {
+	e.putBit(v != 0, 128)
+	if v != 0 {
+		e.putSigned(v, n)
+	}
+}
+
+// finish дописывает оставшиеся биты и возвращает закодированные данные.
+func (e *boolEncoder) finish() []byte {
+	for i := 0; i < 32; i++ {
+		e.putBit(false, 128)
+	}
+	return e.buf
+}
@@ -0,0 +1,266 @@
+package webp
+
+import "sort"
+
+const (
+	// maxCodeLength - максимальная длина префиксного кода символа.
+	maxCodeLength = 15
+	// maxCodeLengthCodeLength - максимальная длина кода в коде длин.
+	maxCodeLengthCodeLength = 7
+	numCodeLengthCodes      = 19
+)
+
+// codeLengthCodeOrder - порядок передачи длин кода длин (спецификация VP8L, раздел 3.7.2.1.2).
+var codeLengthCodeOrder = [numCodeLengthCodes]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// huffmanCode - канонический префиксный код алфавита.
+type huffmanCode struct {
+	lengths []uint8
+	// codes содержит коды с обратным порядком битов, готовые для записи в bitWriter.
+	codes []uint32
+	// single означает, что в алфавите используется один символ и он кодируется нулем битов.
+	single bool
+}
+
+// buildHuffmanCode строит код по частотам символов с длинами не больше maxLength.
+func buildHuffmanCode(freqs []uint32, maxLength int) huffmanCode {
+	code := huffmanCode{
+		lengths: make([]uint8, len(freqs)),
+		codes:   make([]uint32, len(freqs)),
+	}
+
+	counts := append([]uint32(nil), freqs...)
+	// Если код получился слишком длинным, выравниваем частоты и строим заново
+	for huffmanLengths(counts, code.lengths) > maxLength {
+		for i, c := range counts {
+			if c > 1 {
+				counts[i] = (c + 1) / 2
+			}
+		}
+	}
+
+	used := 0
+	for _, l := range code.lengths {
+		if l > 0 {
+			used++
+		}
+	}
+	code.single = used == 1
+
+	var lengthCounts [maxCodeLength + 1]uint32
+	for _, l := range code.lengths {
+		lengthCounts[l]++
+	}
+	lengthCounts[0] = 0
+	var nextCode [maxCodeLength + 1]uint32
+	var c uint32
+	for l := 1; l <= maxCodeLength; l++ {
+		c = (c + lengthCounts[l-1]) << 1
+		nextCode[l] = c
+	}
+	for s, l := range code.lengths {
+		if l > 0 {
+			code.codes[s] = reverseBits(nextCode[l], uint(l))
+			nextCode[l]++
+		}
+	}
+
+	return code
+}
+
+// huffmanLengths вычисляет длины кодов Хаффмана и возвращает максимальную из них.
+// Используемый в алфавите единственный символ получает длину 1.
+func huffmanLengths(freqs []uint32, lengths []uint8) int {
+	for i := range lengths {
+		lengths[i] = 0
+	}
+
+	var leaves []int
+	for s, f := range freqs {
+		if f > 0 {
+			leaves = append(leaves, s)
+		}
+	}
+	if len(leaves) == 0 {
+		return 0
+	}
+	if len(leaves) == 1 {
+		lengths[leaves[0]] = 1
+		return 1
+	}
+
+	// Листья упорядочены по частоте, а внутренние узлы создаются в порядке неубывания веса,
+	// поэтому для построения дерева достаточно двух очередей
+	sort.Slice(leaves, func(i, j int) bool {
+		fi, fj := freqs[leaves[i]], freqs[leaves[j]]
+		if fi != fj {
+			return fi < fj
+		}
+		return leaves[i] < leaves[j]
+	})
+
+	n := len(leaves)
+	weights := make([]uint64, 2*n-1)
+	parents := make([]int, 2*n-1)
+	for i, s := range leaves {
+		weights[i] = uint64(freqs[s])
+	}
+
+	nextLeaf, nextNode := 0, n
+	pick := func(created int) int {
+		if nextLeaf < n && (nextNode >= created || weights[nextLeaf] <= weights[nextNode]) {
+			nextLeaf++
+			return nextLeaf - 1
+		}
+		nextNode++
+		return nextNode - 1
+	}
+	for created := n; created < 2*n-1; created++ {
+		a := pick(created)
+		b := pick(created)
+		weights[created] = weights[a] + weights[b]
+		parents[a], parents[b] = created, created
+	}
+
+	depths := make([]int, 2*n-1)
+	maxDepth := 0
+	for i := 2*n - 3; i >= 0; i-- {
+		depths[i] = depths[parents[i]] + 1
+		if i < n {
+			lengths[leaves[i]] = uint8(min(depths[i], 255))
+			maxDepth = max(maxDepth, depths[i])
+		}
+	}
+
+	return maxDepth
+}
+
+// reverseBits возвращает n младших битов v в обратном порядке.
+func reverseBits(v uint32, n uint) uint32 {
+	var r uint32
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | v>>i&1
+	}
+	return r
+}
+
+// writeSymbol записывает код символа s.
+func (c *huffmanCode) writeSymbol(w *bitWriter, s int) {
+	if c.single {
+		return
+	}
+	w.writeBits(c.codes[s], uint(c.lengths[s]))
+}
+
+// writeHuffmanCode записывает описание кода в поток (спецификация VP8L, раздел 3.7.2.1).
+func writeHuffmanCode(w *bitWriter, code *huffmanCode) {
+	var symbols []int
+	for s, l := range code.lengths {
+		if l > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		writeSimpleHuffmanCode(w, symbols)
+		return
+	}
+
+	// Длины кодируются с повторами, а сами повторы - кодом длин
+	tokens := codeLengthTokens(code.lengths)
+	freqs := make([]uint32, numCodeLengthCodes)
+	for _, t := range tokens {
+		freqs[t.code]++
+	}
+	lengthCode := buildHuffmanCode(freqs, maxCodeLengthCodeLength)
+
+	numCodes := 4
+	for i := numCodeLengthCodes - 1; i >= 4; i-- {
+		if lengthCode.lengths[codeLengthCodeOrder[i]] > 0 {
+			numCodes = i + 1
+			break
+		}
+	}
+
+	w.writeBits(0, 1)
+	w.writeBits(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		w.writeBits(uint32(lengthCode.lengths[codeLengthCodeOrder[i]]), 3)
+	}
+	// Количество кодируемых длин совпадает с размером алфавита
+	w.writeBits(0, 1)
+	for _, t := range tokens {
+		lengthCode.writeSymbol(w, t.code)
+		switch t.code {
+		case 16:
+			w.writeBits(uint32(t.extra), 2)
+		case 17:
+			w.writeBits(uint32(t.extra), 3)
+		case 18:
+			w.writeBits(uint32(t.extra), 7)
+		}
+	}
+}
+
+// writeSimpleHuffmanCode записывает код из одного или двух символов меньше 256.
+// Пустой алфавит записывается как код из одного нулевого символа.
+func writeSimpleHuffmanCode(w *bitWriter, symbols []int) {
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+	w.writeBits(1, 1)
+	w.writeBits(uint32(len(symbols)-1), 1)
+	if symbols[0] < 2 {
+		w.writeBits(0, 1)
+		w.writeBits(uint32(symbols[0]), 1)
+	} else {
+		w.writeBits(1, 1)
+		w.writeBits(uint32(symbols[0]), 8)
+	}
+	if len(symbols) == 2 {
+		w.writeBits(uint32(symbols[1]), 8)
+	}
+}
+
+// codeLengthToken - элемент последовательности длин: длина 0..15 или код повтора 16..18.
+type codeLengthToken struct {
+	code  int
+	extra int
+}
+
+// codeLengthTokens сжимает последовательность длин кодов повторами.
+func codeLengthTokens(lengths []uint8) []codeLengthToken {
+	var tokens []codeLengthToken
+	for i := 0; i < len(lengths); {
+		v := int(lengths[i])
+		run := 1
+		for i+run < len(lengths) && int(lengths[i+run]) == v {
+			run++
+		}
+		i += run
+
+		if v == 0 {
+			for run >= 11 {
+				r := min(run, 138)
+				tokens = append(tokens, codeLengthToken{18, r - 11})
+				run -= r
+			}
+			if run >= 3 {
+				tokens = append(tokens, codeLengthToken{17, run - 3})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, codeLengthToken{v, 0})
+			run--
+			for run >= 3 {
+				r := min(run, 6)
+				tokens = append(tokens, codeLengthToken{16, r - 3})
+				run -= r
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, codeLengthToken{v, 0})
+		}
+	}
+	return tokens
+}
@@ -0,0 +1,788 @@
+package webp
+
+import (
+	"errors"
+	"image"
+	"math"
+)
+
+const (
+	numTypes    = 4
+	numBands    = 8
+	numContexts = 3
+	numProbas   = 11
+
+	// Типы блоков коэффициентов, определяющие набор вероятностей.
+	typeYAfterY2 = 0
+	typeY2       = 1
+	typeUV       = 2
+
+	// maxLevel - наибольший модуль квантованного коэффициента.
+	maxLevel = 2048
+	// maxFirstPartitionSize - ограничение размера первого раздела, который записывается в 19 битах.
+	maxFirstPartitionSize = 1<<19 - 1
+)
+
+// Режимы внутрикадрового предсказания блоков 16x16 и 8x8.
+const (
+	predDC = iota
+	predV
+	predH
+	predTM
+)
+
+// tokenStats - количество нулей и единиц, закодированных с каждой вероятностью коэффициентов.
+type tokenStats [numTypes][numBands][numContexts][numProbas][2]uint32
+
+// macroblock хранит выбранные режимы предсказания и квантованные коэффициенты макроблока.
+type macroblock struct {
+	yMode  int
+	uvMode int
+	y2     [16]int32
+	y      [16][16]int32
+	// uv содержит сначала четыре блока U, затем четыре блока V.
+	uv   [8][16]int32
+	skip bool
+}
+
+// vp8Encoder кодирует ключевой кадр VP8 с предсказанием макроблоков целиком (RFC 6386).
+type vp8Encoder struct {
+	width, height     int
+	mbW, mbH          int
+	yStride, uvStride int
+	// Исходные плоскости, дополненные повтором краевых пикселей до размера, кратного макроблоку.
+	srcY, srcU, srcV []uint8
+	// Восстановленные плоскости, совпадающие с результатом декодера до фильтрации.
+	recY, recU, recV []uint8
+
+	qi                        int
+	y1Quant, y2Quant, uvQuant [2]int32
+
+	mbs   []macroblock
+	probs [numTypes][numBands][numContexts][numProbas]uint8
+}
+
+// encodeLossy кодирует изображение с потерями в кадр VP8. Прозрачность не сохраняется.
+func encodeLossy(img *image.NRGBA, quality int) ([]byte, error) {
+	e := newVP8Encoder(img, quality)
+	for mby := 0; mby < e.mbH; mby++ {
+		for mbx := 0; mbx < e.mbW; mbx++ {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+
+	var stats tokenStats
+	e.writeTokens(nil, &stats)
+	e.updateProbs(&stats)
+
+	return e.frame()
+}
+
+func newVP8Encoder(img *image.NRGBA, quality int) *vp8Encoder {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	e := &vp8Encoder{
+		width:  w,
+		height: h,
+		mbW:    (w + 15) / 16,
+		mbH:    (h + 15) / 16,
+		probs:  defaultCoeffProbs,
+	}
+	e.yStride, e.uvStride = e.mbW*16, e.mbW*8
+	e.srcY = make([]uint8, e.yStride*e.mbH*16)
+	e.srcU = make([]uint8, e.uvStride*e.mbH*8)
+	e.srcV = make([]uint8, e.uvStride*e.mbH*8)
+	e.recY = make([]uint8, len(e.srcY))
+	e.recU = make([]uint8, len(e.srcU))
+	e.recV = make([]uint8, len(e.srcV))
+	e.mbs = make([]macroblock, e.mbW*e.mbH)
+
+	// Преобразование в YUV BT.601 с ограниченным диапазоном, как в libwebp
+	pixel := func(x, y int) (int32, int32, int32) {
+		p := img.Pix[min(y, h-1)*img.Stride+min(x, w-1)*4:]
+		return int32(p[0]), int32(p[1]), int32(p[2])
+	}
+	for y := 0; y < e.mbH*16; y++ {
+		for x := 0; x < e.yStride; x++ {
+			r, g, b := pixel(x, y)
+			e.srcY[y*e.yStride+x] = uint8((16839*r + 33059*g + 6420*b + 16<<16 + 1<<15) >> 16)
+		}
+	}
+	for y := 0; y < e.mbH*8; y++ {
+		for x := 0; x < e.uvStride; x++ {
+			var r, g, b int32
+			for i := 0; i < 4; i++ {
+				pr, pg, pb := pixel(2*x+i&1, 2*y+i>>1)
+				r, g, b = r+pr, g+pg, b+pb
+			}
+			e.srcU[y*e.uvStride+x] = clipUV(-9719*r - 19081*g + 28800*b)
+			e.srcV[y*e.uvStride+x] = clipUV(28800*r - 24116*g - 4684*b)
+		}
+	}
+
+	e.qi = qualityToQuantizer(quality)
+	dc, ac := dcQuantTable[e.qi], acQuantTable[e.qi]
+	e.y1Quant = [2]int32{dc, ac}
+	e.y2Quant = [2]int32{dc * 2, max(ac*155/100, 8)}
+	e.uvQuant = [2]int32{dcQuantTable[min(e.qi, 117)], ac}
+
+	return e
+}
+
+// clipUV масштабирует сумму цветоразностной компоненты по четырем пикселям.
+func clipUV(v int32) uint8 {
+	v = (v + 1<<17 + 128<<18) >> 18
+	return uint8(max(0, min(255, v)))
+}
+
+// qualityToQuantizer переводит качество 0..100 в индекс квантователя так же, как libwebp.
+func qualityToQuantizer(quality int) int {
+	c := float64(quality) / 100
+	linear := 2*c - 1
+	if c < 0.75 {
+		linear = c * 2 / 3
+	}
+	qi := int(math.Round(127 * (1 - math.Cbrt(linear))))
+	return max(0, min(127, qi))
+}
+
+// encodeMacroblock выбирает режимы предсказания, квантует остатки и восстанавливает макроблок.
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	mb := &e.mbs[mby*e.mbW+mbx]
+
+	// Яркость: режим с наименьшей ошибкой предсказания
+	var pred [256]uint8
+	mb.yMode = e.bestLumaMode(mbx, mby, pred[:])
+
+	var coeffs [16][16]int32
+	var dcs [16]int32
+	for b := range coeffs {
+		x0, y0 := mbx*16+b%4*4, mby*16+b/4*4
+		var residual [16]int32
+		for i := range residual {
+			x, y := i%4, i/4
+			residual[i] = int32(e.srcY[(y0+y)*e.yStride+x0+x]) - int32(pred[(b/4*4+y)*16+b%4*4+x])
+		}
+		forwardDCT(&residual, &coeffs[b])
+		dcs[b] = coeffs[b][0]
+	}
+	var wht [16]int32
+	forwardWHT(&dcs, &wht)
+	quantizeBlock(&wht, &mb.y2, e.y2Quant)
+	for b := range coeffs {
+		coeffs[b][0] = 0
+		quantizeBlock(&coeffs[b], &mb.y[b], e.y1Quant)
+	}
+
+	// Восстановление повторяет действия декодера, чтобы предсказание следующих макроблоков совпадало
+	var y2 [16]int32
+	dequantizeBlock(&mb.y2, &y2, e.y2Quant)
+	inverseWHT(&y2, &dcs)
+	copyBlock(e.recY, e.yStride, mbx*16, mby*16, pred[:], 16)
+	for b := range coeffs {
+		var c [16]int32
+		dequantizeBlock(&mb.y[b], &c, e.y1Quant)
+		c[0] = dcs[b]
+		inverseDCT(&c, e.recY, e.yStride, mbx*16+b%4*4, mby*16+b/4*4)
+	}
+
+	// Цветность: общий режим для U и V
+	var predU, predV [64]uint8
+	mb.uvMode = e.bestChromaMode(mbx, mby, predU[:], predV[:])
+	e.encodeChroma(mbx, mby, planeRef{e.srcU, e.recU, e.uvStride}, predU[:], mb.uv[:4])
+	e.encodeChroma(mbx, mby, planeRef{e.srcV, e.recV, e.uvStride}, predV[:], mb.uv[4:])
+
+	mb.skip = isZero(&mb.y2)
+	for b := range mb.y {
+		mb.skip = mb.skip && isZero(&mb.y[b])
+	}
+	for b := range mb.uv {
+		mb.skip = mb.skip && isZero(&mb.uv[b])
+	}
+}
+
+// encodeChroma квантует остатки четырех блоков 4x4 плоскости цветности и восстанавливает их.
+func (e *vp8Encoder) encodeChroma(mbx, mby int, plane planeRef, pred []uint8, levels [][16]int32) {
+	x0, y0 := mbx*8, mby*8
+	copyBlock(plane.rec, plane.stride, x0, y0, pred, 8)
+	for b := range levels {
+		bx, by := x0+b%2*4, y0+b/2*4
+		var residual, c [16]int32
+		for i := range residual {
+			x, y := i%4, i/4
+			residual[i] = int32(plane.src[(by+y)*plane.stride+bx+x]) - int32(pred[(b/2*4+y)*8+b%2*4+x])
+		}
+		forwardDCT(&residual, &c)
+		quantizeBlock(&c, &levels[b], e.uvQuant)
+		dequantizeBlock(&levels[b], &c, e.uvQuant)
+		inverseDCT(&c, plane.rec, plane.stride, bx, by)
+	}
+}
+
+// planeRef - исходная и восстановленная плоскости с общим шагом строки.
+type planeRef struct {
+	src, rec []uint8
+	stride   int
+}
+
+// availableModes возвращает режимы, для которых есть соседние восстановленные пиксели.
+func availableModes(mbx, mby int) []int {
+	modes := []int{predDC}
+	if mby > 0 {
+		modes = append(modes, predV)
+	}
+	if mbx > 0 {
+		modes = append(modes, predH)
+	}
+	if mbx > 0 && mby > 0 {
+		modes = append(modes, predTM)
+	}
+	return modes
+}
+
+// bestLumaMode выбирает режим предсказания яркости с наименьшей суммой квадратов ошибок.
+func (e *vp8Encoder) bestLumaMode(mbx, mby int, pred []uint8) int {
+	var candidate [256]uint8
+	bestMode, bestErr := predDC, -1
+	for _, mode := range availableModes(mbx, mby) {
+		predictBlock(candidate[:], e.recY, e.yStride, mbx*16, mby*16, 16, mode)
+		err := blockError(e.srcY, e.yStride, mbx*16, mby*16, candidate[:], 16)
+		if bestErr < 0 || err < bestErr {
+			bestMode, bestErr = mode, err
+			copy(pred, candidate[:])
+		}
+	}
+	return bestMode
+}
+
+// bestChromaMode выбирает общий для U и V режим предсказания.
+func (e *vp8Encoder) bestChromaMode(mbx, mby int, predU, predV []uint8) int {
+	var candU, candV [64]uint8
+	bestMode, bestErr := predDC, -1
+	for _, mode := range availableModes(mbx, mby) {
+		predictBlock(candU[:], e.recU, e.uvStride, mbx*8, mby*8, 8, mode)
+		predictBlock(candV[:], e.recV, e.uvStride, mbx*8, mby*8, 8, mode)
+		err := blockError(e.srcU, e.uvStride, mbx*8, mby*8, candU[:], 8) +
+			blockError(e.srcV, e.uvStride, mbx*8, mby*8, candV[:], 8)
+		if bestErr < 0 || err < bestErr {
+			bestMode, bestErr = mode, err
+			copy(predU, candU[:])
+			copy(predV, candV[:])
+		}
+	}
+	return bestMode
+}
+
+// predictBlock строит предсказание блока по восстановленным пикселям сверху и слева.
+func predictBlock(dst, plane []uint8, stride, x0, y0, size, mode int) {
+	switch mode {
+	case predV:
+		top := plane[(y0-1)*stride+x0:]
+		for y := 0; y < size; y++ {
+			copy(dst[y*size:(y+1)*size], top[:size])
+		}
+	case predH:
+		for y := 0; y < size; y++ {
+			left := plane[(y0+y)*stride+x0-1]
+			for x := 0; x < size; x++ {
+				dst[y*size+x] = left
+			}
+		}
+	case predTM:
+		topLeft := int32(plane[(y0-1)*stride+x0-1])
+		for y := 0; y < size; y++ {
+			left := int32(plane[(y0+y)*stride+x0-1])
+			for x := 0; x < size; x++ {
+				dst[y*size+x] = clip8(left + int32(plane[(y0-1)*stride+x0+x]) - topLeft)
+			}
+		}
+	default:
+		// Среднее по доступным соседям, 128 для левого верхнего макроблока
+		sum, n := 0, 0
+		if y0 > 0 {
+			for x := 0; x < size; x++ {
+				sum += int(plane[(y0-1)*stride+x0+x])
+			}
+			n += size
+		}
+		if x0 > 0 {
+			for y := 0; y < size; y++ {
+				sum += int(plane[(y0+y)*stride+x0-1])
+			}
+			n += size
+		}
+		dc := uint8(128)
+		if n > 0 {
+			dc = uint8((sum + n/2) / n)
+		}
+		for i := range dst[:size*size] {
+			dst[i] = dc
+		}
+	}
+}
+
+// blockError возвращает сумму квадратов отклонений предсказания от исходного блока.
+func blockError(src []uint8, stride, x0, y0 int, pred []uint8, size int) int {
+	sum := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			d := int(src[(y0+y)*stride+x0+x]) - int(pred[y*size+x])
+			sum += d * d
+		}
+	}
+	return sum
+}
+
+func copyBlock(dst []uint8, stride, x0, y0 int, src []uint8, size int) {
+	for y := 0; y < size; y++ {
+		copy(dst[(y0+y)*stride+x0:], src[y*size:(y+1)*size])
+	}
+}
+
+func clip8(v int32) uint8 {
+	return uint8(max(0, min(255, v)))
+}
+
+func isZero(levels *[16]int32) bool {
+	for _, v := range levels {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardDCT выполняет прямое преобразование блока 4x4 так же, как libvpx.
+func forwardDCT(in, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		r := in[i*4:]
+		a := (r[0] + r[3]) * 8
+		b := (r[1] + r[2]) * 8
+		c := (r[1] - r[2]) * 8
+		d := (r[0] - r[3]) * 8
+		tmp[i*4+0] = a + b
+		tmp[i*4+2] = a - b
+		tmp[i*4+1] = (c*2217 + d*5352 + 14500) >> 12
+		tmp[i*4+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a := tmp[i] + tmp[12+i]
+		b := tmp[4+i] + tmp[8+i]
+		c := tmp[4+i] - tmp[8+i]
+		d := tmp[i] - tmp[12+i]
+		out[i] = (a + b + 7) >> 4
+		out[8+i] = (a - b + 7) >> 4
+		out[4+i] = (c*2217 + d*5352 + 12000) >> 16
+		if d != 0 {
+			out[4+i]++
+		}
+		out[12+i] = (d*2217 - c*5352 + 51000) >> 16
+	}
+}
+
+// forwardWHT выполняет прямое преобразование Уолша-Адамара коэффициентов DC блоков яркости.
+func forwardWHT(in, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		r := in[i*4:]
+		a := (r[0] + r[2]) * 4
+		d := (r[1] + r[3]) * 4
+		c := (r[1] - r[3]) * 4
+		b := (r[0] - r[2]) * 4
+		tmp[i*4+0] = a + d
+		if a != 0 {
+			tmp[i*4+0]++
+		}
+		tmp[i*4+1] = b + c
+		tmp[i*4+2] = b - c
+		tmp[i*4+3] = a - d
+	}
+	for i := 0; i < 4; i++ {
+		a := tmp[i] + tmp[8+i]
+		d := tmp[4+i] + tmp[12+i]
+		c := tmp[4+i] - tmp[12+i]
+		b := tmp[i] - tmp[8+i]
+		for k, v := range [4]int32{a + d, b + c, b - c, a - d} {
+			if v < 0 {
+				v++
+			}
+			out[k*4+i] = (v + 3) >> 3
+		}
+	}
+}
+
+// inverseDCT добавляет к блоку 4x4 плоскости результат обратного преобразования коэффициентов.
+// Вычисления совпадают с декодером.
+func inverseDCT(in *[16]int32, plane []uint8, stride, x0, y0 int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	if isZero(in) {
+		return
+	}
+	var c [16]int32
+	for i := range c {
+		c[i] = int32(int16(in[i]))
+	}
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := c[i] + c[8+i]
+		b := c[i] - c[8+i]
+		cc := (c[4+i]*c2)>>16 - (c[12+i]*c1)>>16
+		d := (c[4+i]*c1)>>16 + (c[12+i]*c2)>>16
+		m[i] = [4]int32{a + d, b + cc, b - cc, a - d}
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		cc := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := plane[(y0+j)*stride+x0:]
+		row[0] = clip8(int32(row[0]) + (a+d)>>3)
+		row[1] = clip8(int32(row[1]) + (b+cc)>>3)
+		row[2] = clip8(int32(row[2]) + (b-cc)>>3)
+		row[3] = clip8(int32(row[3]) + (a-d)>>3)
+	}
+}
+
+// inverseWHT восстанавливает коэффициенты DC блоков яркости так же, как декодер.
+func inverseWHT(in, out *[16]int32) {
+	var c [16]int32
+	for i := range c {
+		c[i] = int32(int16(in[i]))
+	}
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := c[i] + c[12+i]
+		a1 := c[4+i] + c[8+i]
+		a2 := c[4+i] - c[8+i]
+		a3 := c[i] - c[12+i]
+		m[i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[i*4] + 3
+		a0 := dc + m[i*4+3]
+		a1 := m[i*4+1] + m[i*4+2]
+		a2 := m[i*4+1] - m[i*4+2]
+		a3 := dc - m[i*4+3]
+		out[i*4+0] = int32(int16((a0 + a1) >> 3))
+		out[i*4+1] = int32(int16((a3 + a2) >> 3))
+		out[i*4+2] = int32(int16((a0 - a1) >> 3))
+		out[i*4+3] = int32(int16((a3 - a2) >> 3))
+	}
+}
+
+// quantizeBlock квантует коэффициенты: quant[0] - шаг для DC, quant[1] - для остальных.
+// Коэффициенты AC округляются с мертвой зоной, что уменьшает размер без заметной потери качества.
+func quantizeBlock(in, out *[16]int32, quant [2]int32) {
+	for i, v := range in {
+		step := quant[min(i, 1)]
+		bias := step * 3 / 8
+		if i == 0 {
+			bias = step / 2
+		}
+		level := (abs32(v) + bias) / step
+		level = min(level, maxLevel)
+		if v < 0 {
+			level = -level
+		}
+		out[i] = level
+	}
+}
+
+func dequantizeBlock(in, out *[16]int32, quant [2]int32) {
+	for i, v := range in {
+		out[i] = v * quant[min(i, 1)]
+	}
+}
+
+func abs32(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// writeTokens кодирует коэффициенты всех макроблоков. Если bw равен nil,
+// только собирается статистика для выбора вероятностей.
+func (e *vp8Encoder) writeTokens(bw *boolEncoder, stats *tokenStats) {
+	// Признаки ненулевых блоков соседей: 4 блока Y, 2 блока U, 2 блока V и блок Y2
+	topNz := make([][9]int, e.mbW)
+	for mby := 0; mby < e.mbH; mby++ {
+		var leftNz [9]int
+		for mbx := 0; mbx < e.mbW; mbx++ {
+			mb := &e.mbs[mby*e.mbW+mbx]
+			top := &topNz[mbx]
+			if mb.skip {
+				*top, leftNz = [9]int{}, [9]int{}
+				continue
+			}
+
+			nz := e.putCoeffs(bw, stats, typeY2, top[8]+leftNz[8], &mb.y2, 0)
+			top[8], leftNz[8] = nz, nz
+			for b := range mb.y {
+				x, y := b%4, b/4
+				nz := e.putCoeffs(bw, stats, typeYAfterY2, top[x]+leftNz[y], &mb.y[b], 1)
+				top[x], leftNz[y] = nz, nz
+			}
+			for b := range mb.uv {
+				x, y := 4+b/4*2+b%2, 4+b/4*2+b%4/2
+				nz := e.putCoeffs(bw, stats, typeUV, top[x]+leftNz[y], &mb.uv[b], 0)
+				top[x], leftNz[y] = nz, nz
+			}
+		}
+	}
+}
+
+// putCoeffs кодирует коэффициенты блока начиная с позиции first в порядке обхода
+// и возвращает 1, если в блоке есть ненулевые коэффициенты (RFC 6386, раздел 13).
+func (e *vp8Encoder) putCoeffs(bw *boolEncoder, stats *tokenStats, typ, ctx int, levels *[16]int32, first int) int {
+	tw := tokenWriter{bw: bw, stats: stats, probs: &e.probs, typ: typ}
+
+	last := -1
+	for n := first; n < 16; n++ {
+		if levels[zigzag[n]] != 0 {
+			last = n
+		}
+	}
+	if last < 0 {
+		tw.bit(false, bands[first], ctx, 0)
+		return 0
+	}
+
+	afterZero := false
+	for n := first; n <= last; n++ {
+		band := bands[n]
+		if !afterZero {
+			// После нуля признак конца блока не передается
+			tw.bit(true, band, ctx, 0)
+		}
+		v := levels[zigzag[n]]
+		if v == 0 {
+			tw.bit(false, band, ctx, 1)
+			ctx, afterZero = 0, true
+			continue
+		}
+		tw.bit(true, band, ctx, 1)
+		ctx = tw.putLevel(abs32(v), band, ctx)
+		tw.extra(v < 0, 128)
+		afterZero = false
+	}
+
+	if last < 15 {
+		tw.bit(false, bands[last+1], ctx, 0)
+	}
+	return 1
+}
+
+// tokenWriter кодирует токены коэффициентов одного типа блоков. Если bw равен nil,
+// токены только учитываются в статистике.
+type tokenWriter struct {
+	bw    *boolEncoder
+	stats *tokenStats
+	probs *[numTypes][numBands][numContexts][numProbas]uint8
+	typ   int
+}
+
+// bit кодирует бит узла node дерева токенов.
+func (w *tokenWriter) bit(b bool, band, ctx, node int) {
+	if b {
+		w.stats[w.typ][band][ctx][node][1]++
+	} else {
+		w.stats[w.typ][band][ctx][node][0]++
+	}
+	if w.bw != nil {
+		w.bw.putBit(b, w.probs[w.typ][band][ctx][node])
+	}
+}
+
+// extra кодирует дополнительный бит с фиксированной вероятностью.
+func (w *tokenWriter) extra(b bool, prob uint8) {
+	if w.bw != nil {
+		w.bw.putBit(b, prob)
+	}
+}
+
+// putLevel кодирует ненулевой модуль коэффициента и возвращает контекст следующего токена.
+func (w *tokenWriter) putLevel(level int32, band, ctx int) int {
+	if level == 1 {
+		w.bit(false, band, ctx, 2)
+		return 1
+	}
+	w.bit(true, band, ctx, 2)
+
+	switch {
+	case level <= 4:
+		w.bit(false, band, ctx, 3)
+		w.bit(level != 2, band, ctx, 4)
+		if level != 2 {
+			w.bit(level == 4, band, ctx, 5)
+		}
+	case level <= 10:
+		w.bit(true, band, ctx, 3)
+		w.bit(false, band, ctx, 6)
+		w.bit(level > 6, band, ctx, 7)
+		if level <= 6 {
+			w.extra(level == 6, cat1Probs[0])
+		} else {
+			w.extra((level-7)&2 != 0, cat2Probs[0])
+			w.extra((level-7)&1 != 0, cat2Probs[1])
+		}
+	default:
+		w.bit(true, band, ctx, 3)
+		w.bit(true, band, ctx, 6)
+		cat, probs := 3, cat6Probs
+		switch {
+		case level < 19:
+			cat, probs = 0, cat3Probs
+		case level < 35:
+			cat, probs = 1, cat4Probs
+		case level < 67:
+			cat, probs = 2, cat5Probs
+		}
+		w.bit(cat >= 2, band, ctx, 8)
+		w.bit(cat&1 != 0, band, ctx, 9+cat/2)
+		rest := level - 3 - 8<<cat
+		for i, prob := range probs {
+			w.extra(rest>>(len(probs)-1-i)&1 != 0, prob)
+		}
+	}
+	return 2
+}
+
+// updateProbs заменяет вероятности коэффициентов на оценки по статистике,
+// если это уменьшает размер с учетом затрат на передачу новых значений.
+func (e *vp8Encoder) updateProbs(stats *tokenStats) {
+	for t := range e.probs {
+		for b := range e.probs[t] {
+			for c := range e.probs[t][b] {
+				for p := range e.probs[t][b][c] {
+					zeros, ones := stats[t][b][c][p][0], stats[t][b][c][p][1]
+					total := zeros + ones
+					if total == 0 {
+						continue
+					}
+					newProb := uint8(max(1, min(255, (zeros*255+total/2)/total)))
+					oldProb := defaultCoeffProbs[t][b][c][p]
+					updateProb := coeffUpdateProbs[t][b][c][p]
+					oldCost := bitsCost(zeros, ones, oldProb) + bitsCost(1, 0, updateProb)
+					newCost := bitsCost(zeros, ones, newProb) + bitsCost(0, 1, updateProb) + 8
+					if newCost < oldCost {
+						e.probs[t][b][c][p] = newProb
+					}
+				}
+			}
+		}
+	}
+}
+
+// bitsCost оценивает количество битов для кодирования zeros нулей и ones единиц с вероятностью нуля prob/256.
+func bitsCost(zeros, ones uint32, prob uint8) float64 {
+	p := float64(prob) / 256
+	return -float64(zeros)*math.Log2(p) - float64(ones)*math.Log2(1-p)
+}
+
+// frame собирает кадр VP8: заголовок, первый раздел с режимами макроблоков и раздел коэффициентов.
+func (e *vp8Encoder) frame() ([]byte, error) {
+	skipped := 0
+	for i := range e.mbs {
+		if e.mbs[i].skip {
+			skipped++
+		}
+	}
+	useSkip := skipped > 0
+	skipProb := uint8(max(1, min(255, (len(e.mbs)-skipped)*256/len(e.mbs))))
+
+	hdr := newBoolEncoder()
+	// Цветовое пространство и необходимость ограничения значений
+	hdr.putLiteral(0, 1)
+	hdr.putLiteral(0, 1)
+	// Без сегментации
+	hdr.putBit(false, 128)
+	// Обычный фильтр, его уровень и резкость, без поправок уровня
+	hdr.putLiteral(0, 1)
+	hdr.putLiteral(uint32(e.qi*3/8), 6)
+	hdr.putLiteral(0, 3)
+	hdr.putBit(false, 128)
+	// Один раздел коэффициентов
+	hdr.putLiteral(0, 2)
+	// Индекс квантователя без поправок
+	hdr.putLiteral(uint32(e.qi), 7)
+	for i := 0; i < 5; i++ {
+		hdr.putBit(false, 128)
+	}
+	// refresh_entropy_probs
+	hdr.putBit(false, 128)
+	e.writeProbUpdates(hdr)
+	hdr.putBit(useSkip, 128)
+	if useSkip {
+		hdr.putLiteral(uint32(skipProb), 8)
+	}
+
+	e.writeModes(hdr, useSkip, skipProb)
+	first := hdr.finish()
+	if len(first) > maxFirstPartitionSize {
+		return nil, errors.New("webp: image is too large for lossy encoding")
+	}
+
+	tokens := newBoolEncoder()
+	e.writeTokens(tokens, &tokenStats{})
+	partition := tokens.finish()
+
+	frame := make([]byte, 10, 10+len(first)+len(partition))
+	// Ключевой кадр версии 0, отображаемый, с размером первого раздела
+	tag := uint32(len(first))<<5 | 1<<4
+	frame[0], frame[1], frame[2] = byte(tag), byte(tag>>8), byte(tag>>16)
+	frame[3], frame[4], frame[5] = 0x9d, 0x01, 0x2a
+	frame[6], frame[7] = byte(e.width), byte(e.width>>8)
+	frame[8], frame[9] = byte(e.height), byte(e.height>>8)
+	frame = append(frame, first...)
+	return append(frame, partition...), nil
+}
+
+// writeProbUpdates записывает вероятности коэффициентов, отличающиеся от значений по умолчанию.
+func (e *vp8Encoder) writeProbUpdates(hdr *boolEncoder) {
+	for t := range e.probs {
+		for b := range e.probs[t] {
+			for c := range e.probs[t][b] {
+				for p, prob := range e.probs[t][b][c] {
+					update := prob != defaultCoeffProbs[t][b][c][p]
+					hdr.putBit(update, coeffUpdateProbs[t][b][c][p])
+					if update {
+						hdr.putLiteral(uint32(prob), 8)
+					}
+				}
+			}
+		}
+	}
+}
+
+// writeModes записывает признаки пропуска и режимы предсказания макроблоков.
+func (e *vp8Encoder) writeModes(hdr *boolEncoder, useSkip bool, skipProb uint8) {
+	for i := range e.mbs {
+		mb := &e.mbs[i]
+		if useSkip {
+			hdr.putBit(mb.skip, skipProb)
+		}
+		// Предсказание макроблока целиком
+		hdr.putBit(true, 145)
+		hdr.putBit(mb.yMode == predH || mb.yMode == predTM, 156)
+		if mb.yMode == predH || mb.yMode == predTM {
+			hdr.putBit(mb.yMode == predTM, 128)
+		} else {
+			hdr.putBit(mb.yMode == predV, 163)
+		}
+		hdr.putBit(mb.uvMode != predDC, 142)
+		if mb.uvMode != predDC {
+			hdr.putBit(mb.uvMode != predV, 114)
+			if mb.uvMode != predV {
+				hdr.putBit(mb.uvMode == predTM, 183)
+			}
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package webp
+
+import (
+	"image"
+	"math/bits"
+)
+
+const (
+	numLiteralCodes  = 256
+	numLengthCodes   = 24
+	numDistanceCodes = 40
+	// numDistanceMapCodes - количество кодов расстояний, задающих двумерное смещение.
+	numDistanceMapCodes = 120
+
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+
+	// predictorBits - логарифм стороны блока, для которого выбирается режим предсказания.
+	predictorBits = 4
+	numPredictors = 14
+
+	// Параметры поиска повторов LZ77.
+	minMatchLength     = 3
+	maxMatchLength     = 4096
+	maxMatchCandidates = 8
+	hashBits           = 16
+	windowSize         = 1<<20 - numDistanceMapCodes
+)
+
+// pixelRef - элемент потока пикселей: литерал или ссылка на ранее закодированные пиксели.
+type pixelRef struct {
+	argb uint32
+	// length - длина повтора, ноль для литерала.
+	length   int
+	distance int
+}
+
+// encodeLossless кодирует изображение без потерь в поток VP8L.
+func encodeLossless(img *image.NRGBA) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	argb := make([]uint32, w*h)
+	hasAlpha := false
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.Pix[y*img.Stride+x*4:]
+			argb[y*w+x] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+			hasAlpha = hasAlpha || p[3] != 0xff
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.writeBits(0x2f, 8)
+	bw.writeBits(uint32(w-1), 14)
+	bw.writeBits(uint32(h-1), 14)
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3)
+	writeLosslessImage(bw, argb, w, h, true)
+	return bw.bytes()
+}
+
+// encodeAlpha кодирует альфа-канал для чанка ALPH: поток VP8L без заголовка,
+// в котором значения прозрачности записаны в зеленый канал.
+func encodeAlpha(img *image.NRGBA) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	argb := make([]uint32, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			argb[y*w+x] = 0xff000000 | uint32(img.Pix[y*img.Stride+x*4+3])<<8
+		}
+	}
+
+	bw := &bitWriter{}
+	writeLosslessImage(bw, argb, w, h, false)
+	return bw.bytes()
+}
+
+// writeLosslessImage записывает преобразования и основное изображение потока VP8L.
+func writeLosslessImage(bw *bitWriter, argb []uint32, w, h int, subtractGreen bool) {
+	if subtractGreen {
+		bw.writeBits(1, 1)
+		bw.writeBits(transformSubtractGreen, 2)
+		for i, p := range argb {
+			green := p >> 8 & 0xff
+			red := (p>>16 - green) & 0xff
+			blue := (p - green) & 0xff
+			argb[i] = p&0xff00ff00 | red<<16 | blue
+		}
+	}
+
+	bw.writeBits(1, 1)
+	bw.writeBits(transformPredictor, 2)
+	bw.writeBits(predictorBits-2, 3)
+	modes := choosePredictors(argb, w, h)
+	residuals := applyPredictors(argb, w, h, modes)
+	tiles := make([]uint32, len(modes))
+	for i, mode := range modes {
+		tiles[i] = 0xff000000 | uint32(mode)<<8
+	}
+	writeEntropyImage(bw, tiles, subSampleSize(w), false)
+
+	bw.writeBits(0, 1)
+	writeEntropyImage(bw, residuals, w, true)
+}
+
+func subSampleSize(size int) int {
+	return (size + 1<<predictorBits - 1) >> predictorBits
+}
+
+// choosePredictors выбирает для каждого блока режим предсказания с наименьшими остатками.
+func choosePredictors(argb []uint32, w, h int) []int {
+	tilesW, tilesH := subSampleSize(w), subSampleSize(h)
+	modes := make([]int, tilesW*tilesH)
+	for ty := 0; ty < tilesH; ty++ {
+		for tx := 0; tx < tilesW; tx++ {
+			bestMode, bestCost := 0, -1
+			for mode := 0; mode < numPredictors; mode++ {
+				cost := 0
+				for y := ty << predictorBits; y < min(h, (ty+1)<<predictorBits); y++ {
+					for x := tx << predictorBits; x < min(w, (tx+1)<<predictorBits); x++ {
+						cost += residualCost(subPixels(argb[y*w+x], predictPixel(argb, w, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesW+tx] = bestMode
+		}
+	}
+	return modes
+}
+
+// residualCost оценивает затраты на кодирование остатка как сумму модулей компонент.
+func residualCost(diff uint32) int {
+	cost := 0
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(int8(diff >> shift))
+		if v < 0 {
+			v = -v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// applyPredictors вычисляет остатки предсказания по компонентам.
+func applyPredictors(argb []uint32, w, h int, modes []int) []uint32 {
+	tilesW := subSampleSize(w)
+	residuals := make([]uint32, len(argb))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			mode := modes[(y>>predictorBits)*tilesW+x>>predictorBits]
+			residuals[y*w+x] = subPixels(argb[y*w+x], predictPixel(argb, w, x, y, mode))
+		}
+	}
+	return residuals
+}
+
+// predictPixel возвращает предсказание пикселя (x, y). В первой строке используется левый
+// соседний пиксель, в первом столбце - верхний, а для первого пикселя - непрозрачный черный.
+func predictPixel(argb []uint32, w, x, y, mode int) uint32 {
+	i := y*w + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-w]
+	}
+
+	left, top, topLeft := argb[i-1], argb[i-w], argb[i-w-1]
+	// Для последнего столбца правым верхним считается первый пиксель текущей строки
+	topRight := argb[i-w+1]
+
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return left
+	case 2:
+		return top
+	case 3:
+		return topRight
+	case 4:
+		return topLeft
+	case 5:
+		return average2(average2(left, topRight), top)
+	case 6:
+		return average2(left, topLeft)
+	case 7:
+		return average2(left, top)
+	case 8:
+		return average2(topLeft, top)
+	case 9:
+		return average2(top, topRight)
+	case 10:
+		return average2(average2(left, topLeft), average2(top, topRight))
+	case 11:
+		return selectPredictor(left, top, topLeft)
+	case 12:
+		return mapChannels(func(a, b, c int) int { return a + b - c }, left, top, topLeft)
+	default:
+		avg := average2(left, top)
+		return mapChannels(func(a, b, _ int) int { return a + (a-b)/2 }, avg, topLeft, 0)
+	}
+}
+
+func average2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+// selectPredictor выбирает левый или верхний пиксель в зависимости от того,
+// вдоль какого направления изображение меняется меньше.
+func selectPredictor(left, top, topLeft uint32) uint32 {
+	var toTop, toLeft int
+	for shift := 0; shift < 32; shift += 8 {
+		c := int(topLeft >> shift & 0xff)
+		toTop += absInt(c - int(top>>shift&0xff))
+		toLeft += absInt(c - int(left>>shift&0xff))
+	}
+	if toTop < toLeft {
+		return left
+	}
+	return top
+}
+
+// mapChannels применяет f к компонентам пикселей и ограничивает результат диапазоном [0, 255].
+func mapChannels(f func(a, b, c int) int, a, b, c uint32) uint32 {
+	var r uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := f(int(a>>shift&0xff), int(b>>shift&0xff), int(c>>shift&0xff))
+		r |= uint32(max(0, min(255, v))) << shift
+	}
+	return r
+}
+
+// subPixels вычитает пиксели покомпонентно по модулю 256.
+func subPixels(a, b uint32) uint32 {
+	alphaGreen := 0x00ff00ff + a&0xff00ff00 - b&0xff00ff00
+	redBlue := 0xff00ff00 + a&0x00ff00ff - b&0x00ff00ff
+	return alphaGreen&0xff00ff00 | redBlue&0x00ff00ff
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// writeEntropyImage записывает изображение префиксными кодами. Для основного изображения
+// дополнительно записывается признак отсутствия карты групп кодов.
+func writeEntropyImage(bw *bitWriter, argb []uint32, w int, main bool) {
+	refs := findBackwardRefs(argb, w)
+	distanceCodes := distanceCodeMap(w)
+
+	// Без цветового кэша
+	bw.writeBits(0, 1)
+	if main {
+		// Одна группа префиксных кодов на все изображение
+		bw.writeBits(0, 1)
+	}
+
+	freqs := [5][]uint32{
+		make([]uint32, numLiteralCodes+numLengthCodes),
+		make([]uint32, numLiteralCodes),
+		make([]uint32, numLiteralCodes),
+		make([]uint32, numLiteralCodes),
+		make([]uint32, numDistanceCodes),
+	}
+	for _, ref := range refs {
+		if ref.length == 0 {
+			freqs[0][ref.argb>>8&0xff]++
+			freqs[1][ref.argb>>16&0xff]++
+			freqs[2][ref.argb&0xff]++
+			freqs[3][ref.argb>>24]++
+			continue
+		}
+		lengthCode, _, _ := prefixEncode(ref.length)
+		distanceCode, _, _ := prefixEncode(distanceCodes.code(ref.distance))
+		freqs[0][numLiteralCodes+lengthCode]++
+		freqs[4][distanceCode]++
+	}
+
+	var codes [5]huffmanCode
+	for i := range codes {
+		codes[i] = buildHuffmanCode(freqs[i], maxCodeLength)
+		writeHuffmanCode(bw, &codes[i])
+	}
+
+	for _, ref := range refs {
+		if ref.length == 0 {
+			codes[0].writeSymbol(bw, int(ref.argb>>8&0xff))
+			codes[1].writeSymbol(bw, int(ref.argb>>16&0xff))
+			codes[2].writeSymbol(bw, int(ref.argb&0xff))
+			codes[3].writeSymbol(bw, int(ref.argb>>24))
+			continue
+		}
+		lengthCode, nBits, extra := prefixEncode(ref.length)
+		codes[0].writeSymbol(bw, numLiteralCodes+lengthCode)
+		bw.writeBits(extra, nBits)
+		distanceCode, nBits, extra := prefixEncode(distanceCodes.code(ref.distance))
+		codes[4].writeSymbol(bw, distanceCode)
+		bw.writeBits(extra, nBits)
+	}
+}
+
+// prefixEncode возвращает префиксный код значения v >= 1,
+// количество и значение дополнительных битов (спецификация VP8L, раздел 4.2.2).
+func prefixEncode(v int) (int, uint, uint32) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	highBit := bits.Len(uint(d)) - 1
+	second := d >> (highBit - 1) & 1
+	nBits := uint(highBit - 1)
+	return 2*highBit + second, nBits, uint32(d) & (1<<nBits - 1)
+}
+
+// distanceCodes сопоставляет расстояния до пикселей, близких по двумерному смещению, коротким кодам.
+type distanceCodes map[int]int
+
+func distanceCodeMap(w int) distanceCodes {
+	codes := make(distanceCodes, numDistanceMapCodes)
+	for i := numDistanceMapCodes - 1; i >= 0; i-- {
+		yOffset := int(distanceMapTable[i] >> 4)
+		xOffset := 8 - int(distanceMapTable[i]&0xf)
+		// Проходим от больших кодов к меньшим, чтобы для расстояния остался наименьший код
+		codes[max(1, yOffset*w+xOffset)] = i + 1
+	}
+	return codes
+}
+
+func (c distanceCodes) code(distance int) int {
+	if code, ok := c[distance]; ok {
+		return code
+	}
+	return distance + numDistanceMapCodes
+}
+
+// findBackwardRefs разбивает пиксели на литералы и повторы жадным поиском по хеш-цепочкам.
+func findBackwardRefs(argb []uint32, w int) []pixelRef {
+	n := len(argb)
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	insert := func(i int) {
+		if i+1 < n {
+			h := pairHash(argb[i], argb[i+1])
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	refs := make([]pixelRef, 0, n)
+	for i := 0; i < n; {
+		limit := min(maxMatchLength, n-i)
+		bestLength, bestDistance := 0, 0
+		try := func(j int) {
+			if j < 0 || i-j > windowSize {
+				return
+			}
+			length := 0
+			for length < limit && argb[j+length] == argb[i+length] {
+				length++
+			}
+			if length > bestLength {
+				bestLength, bestDistance = length, i-j
+			}
+		}
+
+		// Соседние слева и сверху пиксели кодируются короткими расстояниями, поэтому проверяются всегда
+		try(i - 1)
+		try(i - w)
+		if i+1 < n {
+			j := head[pairHash(argb[i], argb[i+1])]
+			for k := 0; j >= 0 && k < maxMatchCandidates && bestLength < limit; k++ {
+				try(int(j))
+				j = prev[j]
+			}
+		}
+
+		if bestLength >= minMatchLength {
+			refs = append(refs, pixelRef{length: bestLength, distance: bestDistance})
+			for k := 0; k < bestLength; k++ {
+				insert(i + k)
+			}
+			i += bestLength
+			continue
+		}
+		refs = append(refs, pixelRef{argb: argb[i]})
+		insert(i)
+		i++
+	}
+
+	return refs
+}
+
+func pairHash(a, b uint32) uint32 {
+	return (a*0x1e35a7bd ^ b*0x9e3779b1) >> (32 - hashBits)
+}
@@ -0,0 +1,115 @@
+// Package webp реализует кодирование изображений в формат WebP без внешних зависимостей:
+// с потерями (VP8) и без потерь (VP8L), а также декодирование отдельных кадров анимированного WebP.
+package webp
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+const (
+	// DefaultQuality - качество сжатия с потерями по умолчанию.
+	DefaultQuality = 75
+	// maxDimension - наибольший размер стороны изображения WebP.
+	maxDimension = 16383
+)
+
+// Идентификаторы чанков RIFF.
+const (
+	fourCCRIFF = "RIFF"
+	fourCCWEBP = "WEBP"
+	fourCCVP8  = "VP8 "
+	fourCCVP8L = "VP8L"
+	fourCCVP8X = "VP8X"
+	fourCCALPH = "ALPH"
+	fourCCANMF = "ANMF"
+)
+
+// Options - параметры кодирования.
+type Options struct {
+	// Lossless включает сжатие без потерь, Quality при этом не используется.
+	Lossless bool
+	// Quality - качество сжатия с потерями от 1 до 100. Нулевое значение означает DefaultQuality.
+	Quality int
+}
+
+// Encode записывает изображение в w в формате WebP. Если o равен nil, используются параметры по умолчанию.
+// Прозрачность сохраняется в обоих режимах.
+func Encode(w io.Writer, img image.Image, o *Options) error {
+	bounds := img.Bounds()
+	if bounds.Dx() < 1 || bounds.Dy() < 1 || bounds.Dx() > maxDimension || bounds.Dy() > maxDimension {
+		return errors.New("webp: invalid image size")
+	}
+
+	var opts Options
+	if o != nil {
+		opts = *o
+	}
+	quality := opts.Quality
+	if quality <= 0 {
+		quality = DefaultQuality
+	}
+	quality = min(quality, 100)
+
+	nrgba := toNRGBA(img)
+	var chunks []byte
+	if opts.Lossless {
+		chunks = appendChunk(chunks, fourCCVP8L, encodeLossless(nrgba))
+	} else {
+		frame, err := encodeLossy(nrgba, quality)
+		if err != nil {
+			return err
+		}
+		if !nrgba.Opaque() {
+			// Кадр VP8 не содержит прозрачности, она передается отдельным чанком ALPH
+			// со сжатием без потерь, что требует расширенного формата
+			vp8x := make([]byte, 10)
+			vp8x[0] = 0x10
+			putUint24(vp8x[4:], uint32(bounds.Dx()-1))
+			putUint24(vp8x[7:], uint32(bounds.Dy()-1))
+			chunks = appendChunk(chunks, fourCCVP8X, vp8x)
+			alpha := append([]byte{1}, encodeAlpha(nrgba)...)
+			chunks = appendChunk(chunks, fourCCALPH, alpha)
+		}
+		chunks = appendChunk(chunks, fourCCVP8, frame)
+	}
+
+	header := make([]byte, 12)
+	copy(header, fourCCRIFF)
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+len(chunks)))
+	copy(header[8:], fourCCWEBP)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(chunks)
+	return err
+}
+
+// appendChunk добавляет чанк RIFF, дополняя данные до четной длины.
+func appendChunk(dst []byte, fourCC string, data []byte) []byte {
+	dst = append(dst, fourCC...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(data)))
+	dst = append(dst, data...)
+	if len(data)%2 != 0 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// toNRGBA приводит изображение к *image.NRGBA с началом координат в нуле.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == (image.Point{}) {
+		return nrgba
+	}
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Rect, img, bounds.Min, draw.Src)
+	return nrgba
+}
@@ -0,0 +1,224 @@
+package webp_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/romangricuk/image-previewer/internal/image/webp"
+	xwebp "golang.org/x/image/webp"
+)
+
+func TestEncodeLossless(t *testing.T) {
+	testCases := []struct {
+		name string
+		img  image.Image
+	}{
+		{"photo", readTestImage(t, "gopher_256x126.jpg")},
+		{"noise", noiseImage(37, 21)},
+		{"transparent gradient", gradientImage(64, 48)},
+		{"single pixel", image.NewNRGBA(image.Rect(0, 0, 1, 1))},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decoded := encodeAndDecode(t, tc.img, &webp.Options{Lossless: true})
+
+			bounds := tc.img.Bounds()
+			if decoded.Bounds().Size() != bounds.Size() {
+				t.Fatalf("Expected size %v, got %v", bounds.Size(), decoded.Bounds().Size())
+			}
+			for y := 0; y < bounds.Dy(); y++ {
+				for x := 0; x < bounds.Dx(); x++ {
+					want := color.NRGBAModel.Convert(tc.img.At(bounds.Min.X+x, bounds.Min.Y+y))
+					got := color.NRGBAModel.Convert(decoded.At(x, y))
+					if want != got {
+						t.Fatalf("Pixel (%d, %d) mismatch: expected %v, got %v", x, y, want, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeLossy(t *testing.T) {
+	img := readTestImage(t, "gopher_256x126.jpg")
+
+	var sizes []int
+	for _, quality := range []int{30, 90} {
+		var buf bytes.Buffer
+		if err := webp.Encode(&buf, img, &webp.Options{Quality: quality}); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		sizes = append(sizes, buf.Len())
+
+		decoded, err := xwebp.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Failed to decode WebP: %v", err)
+		}
+		ycbcr, ok := decoded.(*image.YCbCr)
+		if !ok {
+			t.Fatalf("Expected *image.YCbCr, got %T", decoded)
+		}
+		if ycbcr.Rect.Size() != img.Bounds().Size() {
+			t.Fatalf("Expected size %v, got %v", img.Bounds().Size(), ycbcr.Rect.Size())
+		}
+
+		// Яркость сравнивается с исходной в диапазоне BT.601, который использует VP8
+		if psnr := lumaPSNR(img, ycbcr); psnr < 28 {
+			t.Errorf("Quality %d: PSNR %.1f dB is too low", quality, psnr)
+		}
+	}
+
+	if sizes[0] >= sizes[1] {
+		t.Errorf("Expected lower quality to produce smaller file, got %d and %d bytes", sizes[0], sizes[1])
+	}
+}
+
+func TestEncodeLossyWithAlpha(t *testing.T) {
+	img := gradientImage(50, 30)
+
+	decoded := encodeAndDecode(t, img, nil)
+	nycbcra, ok := decoded.(*image.NYCbCrA)
+	if !ok {
+		t.Fatalf("Expected *image.NYCbCrA, got %T", decoded)
+	}
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 50; x++ {
+			want := img.NRGBAAt(x, y).A
+			if got := nycbcra.A[nycbcra.AOffset(x, y)]; got != want {
+				t.Fatalf("Alpha at (%d, %d) mismatch: expected %d, got %d", x, y, want, got)
+			}
+		}
+	}
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 20000, 1)), nil); err == nil {
+		t.Fatal("Expected error for image wider than WebP allows")
+	}
+}
+
+// FuzzEncode проверяет, что любое изображение кодируется в WebP, который декодирует golang.org/x/image/webp:
+// без потерь - в точности, с потерями - с тем же размером и той же прозрачностью.
+func FuzzEncode(f *testing.F) {
+	f.Add([]byte{}, uint8(0), uint8(0), false, uint8(0))
+	f.Add(noiseImage(37, 21).Pix, uint8(36), uint8(20), false, uint8(75))
+	f.Add(noiseImage(37, 21).Pix, uint8(36), uint8(20), true, uint8(0))
+	f.Add(gradientImage(64, 48).Pix, uint8(63), uint8(47), false, uint8(1))
+	f.Add(gradientImage(64, 48).Pix, uint8(63), uint8(47), true, uint8(100))
+
+	f.Fuzz(func(t *testing.T, pix []byte, w, h uint8, lossless bool, quality uint8) {
+		img := fuzzImage(pix, int(w)+1, int(h)+1)
+		var buf bytes.Buffer
+		if err := webp.Encode(&buf, img, &webp.Options{Lossless: lossless, Quality: int(quality) % 101}); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		decoded, err := xwebp.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Failed to decode WebP: %v", err)
+		}
+		if decoded.Bounds().Size() != img.Rect.Size() {
+			t.Fatalf("Expected size %v, got %v", img.Rect.Size(), decoded.Bounds().Size())
+		}
+
+		for y := 0; y < img.Rect.Dy(); y++ {
+			for x := 0; x < img.Rect.Dx(); x++ {
+				want := img.NRGBAAt(x, y)
+				got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+				if lossless && want != got {
+					t.Fatalf("Pixel (%d, %d) mismatch: expected %v, got %v", x, y, want, got)
+				}
+				// Прозрачность сохраняется без потерь и при сжатии с потерями
+				if want.A != got.A {
+					t.Fatalf("Alpha at (%d, %d) mismatch: expected %d, got %d", x, y, want.A, got.A)
+				}
+			}
+		}
+	})
+}
+
+// fuzzImage создает изображение w x h, пиксели которого по кругу заполняются байтами pix.
+func fuzzImage(pix []byte, w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if len(pix) > 0 {
+		for i := range img.Pix {
+			img.Pix[i] = pix[i%len(pix)]
+		}
+	}
+	return img
+}
+
+func encodeAndDecode(t *testing.T, img image.Image, opts *webp.Options) image.Image {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, opts); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := xwebp.Decode(&buf)
+	if err != nil {
+		t.Fatalf("Failed to decode WebP: %v", err)
+	}
+	return decoded
+}
+
+// lumaPSNR вычисляет отношение сигнал/шум яркости декодированного изображения.
+func lumaPSNR(img image.Image, decoded *image.YCbCr) float64 {
+	bounds := img.Bounds()
+	var sum float64
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			want := 16 + (65.481*float64(r)+128.553*float64(g)+24.966*float64(b))/0xffff
+			d := want - float64(decoded.Y[decoded.YOffset(x, y)])
+			sum += d * d
+		}
+	}
+	mse := sum / float64(bounds.Dx()*bounds.Dy())
+	return 10 * math.Log10(255*255/mse)
+}
+
+func noiseImage(w, h int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rnd.Read(img.Pix)
+	return img
+}
+
+// gradientImage создает изображение с плавными переходами цвета и прозрачности.
+func gradientImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(x * 255 / w),
+				G: uint8(y * 255 / h),
+				B: 128,
+				A: uint8((x + y) * 255 / (w + h)),
+			})
+		}
+	}
+	return img
+}
+
+func readTestImage(t *testing.T, name string) image.Image {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("..", "..", "..", "test", "data", name))
+	if err != nil {
+		t.Fatalf("Failed to read test image: %v", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to decode test image: %v", err)
+	}
+	return img
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrForbiddenAddress возвращается, если сервер источника находится в запрещенной сети.
+var ErrForbiddenAddress = errors.New("source address is not allowed")
+
+// Networks - сети и хосты, заданные списком через запятую.
+type Networks struct {
+	Prefixes []netip.Prefix
+	// Hosts - имена хостов в нижнем регистре, с портом или без него.
+	Hosts []string
+}
+
+// ParseNetworks разбирает список сетей CIDR, IP-адресов и имен хостов с необязательным портом.
+// Если allowHosts не задан, имена хостов считаются ошибкой.
+func ParseNetworks(entries []string, allowHosts bool) (Networks, error) {
+	var networks Networks
+	for _, entry := range entries {
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			networks.Prefixes = append(networks.Prefixes, prefix.Masked())
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			networks.Prefixes = append(networks.Prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		if !allowHosts || strings.ContainsAny(entry, "/ ") {
+			return Networks{}, fmt.Errorf("invalid network %q", entry)
+		}
+		networks.Hosts = append(networks.Hosts, strings.ToLower(entry))
+	}
+	return networks, nil
+}
+
+// containsAddr сообщает, входит ли адрес в одну из сетей.
+func (n Networks) containsAddr(addr netip.Addr) bool {
+	for _, prefix := range n.Prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsHost сообщает, совпадает ли адрес вида host:port с одним из хостов.
+func (n Networks) containsHost(address string) bool {
+	address = strings.ToLower(address)
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	for _, trusted := range n.Hosts {
+		if trusted == address || trusted == host {
+			return true
+		}
+	}
+	return false
+}
+
+// dialGuard устанавливает соединения с серверами источника, проверяя IP-адрес после разрешения имени.
+// Проверка выполняется для каждого соединения, поэтому она распространяется и на перенаправления.
+type dialGuard struct {
+	dialer  *net.Dialer
+	blocked Networks
+	trusted Networks
+	// blockPrivate запрещает локальные, частные и link-local адреса.
+	blockPrivate bool
+}
+
+func newDialGuard(blockPrivate bool, blocked, trusted Networks) *dialGuard {
+	g := &dialGuard{blocked: blocked, trusted: trusted, blockPrivate: blockPrivate}
+	g.dialer = &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   g.control,
+	}
+	return g
+}
+
+// DialContext устанавливает соединение. Доверенные хосты не проверяются.
+func (g *dialGuard) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if g.trusted.containsHost(address) {
+		dialer := *g.dialer
+		dialer.Control = nil
+		return dialer.DialContext(ctx, network, address)
+	}
+	return g.dialer.DialContext(ctx, network, address)
+}
+
+// control проверяет IP-адрес, с которым устанавливается соединение.
+func (g *dialGuard) control(_, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, address)
+	}
+	if addr := addrPort.Addr().Unmap(); !g.allowed(addr) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+	}
+	return nil
+}
+
+// allowed сообщает, разрешено ли соединение с адресом.
+func (g *dialGuard) allowed(addr netip.Addr) bool {
+	if g.trusted.containsAddr(addr) {
+		return true
+	}
+	if g.blocked.containsAddr(addr) {
+		return false
+	}
+	return !g.blockPrivate || !isPrivateAddr(addr)
+}
+
+// specialNetworks - сети специального назначения, которые не относятся к публичному интернету, но не распознаются
+// методами netip.Addr.
+var specialNetworks = []netip.Prefix{
+	// «Эта» сеть (RFC 791)
+	netip.MustParsePrefix("0.0.0.0/8"),
+	// Общее адресное пространство операторов (RFC 6598), в нем же адрес метаданных Alibaba Cloud 100.100.100.200
+	netip.MustParsePrefix("100.64.0.0/10"),
+	// Назначения протоколов IETF (RFC 6890)
+	netip.MustParsePrefix("192.0.0.0/24"),
+	// Тестирование производительности сетей (RFC 2544)
+	netip.MustParsePrefix("198.18.0.0/15"),
+	// Зарезервированные адреса (RFC 1112), включая широковещательный 255.255.255.255
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// NAT64 (RFC 6052) и 6to4 (RFC 3056) содержат адрес IPv4, в том числе частный
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// isPrivateAddr сообщает, относится ли адрес к локальным, частным (RFC 1918, RFC 4193), link-local сетям
+// или к сетям специального назначения.
+func isPrivateAddr(addr netip.Addr) bool {
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range specialNetworks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
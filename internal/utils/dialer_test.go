@@ -0,0 +1,59 @@
+package utils_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/romangricuk/image-previewer/internal/logger"
+	"github.com/romangricuk/image-previewer/internal/utils"
+)
+
+func TestBlockPrivateNetworks(t *testing.T) {
+	fetcher, err := utils.NewFetcher(utils.FetcherOptions{BlockPrivateNetworks: true})
+	if err != nil {
+		t.Fatalf("NewFetcher failed: %v", err)
+	}
+
+	// Адрес проверяется до установки соединения, поэтому запрещенные адреса не требуют доступа к сети
+	testCases := []struct {
+		name    string
+		host    string
+		blocked bool
+	}{
+		{"loopback", "127.0.0.1", true},
+		{"private", "10.1.2.3", true},
+		{"link-local metadata", "169.254.169.254", true},
+		{"this network", "0.1.2.3", true},
+		{"shared address space", "100.64.0.1", true},
+		{"alibaba cloud metadata", "100.100.100.200", true},
+		{"ietf protocol assignments", "192.0.0.170", true},
+		{"benchmarking", "198.19.255.254", true},
+		{"reserved", "240.0.0.1", true},
+		{"broadcast", "255.255.255.255", true},
+		{"ipv6 loopback", "[::1]", true},
+		{"ipv6 unique local", "[fd00::1]", true},
+		{"nat64", "[64:ff9b::a00:1]", true},
+		{"6to4", "[2002:a00:1::]", true},
+		{"below shared address space", "100.63.255.255", false},
+		{"above benchmarking", "198.20.0.1", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Разрешенные адреса не обязаны отвечать: достаточно, что соединение не отклонено проверкой
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			r, _ := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+			resp, err := fetcher.FetchImage(ctx, r, "http://"+tc.host+"/", logger.NewTestLogger())
+			if err == nil {
+				resp.Body.Close()
+			}
+			if blocked := errors.Is(err, utils.ErrForbiddenAddress); blocked != tc.blocked {
+				t.Errorf("Expected blocked %v for %s, got error %v", tc.blocked, tc.host, err)
+			}
+		})
+	}
+}
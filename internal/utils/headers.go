@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AllHeaders в списке пересылаемых заголовков разрешает все заголовки, кроме запрещенных.
+const AllHeaders = "*"
+
+// blockedHeaders не передаются серверу источника ни при каких настройках: они относятся к соединению с клиентом
+// или меняют ответ так, что его нельзя декодировать как изображение целиком.
+var blockedHeaders = map[string]bool{
+	"Host":                true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Expect":              true,
+	"Content-Length":      true,
+	"Accept-Encoding":     true,
+	"Range":               true,
+	"If-Range":            true,
+	"If-Match":            true,
+	"If-None-Match":       true,
+	"If-Modified-Since":   true,
+	"If-Unmodified-Since": true,
+}
+
+// headerPolicy определяет, какие заголовки запроса клиента передаются серверу источника.
+type headerPolicy struct {
+	allowAll bool
+	allow    map[string]bool
+	deny     map[string]bool
+}
+
+func newHeaderPolicy(allow, deny []string) headerPolicy {
+	policy := headerPolicy{
+		allow: make(map[string]bool, len(allow)),
+		deny:  make(map[string]bool, len(deny)),
+	}
+	for _, name := range allow {
+		if name == AllHeaders {
+			policy.allowAll = true
+			continue
+		}
+		policy.allow[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range deny {
+		policy.deny[http.CanonicalHeaderKey(name)] = true
+	}
+	return policy
+}
+
+// forwards сообщает, передается ли заголовок name серверу источника.
+func (p headerPolicy) forwards(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	if blockedHeaders[name] || p.deny[name] {
+		return false
+	}
+	return p.allowAll || p.allow[name]
+}
+
+// ParseHostHeaders разбирает постоянные заголовки для серверов источника, заданные записями
+// вида "<host> <name>: <value>", разделенными точкой с запятой. Хост сравнивается без учета регистра
+// с именем хоста из URL изображения с портом или без него.
+func ParseHostHeaders(s string) (map[string]http.Header, error) {
+	headers := make(map[string]http.Header)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, header, _ := strings.Cut(entry, " ")
+		name, value, found := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !found || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid source header %q, expected <host> <name>: <value>", entry)
+		}
+
+		host = strings.ToLower(host)
+		if headers[host] == nil {
+			headers[host] = make(http.Header)
+		}
+		headers[host].Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrForbiddenHost возвращается, если хост источника не разрешен настройками.
+var ErrForbiddenHost = errors.New("source host is not allowed")
+
+// regexpHostPrefix отмечает шаблон хоста, заданный регулярным выражением.
+const regexpHostPrefix = "~"
+
+// hostPattern - шаблон имени хоста: точное имя, *.example.com для поддоменов или регулярное выражение.
+type hostPattern struct {
+	exact  string
+	suffix string
+	re     *regexp.Regexp
+}
+
+func parseHostPattern(s string) (hostPattern, error) {
+	if expr, ok := strings.CutPrefix(s, regexpHostPrefix); ok {
+		// Регулярное выражение должно совпадать с именем хоста целиком и, как остальные шаблоны,
+		// сравнивается без учета регистра
+		re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+		if err != nil {
+			return hostPattern{}, fmt.Errorf("invalid host pattern %q: %w", s, err)
+		}
+		return hostPattern{re: re}, nil
+	}
+	s = strings.ToLower(s)
+	if domain, ok := strings.CutPrefix(s, "*."); ok {
+		return hostPattern{suffix: "." + domain}, nil
+	}
+	if strings.ContainsAny(s, "*/:") {
+		return hostPattern{}, fmt.Errorf("invalid host pattern %q", s)
+	}
+	return hostPattern{exact: s}, nil
+}
+
+func (p hostPattern) matches(host string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(host)
+	case p.suffix != "":
+		return strings.HasSuffix(host, p.suffix)
+	default:
+		return host == p.exact
+	}
+}
+
+// HostPolicy определяет, с каких хостов разрешено загружать изображения.
+type HostPolicy struct {
+	// restricted означает, что список разрешенных хостов задан, даже если ни один шаблон в нем не разобран.
+	restricted bool
+	allow      []hostPattern
+	deny       []hostPattern
+}
+
+// NewHostPolicy создает политику из списков разрешенных и запрещенных шаблонов хостов. Запрет имеет приоритет,
+// а пустой список разрешенных хостов разрешает все хосты. Шаблоны с ошибками пропускаются и возвращаются
+// в ошибке вместе с политикой из остальных шаблонов.
+func NewHostPolicy(allow, deny []string) (*HostPolicy, error) {
+	policy := &HostPolicy{restricted: len(allow) > 0}
+	var errs []error
+	parse := func(entries []string) []hostPattern {
+		var patterns []hostPattern
+		for _, entry := range entries {
+			pattern, err := parseHostPattern(entry)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			patterns = append(patterns, pattern)
+		}
+		return patterns
+	}
+	policy.allow = parse(allow)
+	policy.deny = parse(deny)
+	return policy, errors.Join(errs...)
+}
+
+// Allowed сообщает, разрешена ли загрузка изображений с хоста. Хост указывается без порта.
+// Точка в конце полного имени не учитывается: evil.com. и evil.com - один и тот же хост.
+func (p *HostPolicy) Allowed(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pattern := range p.deny {
+		if pattern.matches(host) {
+			return false
+		}
+	}
+	if !p.restricted {
+		return true
+	}
+	for _, pattern := range p.allow {
+		if pattern.matches(host) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,27 +2,235 @@ package utils
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 
 	"github.com/romangricuk/image-previewer/internal/logger"
 )
 
-func FetchImage(ctx context.Context, r *http.Request, imageURL string, log logger.Logger) (*http.Response, error) {
-	client := &http.Client{}
-	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+imageURL, nil)
+// Схемы, по которым загружаются исходные изображения.
+const (
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+// secureMarker - сегмент перед URL изображения, требующий загрузки по HTTPS.
+const secureMarker = "s/"
+
+// maxRedirects - наибольшее число перенаправлений при загрузке изображения.
+const maxRedirects = 10
+
+// FetcherOptions - настройки загрузки исходных изображений.
+type FetcherOptions struct {
+	// CAFile - файл PEM с сертификатами удостоверяющих центров, которые дополняют системные.
+	CAFile string
+	// InsecureSkipVerify отключает проверку сертификатов HTTPS. Предназначено только для тестовых окружений.
+	InsecureSkipVerify bool
+	// ForwardHeaders - заголовки запроса клиента, которые передаются серверу источника.
+	// AllHeaders разрешает все заголовки, кроме DenyHeaders.
+	ForwardHeaders []string
+	// DenyHeaders - заголовки запроса клиента, которые не передаются серверу источника.
+	DenyHeaders []string
+	// HostHeaders - постоянные заголовки для отдельных серверов источника, ключ - хост в нижнем регистре.
+	// Они заменяют одноименные заголовки клиента и не передаются при перенаправлении на другой хост.
+	HostHeaders map[string]http.Header
+	// UserAgent - заголовок User-Agent запросов к серверам источника. Если он пуст, передается
+	// заголовок клиента, если это разрешено.
+	UserAgent string
+	// BlockPrivateNetworks запрещает соединения с локальными, частными и link-local адресами.
+	BlockPrivateNetworks bool
+	// BlockedNetworks - дополнительно запрещенные сети.
+	BlockedNetworks Networks
+	// TrustedNetworks - доверенные сети и хосты, соединения с которыми разрешены независимо от запретов.
+	TrustedNetworks Networks
+	// Hosts - политика разрешенных хостов, которая проверяется при каждом перенаправлении.
+	// Пустое значение разрешает все хосты.
+	Hosts *HostPolicy
+}
+
+// Fetcher загружает исходные изображения по HTTP и HTTPS.
+type Fetcher struct {
+	client      *http.Client
+	headers     headerPolicy
+	hostHeaders map[string]http.Header
+	userAgent   string
+	hosts       *HostPolicy
+}
+
+// NewFetcher создает Fetcher с заданными настройками TLS, передачи заголовков и ограничения адресов.
+func NewFetcher(opts FetcherOptions) (*Fetcher, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Проверка отключается только явной настройкой
+		InsecureSkipVerify: opts.InsecureSkipVerify, //nolint:gosec
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	guard := newDialGuard(opts.BlockPrivateNetworks, opts.BlockedNetworks, opts.TrustedNetworks)
+	transport.DialContext = guard.DialContext
+	if opts.BlockPrivateNetworks || len(opts.BlockedNetworks.Prefixes) > 0 {
+		// Через прокси соединение с сервером источника устанавливал бы прокси в обход проверки адреса
+		transport.Proxy = nil
+	}
+	f := &Fetcher{
+		headers:     newHeaderPolicy(opts.ForwardHeaders, opts.DenyHeaders),
+		hostHeaders: opts.HostHeaders,
+		userAgent:   opts.UserAgent,
+		hosts:       opts.Hosts,
+	}
+	f.client = &http.Client{Transport: transport, CheckRedirect: f.checkRedirect}
+	return f, nil
+}
+
+// hostHeadersFor возвращает постоянные заголовки для хоста из URL.
+func (f *Fetcher) hostHeadersFor(u *url.URL) http.Header {
+	if headers, ok := f.hostHeaders[strings.ToLower(u.Host)]; ok {
+		return headers
+	}
+	return f.hostHeaders[strings.ToLower(u.Hostname())]
+}
+
+// checkRedirect ограничивает число перенаправлений, запрещает перенаправления на неразрешенные хосты
+// и при переходе на другой хост заменяет постоянные заголовки прежнего хоста заголовками нового.
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if host := req.URL.Hostname(); f.hosts != nil && !f.hosts.Allowed(host) {
+		return fmt.Errorf("%w: %s", ErrForbiddenHost, host)
+	}
+	prev := via[len(via)-1]
+	if strings.EqualFold(req.URL.Host, prev.URL.Host) {
+		return nil
+	}
+	for name := range f.hostHeadersFor(prev.URL) {
+		req.Header.Del(name)
+	}
+	setHeaders(req.Header, f.hostHeadersFor(req.URL))
+	return nil
+}
+
+// setHeaders заменяет заголовки dst одноименными заголовками src.
+func setHeaders(dst, src http.Header) {
+	for name, values := range src {
+		dst.Del(name)
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// loadCertPool возвращает системные сертификаты, дополненные сертификатами из файла PEM.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+	return pool, nil
+}
+
+// ParseScheme проверяет схему загрузки исходных изображений.
+func ParseScheme(s string) (string, error) {
+	switch scheme := strings.ToLower(s); scheme {
+	case SchemeHTTP, SchemeHTTPS:
+		return scheme, nil
+	default:
+		return "", fmt.Errorf("unsupported scheme %q", s)
+	}
+}
+
+// SourceURL преобразует URL изображения из пути запроса в канонический абсолютный URL. Схема задается префиксом
+// http: или https: (косые черты после него необязательны, так как при нормализации пути они схлопываются),
+// маркером s/ для HTTPS или берется из defaultScheme.
+func SourceURL(path, defaultScheme string) (string, error) {
+	scheme := defaultScheme
+	if rest, ok := strings.CutPrefix(path, secureMarker); ok {
+		scheme, path = SchemeHTTPS, rest
+	} else if prefix, rest, ok := strings.Cut(path, ":"); ok {
+		if explicit, err := ParseScheme(prefix); err == nil {
+			scheme, path = explicit, strings.TrimLeft(rest, "/")
+		}
+	}
+
+	u, err := url.Parse(scheme + "://" + path)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid image URL")
+	}
+	return canonicalURL(u), nil
+}
+
+// canonicalURL приводит URL к виду, в котором он используется в ключе кэша: хост в нижнем регистре, без точки
+// в конце полного имени и без порта по умолчанию, путь не пустой, а фрагмент, который не передается серверу, отброшен.
+// Параметры не переупорядочиваются, так как их порядок может быть важен для сервера.
+func canonicalURL(u *url.URL) string {
+	host, port := strings.TrimSuffix(strings.ToLower(u.Hostname()), "."), u.Port()
+	if (u.Scheme == SchemeHTTP && port == "80") || (u.Scheme == SchemeHTTPS && port == "443") {
+		port = ""
+	}
+	switch {
+	case port != "":
+		u.Host = net.JoinHostPort(host, port)
+	case strings.Contains(host, ":"):
+		u.Host = "[" + host + "]"
+	default:
+		u.Host = host
+	}
+	if u.Path == "" {
+		u.Path, u.RawPath = "/", ""
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
+
+// FetchImage загружает изображение по абсолютному URL. Серверу источника передаются разрешенные заголовки
+// исходного запроса и постоянные заголовки для его хоста.
+func (f *Fetcher) FetchImage(
+	ctx context.Context,
+	r *http.Request,
+	imageURL string,
+	log logger.Logger,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
 	if err != nil {
 		log.Errorf("Failed to create request to fetch image: %v", err)
 		return nil, err
 	}
 
-	// Проксирование заголовков
 	for name, values := range r.Header {
+		if !f.headers.forwards(name) {
+			continue
+		}
 		for _, value := range values {
 			req.Header.Add(name, value)
 		}
 	}
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	setHeaders(req.Header, f.hostHeadersFor(req.URL))
 
-	resp, err := client.Do(req)
+	resp, err := f.client.Do(req)
 	if err != nil {
 		log.Errorf("Error fetching image from URL %s: %v", imageURL, err)
 		return nil, err
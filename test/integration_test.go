@@ -2,15 +2,21 @@ package test
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"image"
-	_ "image/png"
+	"image/color"
+	"image/gif"
+	"image/png"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -20,6 +26,7 @@ import (
 	"github.com/romangricuk/image-previewer/internal/app"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	_ "golang.org/x/image/webp"
 )
 
 func getFreePort() (string, error) {
@@ -48,6 +55,10 @@ func startTestApplication() (application *app.Application, port string, err erro
 	os.Setenv("CACHE_DIR", "./cache")
 	os.Setenv("LOG_LEVEL", "debug")
 	os.Setenv("SHUTDOWN_TIMEOUT", "5s")
+	// Тестовые серверы работают на локальном адресе, загрузка с которого иначе запрещена
+	if _, ok := os.LookupEnv("TRUSTED_SOURCES"); !ok {
+		os.Setenv("TRUSTED_SOURCES", "127.0.0.0/8")
+	}
 
 	cacheDir := os.Getenv("CACHE_DIR")
 	if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
@@ -389,3 +400,1226 @@ func TestImageSmallerThanRequestedSize(t *testing.T) {
 	assert.Equal(t, 100, img.Bounds().Dx(), "Width mismatch")
 	assert.Equal(t, 100, img.Bounds().Dy(), "Height mismatch")
 }
+
+// Тестируем режим fit: изображение вписывается в размеры без обрезки.
+func TestFitMode(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_1024x252.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	sizes := map[string][2]int{
+		"fill": {300, 200},
+		"fit":  {300, 73},
+	}
+
+	for mode, expected := range sizes {
+		reqURL := fmt.Sprintf("http://localhost:%s/%s/300/200/%s", port, mode, imageURL)
+
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+
+		img, _, err := image.Decode(bytes.NewReader(data))
+		require.NoError(t, err, "Failed to decode image")
+
+		// Режимы не должны пересекаться в кэше
+		assert.Equal(t, expected[0], img.Bounds().Dx(), "Width mismatch for mode %s", mode)
+		assert.Equal(t, expected[1], img.Bounds().Dy(), "Height mismatch for mode %s", mode)
+	}
+}
+
+// Тестируем выбор точки привязки и фокусной точки при обрезке.
+func TestGravityOption(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_200x700.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	bodies := make(map[string][]byte)
+	for _, option := range []string{"g:north", "g:south", "fp:0.5,0.2", "fp:0.5,0.8"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/100/100/%s/%s", port, option, imageURL)
+
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+		bodies[option] = data
+	}
+
+	// Разные точки привязки не должны пересекаться в кэше
+	assert.NotEqual(t, bodies["g:north"], bodies["g:south"], "Expected different images for different gravity")
+	assert.NotEqual(t, bodies["fp:0.5,0.2"], bodies["fp:0.5,0.8"], "Expected different images for different focus points")
+
+	reqURL := fmt.Sprintf("http://localhost:%s/fill/100/100/g:middle/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request")
+}
+
+// Тестируем сохранение формата исходного изображения.
+func TestPreserveSourceFormat(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	// Прозрачное PNG-изображение
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 200))
+	for y := 50; y < 150; y++ {
+		for x := 50; x < 150; x++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var pngData bytes.Buffer
+	require.NoError(t, png.Encode(&pngData, src))
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngData.Bytes())
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+	reqURL := fmt.Sprintf("http://localhost:%s/fill/100/100/%s", port, imageURL)
+
+	// Второй запрос обслуживается из кэша и должен вернуть тот же формат
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+		assert.Equal(t, "image/png", resp.Header.Get("Content-Type"), "Expected Content-Type to be image/png")
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+
+		img, format, err := image.Decode(bytes.NewReader(data))
+		require.NoError(t, err, "Failed to decode image")
+		assert.Equal(t, "png", format, "Expected PNG image")
+
+		_, _, _, a := img.At(0, 0).RGBA()
+		assert.Zero(t, a, "Expected transparent background")
+	}
+}
+
+// Тестируем явный выбор формата результата.
+func TestExplicitOutputFormat(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_50x50.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	tests := []struct {
+		options     string
+		contentType string
+		format      string
+	}{
+		{"f:png/", "image/png", "png"},
+		{"", "image/jpeg", "jpeg"},
+		{"format:gif/", "image/gif", "gif"},
+	}
+
+	for _, tt := range tests {
+		reqURL := fmt.Sprintf("http://localhost:%s/fit/40/40/%s%s", port, tt.options, imageURL)
+
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+		assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"), "Content-Type mismatch")
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+
+		_, format, err := image.Decode(bytes.NewReader(data))
+		require.NoError(t, err, "Failed to decode image")
+		assert.Equal(t, tt.format, format, "Format mismatch")
+	}
+
+	reqURL := fmt.Sprintf("http://localhost:%s/fit/40/40/f:svg/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request")
+}
+
+// Тестируем выбор формата по заголовку Accept.
+func TestAcceptNegotiation(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_50x50.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	tests := []struct {
+		name        string
+		options     string
+		accept      string
+		contentType string
+		format      string
+		vary        string
+	}{
+		{"webp accepted", "", "image/avif,image/webp,*/*;q=0.8", "image/webp", "webp", "Accept"},
+		{"webp from cache", "", "image/webp", "image/webp", "webp", "Accept"},
+		{"no accept", "", "", "image/jpeg", "jpeg", "Accept"},
+		{"wildcard only", "", "image/*,*/*", "image/jpeg", "jpeg", "Accept"},
+		{"webp rejected", "", "image/webp;q=0, */*", "image/jpeg", "jpeg", "Accept"},
+		{"explicit format", "f:png/", "image/webp", "image/png", "png", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqURL := fmt.Sprintf("http://localhost:%s/fill/30/20/%s%s", port, tt.options, imageURL)
+			req, err := http.NewRequest(http.MethodGet, reqURL, nil) //nolint:noctx
+			require.NoError(t, err)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err, "Failed to get image")
+			defer resp.Body.Close()
+
+			require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"), "Content-Type mismatch")
+			assert.Equal(t, tt.vary, resp.Header.Get("Vary"), "Vary mismatch")
+
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err, "Failed to read response body")
+
+			img, format, err := image.Decode(bytes.NewReader(data))
+			require.NoError(t, err, "Failed to decode image")
+			assert.Equal(t, tt.format, format, "Format mismatch")
+			assert.Equal(t, image.Pt(30, 20), img.Bounds().Size(), "Size mismatch")
+		})
+	}
+}
+
+// Тестируем опции качества и прогрессивного JPEG.
+func TestQualityOptions(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	bodies := make(map[string][]byte)
+	for _, options := range []string{"q:10/", "q:95/", "quality:95/pr:1/"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/200/100/%s%s", port, options, imageURL)
+
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+		assert.Equal(t, "image/jpeg", resp.Header.Get("Content-Type"), "Expected Content-Type to be image/jpeg")
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+		_, format, err := image.Decode(bytes.NewReader(data))
+		require.NoError(t, err, "Failed to decode image")
+		assert.Equal(t, "jpeg", format, "Expected JPEG image")
+		bodies[options] = data
+	}
+
+	assert.Less(t, len(bodies["q:10/"]), len(bodies["q:95/"]), "Expected lower quality to produce smaller image")
+	// Прогрессивный JPEG отмечается маркером SOF2 и не должен попасть в кэш вместо обычного
+	assert.NotContains(t, string(bodies["q:95/"]), "\xff\xc2", "Expected baseline JPEG")
+	assert.Contains(t, string(bodies["quality:95/pr:1/"]), "\xff\xc2", "Expected progressive JPEG")
+
+	for _, options := range []string{"q:0/", "q:101/", "q:high/", "pr:maybe/"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/200/100/%s%s", port, options, imageURL)
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request for %s", options)
+	}
+}
+
+// Тестируем выбор фильтра интерполяции.
+func TestResampleFilterOption(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	bodies := make(map[string][]byte)
+	for _, options := range []string{"", "rf:nearest/", "resample:linear/"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/f:png/%s%s", port, options, imageURL)
+
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+		bodies[options] = data
+	}
+
+	// Каждый фильтр кэшируется отдельно
+	assert.NotEqual(t, bodies[""], bodies["rf:nearest/"], "Expected different images for different filters")
+	assert.NotEqual(t, bodies["rf:nearest/"], bodies["resample:linear/"], "Expected different images")
+
+	reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/rf:sinc/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request")
+}
+
+// Тестируем политику увеличения маленьких изображений.
+func TestUpscaleOption(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_50x50.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	tests := []struct {
+		options       string
+		width, height int
+	}{
+		{"", 200, 100},
+		{"up:deny/", 50, 25},
+		{"upscale:2x/", 100, 50},
+		{"up:allow/", 200, 100},
+	}
+
+	for _, tt := range tests {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/200/100/%s%s", port, tt.options, imageURL)
+
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+
+		img, _, err := image.Decode(bytes.NewReader(data))
+		require.NoError(t, err, "Failed to decode image")
+		assert.Equal(t, tt.width, img.Bounds().Dx(), "Width mismatch for %s", tt.options)
+		assert.Equal(t, tt.height, img.Bounds().Dy(), "Height mismatch for %s", tt.options)
+	}
+
+	reqURL := fmt.Sprintf("http://localhost:%s/fill/200/100/up:0.5x/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request")
+}
+
+// Тестируем режим pad.
+func TestPadMode(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_1024x252.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	tests := []struct {
+		options    string
+		background color.NRGBA
+	}{
+		{"", color.NRGBA{R: 255, G: 255, B: 255, A: 255}},
+		{"bg:transparent/f:png/", color.NRGBA{}},
+		{"background:0000ff/f:png/", color.NRGBA{B: 255, A: 255}},
+	}
+
+	for _, tt := range tests {
+		reqURL := fmt.Sprintf("http://localhost:%s/pad/300/300/%s%s", port, tt.options, imageURL)
+
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+
+		img, _, err := image.Decode(bytes.NewReader(data))
+		require.NoError(t, err, "Failed to decode image")
+		assert.Equal(t, 300, img.Bounds().Dx(), "Width mismatch")
+		assert.Equal(t, 300, img.Bounds().Dy(), "Height mismatch")
+
+		// Изображение 1024x252 вписывается по ширине, поэтому верхняя полоса заполнена фоном
+		got := color.NRGBAModel.Convert(img.At(150, 5)).(color.NRGBA)
+		assert.InDelta(t, tt.background.R, got.R, 3, "Background mismatch for %s", tt.options)
+		assert.InDelta(t, tt.background.G, got.G, 3, "Background mismatch for %s", tt.options)
+		assert.InDelta(t, tt.background.B, got.B, 3, "Background mismatch for %s", tt.options)
+		assert.Equal(t, tt.background.A, got.A, "Background alpha mismatch for %s", tt.options)
+	}
+
+	reqURL := fmt.Sprintf("http://localhost:%s/pad/300/300/bg:blue/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request")
+}
+
+// Тестируем синтаксис /process/ с опциями обработки.
+func TestProcessEndpoint(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	var requestCount int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requestCount, 1)
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	// Одинаковые параметры в разном порядке и в старом синтаксисе должны использовать одну запись кэша
+	paths := []string{
+		"process/rs:fill:120:80/g:sm/q:70/f:png/plain/",
+		"process/f:png/q:70/gravity:smart/resize:fill:120:80/plain/",
+		"fill/120/80/g:sm/f:png/q:70/",
+	}
+	for _, path := range paths {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%s/%s%s", port, path, imageURL)) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200 for %s", path)
+		assert.Equal(t, "image/png", resp.Header.Get("Content-Type"), "Expected Content-Type to be image/png")
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+		img, _, err := image.Decode(bytes.NewReader(data))
+		require.NoError(t, err, "Failed to decode image")
+		assert.Equal(t, 120, img.Bounds().Dx(), "Width mismatch")
+		assert.Equal(t, 80, img.Bounds().Dy(), "Height mismatch")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requestCount), "Expected equivalent requests to be served from cache")
+
+	// Без опции rs размер изображения не меняется
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/process/f:png/plain/%s", port, imageURL)) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+	cfg, _, err := image.DecodeConfig(resp.Body)
+	require.NoError(t, err, "Failed to decode image config")
+	assert.Equal(t, 256, cfg.Width, "Width mismatch")
+	assert.Equal(t, 126, cfg.Height, "Height mismatch")
+
+	for _, path := range []string{
+		"process/rs:fill:120/plain/",
+		"process/rs:fill:120:80/zoom:2/plain/",
+		"process/rs:fill:120:80/",
+	} {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%s/%s%s", port, path, imageURL)) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request for %s", path)
+	}
+}
+
+// Тестируем коррекции изображения.
+func TestAdjustmentOptions(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	reqURL := fmt.Sprintf("http://localhost:%s/process/rs:fill:100:50/gs:1/bl:2/f:png/plain/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+
+	img, _, err := image.Decode(resp.Body)
+	require.NoError(t, err, "Failed to decode image")
+	for _, p := range []image.Point{{10, 10}, {50, 25}, {90, 40}} {
+		c := color.NRGBAModel.Convert(img.At(p.X, p.Y)).(color.NRGBA)
+		assert.True(t, c.R == c.G && c.G == c.B, "Expected grayscale pixel, got %v", c)
+	}
+
+	for _, option := range []string{"bl:-1", "blur:11", "sh:20", "brightness:150", "gamma:0", "gs:maybe"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/%s/%s", port, option, imageURL)
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request for %s", option)
+	}
+
+	// Без rs коррекции выполнялись бы над исходным изображением
+	for _, option := range []string{"bl:2", "sh:1", "gs:1", "brightness:10"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/process/%s/f:png/plain/%s", port, option, imageURL)
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request for %s", option)
+	}
+}
+
+// Тестируем поворот и отражение.
+func TestRotateFlipOptions(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	// После поворота на 90 градусов изображение вертикальное и вписывается по высоте
+	reqURL := fmt.Sprintf("http://localhost:%s/fit/200/200/rot:90/flip:h/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+
+	cfg, _, err := image.DecodeConfig(resp.Body)
+	require.NoError(t, err, "Failed to decode image config")
+	assert.Equal(t, 98, cfg.Width, "Width mismatch")
+	assert.Equal(t, 200, cfg.Height, "Height mismatch")
+
+	for _, option := range []string{"rot:45", "flip:x"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fit/200/200/%s/%s", port, option, imageURL)
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request for %s", option)
+	}
+}
+
+// Тестируем наложение водяного знака, выбранного в запросе.
+func TestWatermarkOption(t *testing.T) {
+	t.Setenv("WATERMARK_DIR", "./data/watermarks")
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	bodies := make(map[string][]byte)
+	for _, options := range []string{"f:png/", "wm:logo.png/wm_pos:nowe/wm_off:2/f:png/"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/%s%s", port, options, imageURL)
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200 for %s", options)
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+		bodies[options] = data
+	}
+	require.NotEqual(t, bodies["f:png/"], bodies["wm:logo.png/wm_pos:nowe/wm_off:2/f:png/"],
+		"Expected watermarked image to be cached separately")
+
+	img, err := png.Decode(bytes.NewReader(bodies["wm:logo.png/wm_pos:nowe/wm_off:2/f:png/"]))
+	require.NoError(t, err, "Failed to decode image")
+	// Красная рамка логотипа начинается с отступом 2 пикселя от левого верхнего угла
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, color.NRGBAModel.Convert(img.At(3, 3)), "Expected watermark pixel")
+
+	for _, option := range []string{"wm:missing.png", "wm:..%2Fgopher_50x50.jpg", "wm_op:2", "wm_op:0.5"} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/%s/%s", port, option, imageURL)
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request for %s", option)
+	}
+
+	// Без rs водяной знак накладывался бы на исходное изображение
+	reqURL := fmt.Sprintf("http://localhost:%s/process/wm:logo.png/f:png/plain/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request without rs")
+}
+
+// Тестируем обязательный водяной знак из конфигурации.
+func TestEnforcedWatermark(t *testing.T) {
+	t.Setenv("WATERMARK_DIR", "./data/watermarks")
+	t.Setenv("WATERMARK", "logo.png")
+	t.Setenv("WATERMARK_POSITION", "soea")
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	// Параметры водяного знака из запроса не могут изменить обязательный водяной знак
+	reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/wm_op:0/wm_pos:nowe/f:png/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+
+	img, err := png.Decode(resp.Body)
+	require.NoError(t, err, "Failed to decode image")
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, color.NRGBAModel.Convert(img.At(99, 49)), "Expected watermark pixel")
+
+	// Обязательный водяной знак не требует опции rs
+	reqURL = fmt.Sprintf("http://localhost:%s/process/f:png/plain/%s", port, imageURL)
+	resp, err = http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200 without rs")
+
+	img, err = png.Decode(resp.Body)
+	require.NoError(t, err, "Failed to decode image")
+	assert.Equal(t, color.NRGBA{R: 255, A: 255}, color.NRGBAModel.Convert(img.At(255, 125)), "Expected watermark pixel")
+}
+
+// Тестируем, что обязательный водяной знак без каталога водяных знаков не позволяет запустить приложение.
+func TestEnforcedWatermarkWithoutDir(t *testing.T) {
+	t.Setenv("WATERMARK_DIR", "")
+	t.Setenv("WATERMARK", "logo.png")
+	_, err := app.NewApplication("")
+	assert.Error(t, err, "Expected config error")
+}
+
+// Тестируем надпись поверх изображения.
+func TestTextOption(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	var requests atomic.Int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	// "SALE" в base64 с дополнением и без него, опции в разном порядке
+	bodies := make(map[string][]byte)
+	for _, options := range []string{
+		"rs:fill:100:50/f:png",
+		"rs:fill:100:50/txt:U0FMRQ/txt_color:f00/txt_pos:nowe/txt_shadow:000/f:png",
+		"f:png/text_shadow:000000/text_pos:nowe/text_color:ff0000/text:U0FMRQ==/rs:fill:100:50",
+	} {
+		reqURL := fmt.Sprintf("http://localhost:%s/process/%s/plain/%s", port, options, imageURL)
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200 for %s", options)
+
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err, "Failed to read response body")
+		bodies[options] = data
+	}
+	require.NotEqual(t, bodies["rs:fill:100:50/f:png"],
+		bodies["rs:fill:100:50/txt:U0FMRQ/txt_color:f00/txt_pos:nowe/txt_shadow:000/f:png"],
+		"Expected image with text to be cached separately")
+	assert.Equal(t, int32(2), requests.Load(), "Expected equivalent text options to share a cache entry")
+
+	// 48 символов размером 512 пикселей превышают ограничение на размер надписи
+	tooLarge := "txt:" + strings.Repeat("QUFB", 16) + "/txt_size:512"
+	for _, option := range []string{
+		"txt:U0F+RQ", "txt:", "txt_size:2", "txt_color:red", "txt_pos:smart", "txt_size:20", tooLarge,
+	} {
+		reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/%s/%s", port, option, imageURL)
+		resp, err := http.Get(reqURL) //nolint:gosec,noctx
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request for %s", option)
+	}
+
+	// Без rs надпись рисовалась бы на исходном изображении
+	reqURL := fmt.Sprintf("http://localhost:%s/process/txt:U0FMRQ/f:png/plain/%s", port, imageURL)
+	resp, err := http.Get(reqURL) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "Expected status 400 Bad Request without rs")
+}
+
+// Тестируем изменение размера анимированного GIF.
+func TestAnimatedGIF(t *testing.T) {
+	t.Setenv("ANIMATION_MAX_FRAMES", "4")
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "data/animated_64x32.gif")
+	}))
+	defer testServer.Close()
+
+	imageURL := strings.TrimPrefix(testServer.URL, "http://")
+
+	tests := []struct {
+		name        string
+		options     string
+		accept      string
+		contentType string
+		frames      int
+	}{
+		{"source format", "", "", "image/gif", 4},
+		{"explicit gif", "f:gif/", "image/webp", "image/gif", 4},
+		// Формат, выбранный по Accept, не должен терять анимацию
+		{"webp accepted", "", "image/webp", "image/gif", 4},
+		{"explicit png", "f:png/", "", "image/png", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqURL := fmt.Sprintf("http://localhost:%s/fill/32/16/%s%s", port, tt.options, imageURL)
+			req, err := http.NewRequest(http.MethodGet, reqURL, nil) //nolint:noctx
+			require.NoError(t, err)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err, "Failed to get image")
+			defer resp.Body.Close()
+
+			require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+			assert.Equal(t, tt.contentType, resp.Header.Get("Content-Type"), "Content-Type mismatch")
+
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err, "Failed to read response body")
+
+			if tt.frames == 1 {
+				img, _, err := image.Decode(bytes.NewReader(data))
+				require.NoError(t, err, "Failed to decode image")
+				assert.Equal(t, image.Pt(32, 16), img.Bounds().Size(), "Size mismatch")
+				return
+			}
+			g, err := gif.DecodeAll(bytes.NewReader(data))
+			require.NoError(t, err, "Failed to decode animation")
+			require.Len(t, g.Image, tt.frames, "Frame count mismatch")
+			for _, frame := range g.Image {
+				assert.Equal(t, image.Pt(32, 16), frame.Bounds().Size(), "Frame size mismatch")
+			}
+		})
+	}
+}
+
+// Тестируем выбор кадра анимации.
+func TestFrameOption(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	testServer := httptest.NewServer(http.FileServer(http.Dir("data")))
+	defer testServer.Close()
+
+	host := strings.TrimPrefix(testServer.URL, "http://")
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		frames int
+	}{
+		{"animation", "fill/32/16/%s/animated_64x32.gif", http.StatusOK, 4},
+		// Кадр анимации не должен попасть в ту же запись кэша, что и анимация
+		{"still", "fill/32/16/still:1/%s/animated_64x32.gif", http.StatusOK, 1},
+		{"frame", "process/rs:fill:32:16/frame:2/plain/%s/animated_64x32.gif", http.StatusOK, 1},
+		{"webp frame", "fill/32/16/frame:1/f:gif/%s/animated_64x32.webp", http.StatusOK, 1},
+		{"missing frame", "fill/32/16/frame:4/%s/animated_64x32.gif", http.StatusUnprocessableEntity, 0},
+		{"invalid frame", "fill/32/16/frame:-1/%s/animated_64x32.gif", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqURL := fmt.Sprintf("http://localhost:%s/"+tt.path, port, host)
+			resp, err := http.Get(reqURL) //nolint:gosec,noctx
+			require.NoError(t, err, "Failed to get image")
+			defer resp.Body.Close()
+			require.Equal(t, tt.status, resp.StatusCode, "Status mismatch")
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			g, err := gif.DecodeAll(resp.Body)
+			require.NoError(t, err, "Failed to decode image")
+			assert.Len(t, g.Image, tt.frames, "Frame count mismatch")
+		})
+	}
+}
+
+// Тестируем ограничения размера и разрешения исходного изображения.
+func TestSourceLimits(t *testing.T) {
+	t.Setenv("MAX_SOURCE_SIZE", "50000")
+	t.Setenv("MAX_SOURCE_RESOLUTION", "0.1")
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	files := http.FileServer(http.Dir("data"))
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Ответ без Content-Length проверяется при чтении
+		if name, ok := strings.CutPrefix(r.URL.Path, "/chunked/"); ok {
+			data, err := os.ReadFile(filepath.Join("data", name))
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			w.Write(data)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+
+	host := strings.TrimPrefix(testServer.URL, "http://")
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"within limits", "fill/100/50/%s/gopher_256x126.jpg", http.StatusOK},
+		{"too large", "fill/100/50/%s/gopher_2000x1000.jpg", http.StatusRequestEntityTooLarge},
+		{"too large without length", "fill/100/50/%s/chunked/gopher_2000x1000.jpg", http.StatusRequestEntityTooLarge},
+		{"too many pixels", "fill/100/50/%s/gopher_500x500.jpg", http.StatusUnprocessableEntity},
+		// Размер результата ограничивается независимо от размера исходного изображения
+		{"output too large", "pad/50000/50000/%s/gopher_50x50.jpg", http.StatusUnprocessableEntity},
+		{"process output too large", "process/rs:fill:50000:50000/plain/%s/gopher_50x50.jpg",
+			http.StatusUnprocessableEntity},
+		{"zero width", "fill/0/50/%s/gopher_50x50.jpg", http.StatusBadRequest},
+		{"negative height", "fit/50/-1/%s/gopher_50x50.jpg", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqURL := fmt.Sprintf("http://localhost:%s/"+tt.path, port, host)
+			resp, err := http.Get(reqURL) //nolint:gosec,noctx
+			require.NoError(t, err, "Failed to get image")
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode, "Status mismatch")
+		})
+	}
+}
+
+// Тестируем загрузку изображений по HTTPS.
+func TestHTTPSSource(t *testing.T) {
+	testServer := httptest.NewTLSServer(http.FileServer(http.Dir("data")))
+	defer testServer.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: testServer.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, certificate, 0o600))
+
+	host := strings.TrimPrefix(testServer.URL, "https://")
+
+	t.Run("trusted CA", func(t *testing.T) {
+		t.Setenv("SOURCE_SCHEME", "https")
+		t.Setenv("TLS_CA_FILE", caFile)
+		application, port, err := startTestApplication()
+		require.NoError(t, err)
+		defer stopTestApplication(application)
+
+		tests := []struct {
+			name   string
+			source string
+			status int
+		}{
+			{"default scheme", "%s/gopher_256x126.jpg", http.StatusOK},
+			{"explicit scheme", "https://%s/gopher_256x126.jpg", http.StatusOK},
+			{"normalized scheme", "https:/%s/gopher_256x126.jpg", http.StatusOK},
+			{"secure marker", "s/%s/gopher_256x126.jpg", http.StatusOK},
+			// Явно заданная схема http не заменяется схемой по умолчанию
+			{"explicit http", "http:/%s/gopher_256x126.jpg", http.StatusBadRequest},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/"+tt.source, port, host)
+				resp, err := http.Get(reqURL) //nolint:gosec,noctx
+				require.NoError(t, err, "Failed to get image")
+				defer resp.Body.Close()
+				assert.Equal(t, tt.status, resp.StatusCode, "Status mismatch")
+			})
+		}
+	})
+
+	tests := []struct {
+		name     string
+		insecure string
+		status   int
+	}{
+		{"untrusted certificate", "false", http.StatusBadGateway},
+		{"insecure skip verify", "true", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TLS_INSECURE_SKIP_VERIFY", tt.insecure)
+			application, port, err := startTestApplication()
+			require.NoError(t, err)
+			defer stopTestApplication(application)
+
+			reqURL := fmt.Sprintf("http://localhost:%s/fill/100/50/s/%s/gopher_256x126.jpg", port, host)
+			resp, err := http.Get(reqURL) //nolint:gosec,noctx
+			require.NoError(t, err, "Failed to get image")
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode, "Status mismatch")
+		})
+	}
+}
+
+// Тестируем URL изображения с параметрами в кодированном виде.
+func TestEncodedSourceURL(t *testing.T) {
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	// Изображение отдается только с параметрами v=3 и token=a/b
+	var requests atomic.Int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/img" || r.URL.RawQuery != "v=3&token=a%2Fb" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	host := strings.TrimPrefix(testServer.URL, "http://")
+	source := testServer.URL + "/img?v=3&token=a%2Fb"
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"request query", "fill/100/50/" + host + "/img?v=3&token=a%2Fb"},
+		{"percent-encoded", "process/rs:fill:100:50/plain/" + url.PathEscape(source)},
+		{"percent-encoded with fragment", "fill/100/50/plain/" + url.PathEscape(source+"#preview")},
+		{"base64", "process/rs:fill:100:50/b64/" + base64.RawURLEncoding.EncodeToString([]byte(source))},
+		// Схема и хост приводятся к нижнему регистру, а фрагмент отбрасывается
+		{"base64 canonical", "fill/100/50/b64/" + base64.URLEncoding.EncodeToString(
+			[]byte(strings.ToUpper(testServer.URL)+"/img?v=3&token=a%2Fb#preview"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%s/%s", port, tt.path)) //nolint:gosec,noctx
+			require.NoError(t, err, "Failed to get image")
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode, "Status mismatch")
+		})
+	}
+
+	// Все варианты записи URL используют одну запись кэша
+	assert.Equal(t, int32(1), requests.Load(), "Expected equivalent URLs to be served from cache")
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%s/fill/100/50/b64/not*base64", port)) //nolint:gosec,noctx
+	require.NoError(t, err, "Failed to get image")
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Status mismatch")
+}
+
+// Тестируем передачу заголовков серверу источника.
+func TestSourceHeaders(t *testing.T) {
+	var origin, redirected atomic.Pointer[http.Header]
+	redirectServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Clone()
+		redirected.Store(&header)
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer redirectServer.Close()
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, redirectServer.URL+"/img", http.StatusFound)
+			return
+		}
+		header := r.Header.Clone()
+		origin.Store(&header)
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	host := strings.TrimPrefix(testServer.URL, "http://")
+	t.Setenv("FORWARD_HEADERS", "Accept-Language, X-Request-Id, Authorization, Range")
+	t.Setenv("SOURCE_HEADERS", host+" X-Api-Key: secret; example.com X-Api-Key: other")
+	t.Setenv("USER_AGENT", "previewer-test")
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	get := func(source string) {
+		req, err := http.NewRequest(http.MethodGet, //nolint:noctx
+			fmt.Sprintf("http://localhost:%s/fill/100/50/%s", port, source), nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept-Language", "ru")
+		req.Header.Set("X-Request-Id", "42")
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Cookie", "session=1")
+		req.Header.Set("Range", "bytes=0-10")
+		req.Header.Set("User-Agent", "browser")
+		req.Header.Set("X-Api-Key", "client")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err, "Failed to get image")
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, "Expected status 200")
+	}
+
+	get(host + "/img")
+	require.NotNil(t, origin.Load(), "Expected request to the source server")
+	header := *origin.Load()
+	assert.Equal(t, "ru", header.Get("Accept-Language"), "Allowed header was not forwarded")
+	assert.Equal(t, "42", header.Get("X-Request-Id"), "Allowed header was not forwarded")
+	// Запрещенные заголовки не передаются, даже если они разрешены
+	assert.Empty(t, header.Get("Authorization"), "Denied header was forwarded")
+	assert.Empty(t, header.Get("Range"), "Blocked header was forwarded")
+	assert.Empty(t, header.Get("Cookie"), "Header outside of the allowlist was forwarded")
+	assert.Equal(t, "previewer-test", header.Get("User-Agent"), "User-Agent mismatch")
+	assert.Equal(t, []string{"secret"}, header.Values("X-Api-Key"), "Static header mismatch")
+
+	// Постоянные заголовки хоста не передаются на хост, куда перенаправлен запрос
+	get(host + "/redirect")
+	require.NotNil(t, redirected.Load(), "Expected redirect to be followed")
+	header = *redirected.Load()
+	assert.Empty(t, header.Get("X-Api-Key"), "Static header leaked to another host")
+	assert.Equal(t, "42", header.Get("X-Request-Id"), "Allowed header was not forwarded")
+}
+
+// Тестируем запрет загрузки изображений с локальных и частных адресов.
+func TestForbiddenSourceAddress(t *testing.T) {
+	redirectServer := httptest.NewServer(http.FileServer(http.Dir("data")))
+	defer redirectServer.Close()
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, redirectServer.URL+"/gopher_256x126.jpg", http.StatusFound)
+			return
+		}
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	host := strings.TrimPrefix(testServer.URL, "http://")
+	_, testPort, err := net.SplitHostPort(host)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		statuses map[string]int
+	}{
+		{
+			name: "private networks",
+			env:  map[string]string{"TRUSTED_SOURCES": ""},
+			statuses: map[string]int{
+				host + "/img": http.StatusForbidden,
+				// Адрес проверяется после разрешения имени
+				"localhost:" + testPort + "/img": http.StatusForbidden,
+			},
+		},
+		{
+			name: "trusted origin",
+			env:  map[string]string{"TRUSTED_SOURCES": host},
+			statuses: map[string]int{
+				host + "/img": http.StatusOK,
+				// Адрес проверяется и при перенаправлении
+				host + "/redirect":               http.StatusForbidden,
+				"localhost:" + testPort + "/img": http.StatusForbidden,
+			},
+		},
+		{
+			name: "blocked networks",
+			env: map[string]string{
+				"TRUSTED_SOURCES":        "",
+				"BLOCK_PRIVATE_NETWORKS": "false",
+				"BLOCKED_NETWORKS":       "127.0.0.1/32",
+			},
+			statuses: map[string]int{host + "/img": http.StatusForbidden},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			application, port, err := startTestApplication()
+			require.NoError(t, err)
+			defer stopTestApplication(application)
+
+			for source, status := range tt.statuses {
+				resp, err := http.Get(fmt.Sprintf("http://localhost:%s/fill/100/50/%s", port, source)) //nolint:gosec,noctx
+				require.NoError(t, err, "Failed to get image")
+				resp.Body.Close()
+				assert.Equal(t, status, resp.StatusCode, "Status mismatch for %s", source)
+			}
+		})
+	}
+}
+
+// Тестируем списки разрешенных и запрещенных хостов источника.
+func TestSourceHostPolicy(t *testing.T) {
+	var requests atomic.Int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, port, _ := net.SplitHostPort(r.Host)
+		switch r.URL.Path {
+		case "/redirect":
+			// Перенаправление с разрешенного хоста на запрещенный
+			http.Redirect(w, r, "http://127.0.0.2:"+port+"/img", http.StatusFound)
+			return
+		case "/redirect-dot":
+			http.Redirect(w, r, "http://127.0.0.2.:"+port+"/img", http.StatusFound)
+			return
+		}
+		http.ServeFile(w, r, "data/gopher_256x126.jpg")
+	}))
+	defer testServer.Close()
+
+	t.Setenv("ALLOWED_SOURCES", `localhost, ~127\.0\.0\.\d+, *.example.com`)
+	t.Setenv("DENIED_SOURCES", `*.bad.example.com, 127.0.0.2, ~BLOCKED\.example\.com`)
+	application, port, err := startTestApplication()
+	require.NoError(t, err)
+	defer stopTestApplication(application)
+
+	_, testPort, err := net.SplitHostPort(strings.TrimPrefix(testServer.URL, "http://"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		source string
+		status int
+	}{
+		{"exact", "localhost:" + testPort + "/img", http.StatusOK},
+		{"regexp", "127.0.0.1:" + testPort + "/img", http.StatusOK},
+		{"denied exact", "127.0.0.2:" + testPort + "/img", http.StatusForbidden},
+		{"denied wildcard", "cdn.bad.example.com/img", http.StatusForbidden},
+		// Шаблон *.example.com не распространяется на сам домен
+		{"wildcard apex", "example.com/img", http.StatusForbidden},
+		{"not allowed", "example.org/img", http.StatusForbidden},
+		// Регулярное выражение сравнивается без учета регистра
+		{"denied regexp", "blocked.example.com/img", http.StatusForbidden},
+		// Точка в конце полного имени не обходит запрет
+		{"denied exact trailing dot", "127.0.0.2.:" + testPort + "/img", http.StatusForbidden},
+		{"denied wildcard trailing dot", "cdn.bad.example.com./img", http.StatusForbidden},
+		{"denied regexp trailing dot", "blocked.example.com./img", http.StatusForbidden},
+		// Имя с точкой в конце дает тот же ключ кэша, что и без нее, поэтому изображение не загружается повторно
+		{"allowed trailing dot", "localhost.:" + testPort + "/img", http.StatusOK},
+		// Хост проверяется и при перенаправлении
+		{"redirect", "localhost:" + testPort + "/redirect", http.StatusForbidden},
+		{"redirect trailing dot", "localhost:" + testPort + "/redirect-dot", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(fmt.Sprintf("http://localhost:%s/fill/100/50/%s", port, tt.source)) //nolint:gosec,noctx
+			require.NoError(t, err, "Failed to get image")
+			defer resp.Body.Close()
+			assert.Equal(t, tt.status, resp.StatusCode, "Status mismatch")
+			if tt.status == http.StatusForbidden {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Contains(t, string(body), "source host is not allowed", "Unexpected error message")
+			}
+		})
+	}
+
+	// Запрещенные хосты отклоняются до загрузки
+	assert.Equal(t, int32(4), requests.Load(), "Expected only allowed hosts to be fetched")
+}
+
+// Тестируем отказ запуска с ошибкой в списке запрещенных сетей: иначе не действовал бы весь список.
+func TestInvalidBlockedNetworks(t *testing.T) {
+	t.Setenv("BLOCKED_NETWORKS", "203.0.113.0/24, 198.51.100.0/33")
+	_, err := app.NewApplication("")
+	assert.ErrorContains(t, err, "invalid blocked networks", "Expected invalid blocked networks error")
+}
+
+// Тестируем отказ запуска с ошибкой в шаблоне хоста: без шаблона запрет не действовал бы.
+func TestInvalidSourceHostPattern(t *testing.T) {
+	t.Setenv("DENIED_SOURCES", `evil.com, ~evil[`)
+	_, err := app.NewApplication("")
+	assert.ErrorContains(t, err, "invalid source host patterns", "Expected invalid host pattern error")
+}